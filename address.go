@@ -0,0 +1,292 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"strings"
+
+	"golang.org/x/image/font/opentype"
+)
+
+const (
+	// AddressMaxFontSize is the largest the delivery address is drawn, so a
+	// short address on a large label does not fill it.
+	AddressMaxFontSize = 24
+	// PostcodeScale is how much larger than the rest of the address the
+	// postcode is drawn.
+	PostcodeScale = 1.6
+
+	ReturnAddressMaxFontSize = 9
+	ServiceMaxFontSize       = 28
+
+	// AddressBoldFontName is used for the recipient's name, the postcode
+	// and the service indicator.
+	AddressBoldFontName = "Go Bold"
+
+	// AddressGapMM is the space between the parts of an address label.
+	AddressGapMM = 2
+)
+
+// Address is a postal address. Lines are the street address, in order,
+// without the city, postcode or country.
+type Address struct {
+	Name     string   `json:"name"`
+	Lines    []string `json:"lines"`
+	City     string   `json:"city"`
+	Postcode string   `json:"postcode"`
+	Country  string   `json:"country"`
+}
+
+func (a *Address) validate(field string) error {
+	if strings.TrimSpace(a.Name) == "" {
+		return newPrintError(CodeInvalidRequest, nil, "%s.name is required", field)
+	}
+	if len(a.lines()) == 0 {
+		return newPrintError(CodeInvalidRequest, nil, "%s.lines needs at least one line", field)
+	}
+	return nil
+}
+
+// lines are the address lines and city that are not blank.
+func (a *Address) lines() []string {
+	var lines []string
+	for _, line := range a.Lines {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if city := strings.TrimSpace(a.City); city != "" {
+		lines = append(lines, city)
+	}
+	return lines
+}
+
+// oneLine is the whole address on a single line, for the return address.
+func (a *Address) oneLine() string {
+	parts := append([]string{strings.TrimSpace(a.Name)}, a.lines()...)
+	if postcode := strings.TrimSpace(a.Postcode); postcode != "" {
+		parts = append(parts, postcode)
+	}
+	if country := strings.TrimSpace(a.Country); country != "" {
+		parts = append(parts, country)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// AddressLabelRequest is the JSON body of an address label. Service is an
+// indicator such as "Tracked 24" drawn in a box at the top of the label.
+type AddressLabelRequest struct {
+	Format  string   `json:"format"`
+	Rotate  int      `json:"rotate"`
+	To      Address  `json:"to"`
+	From    *Address `json:"from"`
+	Service string   `json:"service"`
+}
+
+func (r *AddressLabelRequest) validate() error {
+	switch r.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return newPrintError(CodeInvalidRequest, nil, "rotate must be 0, 90, 180 or 270, not %d", r.Rotate)
+	}
+
+	if err := r.To.validate("to"); err != nil {
+		return err
+	}
+	if r.From != nil {
+		return r.From.validate("from")
+	}
+	return nil
+}
+
+// addressBlock is a part of the delivery address drawn in its own font and
+// size relative to the rest.
+type addressBlock struct {
+	font  *opentype.Font
+	scale float64
+	text  string
+}
+
+// deliveryBlocks lays the address out as the name in bold, the address
+// lines, the postcode in larger bold type and the country in capitals.
+func deliveryBlocks(address *Address, regular, bold *opentype.Font) []addressBlock {
+	blocks := []addressBlock{
+		{font: bold, scale: 1, text: strings.TrimSpace(address.Name)},
+		{font: regular, scale: 1, text: strings.Join(address.lines(), "\n")},
+	}
+	if postcode := strings.TrimSpace(address.Postcode); postcode != "" {
+		blocks = append(blocks, addressBlock{font: bold, scale: PostcodeScale, text: strings.ToUpper(postcode)})
+	}
+	if country := strings.TrimSpace(address.Country); country != "" {
+		blocks = append(blocks, addressBlock{font: regular, scale: 1, text: strings.ToUpper(country)})
+	}
+	return blocks
+}
+
+// layoutBlocks wraps each block at the given font size, returning the
+// layouts and the height of them stacked one under the other.
+func layoutBlocks(blocks []addressBlock, size float64, width int, breakWords bool) ([]*TextLayout, int, bool, error) {
+	layouts := make([]*TextLayout, len(blocks))
+	height := 0
+	for i, block := range blocks {
+		layout, _, err := layoutText(block.font, TextOptions{Text: block.text, LineSpacing: 1}, size*block.scale, width, math.MaxInt, breakWords)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if layout == nil {
+			return nil, 0, false, nil
+		}
+		layouts[i] = layout
+		height += len(layout.Lines) * layout.LineHeight
+	}
+	return layouts, height, true, nil
+}
+
+// fitBlocks finds the largest size at which the blocks fit in a box of the
+// given size. As with fitText, long lines wrap onto the next line and words
+// are only split if they do not fit whole even at the smallest size.
+func fitBlocks(blocks []addressBlock, width, height int) ([]*TextLayout, error) {
+	var layoutErr error
+	fitsAt := func(breakWords bool) func(size float64) bool {
+		return func(size float64) bool {
+			_, blocksHeight, wrapped, err := layoutBlocks(blocks, size, width, breakWords)
+			if err != nil && layoutErr == nil {
+				layoutErr = err
+			}
+			return wrapped && blocksHeight <= height
+		}
+	}
+
+	breakWords := false
+	size, fits := largestFittingSize(AddressMaxFontSize, DefaultMinFontSize, fitsAt(false))
+	if !fits {
+		breakWords = true
+		size, fits = largestFittingSize(AddressMaxFontSize, DefaultMinFontSize, fitsAt(true))
+	}
+	if layoutErr != nil {
+		return nil, layoutErr
+	}
+	if !fits {
+		return nil, newPrintError(CodeTextDoesNotFit, nil, "the address does not fit on the label even at %gpt", smallestSize(AddressMaxFontSize, DefaultMinFontSize))
+	}
+
+	layouts, _, _, err := layoutBlocks(blocks, size, width, breakWords)
+	return layouts, err
+}
+
+// renderAddressLabel draws the service indicator at the top of the label,
+// the return address at the bottom under a rule and the delivery address in
+// the space between them.
+func renderAddressLabel(request *AddressLabelRequest, format LabelFormat, dimensions LabelDimensions) (*RenderedLabel, error) {
+	regular, err := findFont(DefaultFontName)
+	if err != nil {
+		return nil, err
+	}
+	bold, err := findFont(AddressBoldFontName)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderPrintableArea(format, dimensions, request.Rotate, func(width, height int) (*image.RGBA, error) {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+		gap := mmToDots(AddressGapMM)
+		thickness := mmToDots(DefaultLineThicknessMM)
+		top, bottom := 0, height
+
+		if service := strings.TrimSpace(request.Service); service != "" {
+			band := image.Rect(0, 0, width, height/8)
+			drawOutline(img, band, thickness, color.RGBA{A: 0xff})
+
+			inner := band.Inset(thickness + gap/2)
+			options := TextOptions{
+				Text:        strings.ToUpper(service),
+				Align:       AlignCenter,
+				VAlign:      VAlignMiddle,
+				MaxSize:     ServiceMaxFontSize,
+				MinSize:     DefaultMinFontSize,
+				LineSpacing: 1,
+			}
+			layout, err := fitText(bold, options, inner.Dx(), inner.Dy())
+			if err != nil {
+				return nil, err
+			}
+			draw.Draw(img, inner, layout.render(options, inner.Dx(), inner.Dy()), image.Point{}, draw.Over)
+			top = band.Max.Y + gap
+		}
+
+		if request.From != nil {
+			band := image.Rect(0, height-height/7, width, height)
+			rule := image.Rect(0, band.Min.Y, width, band.Min.Y+thickness)
+			draw.Draw(img, rule, image.Black, image.Point{}, draw.Src)
+
+			inner := image.Rect(0, rule.Max.Y+gap/2, width, height)
+			options := TextOptions{
+				Text:        "Return to: " + request.From.oneLine(),
+				Align:       AlignLeft,
+				VAlign:      VAlignMiddle,
+				MaxSize:     ReturnAddressMaxFontSize,
+				MinSize:     DefaultMinFontSize,
+				LineSpacing: 1,
+			}
+			layout, err := fitText(regular, options, inner.Dx(), inner.Dy())
+			if err != nil {
+				return nil, err
+			}
+			draw.Draw(img, inner, layout.render(options, inner.Dx(), inner.Dy()), image.Point{}, draw.Over)
+			bottom = band.Min.Y - gap
+		}
+
+		layouts, err := fitBlocks(deliveryBlocks(&request.To, regular, bold), width, bottom-top)
+		if err != nil {
+			return nil, err
+		}
+
+		blocksHeight := 0
+		for _, layout := range layouts {
+			blocksHeight += len(layout.Lines) * layout.LineHeight
+		}
+		y := top + (bottom-top-blocksHeight)/2
+		for _, layout := range layouts {
+			blockHeight := len(layout.Lines) * layout.LineHeight
+			box := image.Rect(0, y, width, y+blockHeight)
+			options := TextOptions{Align: AlignLeft, VAlign: VAlignTop}
+			draw.Draw(img, box, layout.render(options, width, blockHeight), image.Point{}, draw.Over)
+			y += blockHeight
+		}
+		return img, nil
+	})
+}
+
+func addressLabel(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		var request AddressLabelRequest
+		if err := decodeJSONBody(req, &request); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		if err := request.validate(); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		format, dimensions, exists := findLabelFormat(request.Format)
+		if !exists {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", request.Format))
+			return
+		}
+
+		label, err := renderAddressLabel(&request, format, dimensions)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		respondWithLabel(rw, req, label)
+	}
+}
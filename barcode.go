@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/code39"
+	"github.com/boombuler/barcode/datamatrix"
+	"github.com/boombuler/barcode/ean"
+	"github.com/boombuler/barcode/pdf417"
+	"github.com/boombuler/barcode/qr"
+	"github.com/boombuler/barcode/twooffive"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	SymbologyCode128    = "code128"
+	SymbologyCode39     = "code39"
+	SymbologyEAN13      = "ean13"
+	SymbologyUPCA       = "upca"
+	SymbologyITF14      = "itf14"
+	SymbologyQR         = "qr"
+	SymbologyDataMatrix = "datamatrix"
+	SymbologyPDF417     = "pdf417"
+
+	// DefaultBarHeightMM is the height of linear barcodes unless the request
+	// sets one, or the space available if that is less.
+	DefaultBarHeightMM = 15
+	// BarcodeTextGap is the space in dots between the bars and the human
+	// readable text under them.
+	BarcodeTextGap = 8
+	// BarcodeTextSize is the largest size in points of the human readable
+	// text, which shrinks to the width of the bars.
+	BarcodeTextSize = 10
+	// pdf417RowModules is the height of each PDF417 row in modules. The
+	// encoder draws rows two pixels tall, less than the three the standard
+	// asks for.
+	pdf417RowModules = 3
+)
+
+// Symbology is a kind of barcode and what it needs around it to scan.
+type Symbology struct {
+	Name string
+	// TwoDimensional codes are scaled the same in both directions. Linear
+	// codes are drawn with bars of any height.
+	TwoDimensional bool
+	// QuietZone is the blank margin in modules each side of the code.
+	QuietZone int
+	Encode    func(data string) (barcode.Barcode, error)
+}
+
+var symbologies = map[string]Symbology{
+	SymbologyCode128: {
+		Name:      "Code 128",
+		QuietZone: 10,
+		Encode: func(data string) (barcode.Barcode, error) {
+			return code128.Encode(data)
+		},
+	},
+	SymbologyCode39: {
+		Name:      "Code 39",
+		QuietZone: 10,
+		Encode: func(data string) (barcode.Barcode, error) {
+			return code39.Encode(data, false, true)
+		},
+	},
+	SymbologyEAN13: {
+		Name:      "EAN-13",
+		QuietZone: 11,
+		Encode: func(data string) (barcode.Barcode, error) {
+			if err := checkDigits(data, 12, 13); err != nil {
+				return nil, err
+			}
+			return ean.Encode(data)
+		},
+	},
+	SymbologyUPCA: {
+		Name:      "UPC-A",
+		QuietZone: 9,
+		Encode: func(data string) (barcode.Barcode, error) {
+			if err := checkDigits(data, 11, 12); err != nil {
+				return nil, err
+			}
+			// A UPC-A code is the EAN-13 code with a leading zero.
+			return ean.Encode("0" + data)
+		},
+	},
+	SymbologyITF14: {
+		Name:      "ITF-14",
+		QuietZone: 10,
+		Encode: func(data string) (barcode.Barcode, error) {
+			if err := checkDigits(data, 13, 14); err != nil {
+				return nil, err
+			}
+			withCheckDigit, err := twooffive.AddCheckSum(data[:13])
+			if err != nil {
+				return nil, err
+			}
+			if len(data) == 14 && data != withCheckDigit {
+				return nil, fmt.Errorf("check digit should be %c", withCheckDigit[13])
+			}
+			return twooffive.Encode(withCheckDigit, true)
+		},
+	},
+	SymbologyQR: {
+		Name:           "QR code",
+		TwoDimensional: true,
+		QuietZone:      4,
+		Encode: func(data string) (barcode.Barcode, error) {
+			return qr.Encode(data, qr.M, qr.Auto)
+		},
+	},
+	SymbologyDataMatrix: {
+		Name:           "Data Matrix",
+		TwoDimensional: true,
+		QuietZone:      1,
+		Encode: func(data string) (barcode.Barcode, error) {
+			return datamatrix.Encode(data)
+		},
+	},
+	SymbologyPDF417: {
+		Name:           "PDF417",
+		TwoDimensional: true,
+		QuietZone:      2,
+		Encode: func(data string) (barcode.Barcode, error) {
+			return pdf417.Encode(data, 2)
+		},
+	},
+}
+
+func checkDigits(data string, lengths ...int) error {
+	for _, r := range data {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("must be digits only")
+		}
+	}
+	for _, length := range lengths {
+		if len(data) == length {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be %d digits, or %d with the check digit", lengths[0], lengths[len(lengths)-1])
+}
+
+// BarcodeOptions control how a barcode is drawn. They are read from the
+// request's form values or query.
+type BarcodeOptions struct {
+	Symbology string
+	Data      string
+	// Module is the width of the narrowest bar, or of each square of a 2D
+	// code, in dots. Zero draws the largest code that fits.
+	Module int
+	// HeightMM is the height of the bars of linear codes.
+	HeightMM      float64
+	HumanReadable bool
+}
+
+// parseBarcodeOptions reads the barcode's options, taking its data from the
+// named value. It returns nil if there is no data.
+func parseBarcodeOptions(req *http.Request, dataKey string) (*BarcodeOptions, error) {
+	options := &BarcodeOptions{
+		Symbology:     req.FormValue("symbology"),
+		Data:          req.FormValue(dataKey),
+		HeightMM:      DefaultBarHeightMM,
+		HumanReadable: true,
+	}
+	if options.Data == "" {
+		return nil, nil
+	}
+
+	if options.Symbology == "" {
+		options.Symbology = SymbologyCode128
+	}
+	if _, exists := symbologies[options.Symbology]; !exists {
+		return nil, newPrintError(CodeInvalidRequest, nil, "symbology must be one of %s, not '%s'", strings.Join(symbologyNames(), ", "), options.Symbology)
+	}
+
+	if module := req.FormValue("module"); module != "" {
+		value, err := strconv.Atoi(module)
+		if err != nil || value < 1 {
+			return nil, newPrintError(CodeInvalidRequest, err, "module must be a whole number of dots")
+		}
+		options.Module = value
+	}
+
+	if height := req.FormValue("height"); height != "" {
+		value, err := strconv.ParseFloat(height, 64)
+		if err != nil || value <= 0 {
+			return nil, newPrintError(CodeInvalidRequest, err, "height must be a positive number of millimetres")
+		}
+		options.HeightMM = value
+	}
+
+	if humanReadable := req.FormValue("human_readable"); humanReadable != "" {
+		value, err := strconv.ParseBool(humanReadable)
+		if err != nil {
+			return nil, newPrintError(CodeInvalidRequest, err, "human_readable must be true or false")
+		}
+		options.HumanReadable = value
+	}
+
+	return options, nil
+}
+
+func symbologyNames() []string {
+	return []string{
+		SymbologyCode128,
+		SymbologyCode39,
+		SymbologyEAN13,
+		SymbologyUPCA,
+		SymbologyITF14,
+		SymbologyQR,
+		SymbologyDataMatrix,
+		SymbologyPDF417,
+	}
+}
+
+// BarcodeLayout is an encoded barcode sized to whole dots per module.
+type BarcodeLayout struct {
+	Code      barcode.Barcode
+	Symbology Symbology
+	Module    int
+	// RowHeight is the height in dots of each row of modules. Linear codes
+	// have one row as tall as the bars.
+	RowHeight int
+	// nativeRowHeight is the height in pixels of each row of the encoder's
+	// image.
+	nativeRowHeight int
+	Text            string
+	TextFace        font.Face
+	// Size includes the quiet zones and the human readable text.
+	Size image.Point
+}
+
+// layoutBarcode encodes the data and picks the module size so the code,
+// its quiet zones and its text fit in the width and height.
+func layoutBarcode(options *BarcodeOptions, width, height int) (*BarcodeLayout, error) {
+	symbology := symbologies[options.Symbology]
+	code, err := symbology.Encode(options.Data)
+	if err != nil {
+		return nil, newPrintError(CodeInvalidRequest, err, "could not encode '%s' as %s: %v", options.Data, symbology.Name, err)
+	}
+
+	layout := &BarcodeLayout{
+		Code:            code,
+		Symbology:       symbology,
+		nativeRowHeight: 1,
+	}
+
+	columns, rows := code.Bounds().Dx(), code.Bounds().Dy()
+	rowModules := 1
+	if options.Symbology == SymbologyPDF417 {
+		layout.nativeRowHeight = 2
+		rows /= layout.nativeRowHeight
+		rowModules = pdf417RowModules
+	}
+	quietZone := symbology.QuietZone
+
+	module := width / (columns + 2*quietZone)
+	if symbology.TwoDimensional {
+		module = min(module, height/(rows*rowModules+2*quietZone))
+	}
+	if options.Module > 0 {
+		if options.Module > module {
+			return nil, newPrintError(CodeBarcodeDoesNotFit, nil, "%s of '%s' is too big for the label with %d dot modules", symbology.Name, options.Data, options.Module)
+		}
+		module = options.Module
+	}
+	if module < 1 {
+		return nil, newPrintError(CodeBarcodeDoesNotFit, nil, "%s of '%s' is too big for the label even with 1 dot modules", symbology.Name, options.Data)
+	}
+	layout.Module = module
+
+	if symbology.TwoDimensional {
+		layout.RowHeight = module * rowModules
+		layout.Size = image.Pt((columns+2*quietZone)*module, rows*layout.RowHeight+2*quietZone*module)
+		return layout, nil
+	}
+
+	barsWidth := columns * module
+	textHeight := 0
+	if options.HumanReadable {
+		layout.Text = code.Content()
+		if options.Symbology == SymbologyUPCA {
+			layout.Text = strings.TrimPrefix(layout.Text, "0")
+		}
+		for size := float64(BarcodeTextSize); size >= DefaultMinFontSize; size -= fontSizeStep {
+			layout.TextFace, err = newFace(regularFont, size)
+			if err != nil {
+				return nil, newPrintError(CodeInternal, err, "could not draw the barcode text")
+			}
+			if textWidth(layout.TextFace, layout.Text) <= barsWidth {
+				break
+			}
+		}
+		metrics := layout.TextFace.Metrics()
+		textHeight = BarcodeTextGap + metrics.Ascent.Ceil() + metrics.Descent.Ceil()
+	}
+
+	layout.RowHeight = min(int(options.HeightMM*DotsPerMM), height-textHeight)
+	if layout.RowHeight < module*10 {
+		return nil, newPrintError(CodeBarcodeDoesNotFit, nil, "there is not enough room on the label for the bars of %s", symbology.Name)
+	}
+	layout.Size = image.Pt((columns+2*quietZone)*module, layout.RowHeight+textHeight)
+	return layout, nil
+}
+
+// draw draws the barcode with its top left corner, including the quiet
+// zone, at the origin. Every module is exactly Module dots wide so bars
+// line up with the print head's dots.
+func (b *BarcodeLayout) draw(dst *image.RGBA, origin image.Point) {
+	draw.Draw(dst, image.Rectangle{Min: origin, Max: origin.Add(b.Size)}, image.White, image.Point{}, draw.Src)
+
+	quietZone := b.Symbology.QuietZone * b.Module
+	top := origin.Y
+	if b.Symbology.TwoDimensional {
+		top += quietZone
+	}
+
+	bounds := b.Code.Bounds()
+	black := &image.Uniform{color.Black}
+
+	for row := 0; row*b.nativeRowHeight < bounds.Dy(); row++ {
+		for column := 0; column < bounds.Dx(); column++ {
+			r, _, _, _ := b.Code.At(bounds.Min.X+column, bounds.Min.Y+row*b.nativeRowHeight).RGBA()
+			if r > 0x7fff {
+				continue
+			}
+			x := origin.X + quietZone + column*b.Module
+			y := top + row*b.RowHeight
+			draw.Draw(dst, image.Rect(x, y, x+b.Module, y+b.RowHeight), black, image.Point{}, draw.Src)
+		}
+	}
+
+	if b.TextFace != nil {
+		x := origin.X + (b.Size.X-textWidth(b.TextFace, b.Text))/2
+		y := top + b.RowHeight + BarcodeTextGap + b.TextFace.Metrics().Ascent.Ceil()
+		drawer := font.Drawer{
+			Dst:  dst,
+			Src:  image.Black,
+			Face: b.TextFace,
+			Dot:  fixed.P(x, y),
+		}
+		drawer.DrawString(b.Text)
+	}
+}
+
+func barcodeLabel(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		formatName := req.FormValue("format")
+		format, dimensions, exists := findLabelFormat(formatName)
+		if !exists {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", formatName))
+			return
+		}
+
+		options, err := parseBarcodeOptions(req, "data")
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		if options == nil {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "data is required"))
+			return
+		}
+
+		rotate, err := parseRightAngle(req)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		label, err := renderPrintableArea(format, dimensions, rotate, func(width, height int) (*image.RGBA, error) {
+			layout, err := layoutBarcode(options, width, height)
+			if err != nil {
+				return nil, err
+			}
+
+			img := image.NewRGBA(image.Rect(0, 0, width, height))
+			draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+			layout.draw(img, image.Pt((width-layout.Size.X)/2, (height-layout.Size.Y)/2))
+			return img, nil
+		})
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		respondWithLabel(rw, req, label)
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+type BatchState string
+
+const (
+	BatchRunning   BatchState = "running"
+	BatchCompleted BatchState = "completed"
+	BatchFailed    BatchState = "failed"
+	BatchCancelled BatchState = "cancelled"
+)
+
+// Batch labels that have not been queued yet are pending, and those passed
+// over by resuming from a later row are skipped. Queued labels take the
+// state of their print job.
+const (
+	LabelPending JobState = "pending"
+	LabelSkipped JobState = "skipped"
+)
+
+// Batch prints one label per record of a stored template, in record order.
+// Each label is queued once the one before it has printed, so a batch never
+// holds more than one job in the queue and other jobs can print in between.
+type Batch struct {
+	ID         string
+	Template   *LabelTemplate
+	Format     LabelFormat
+	Dimensions LabelDimensions
+	Printer    string
+	Strictness string
+	Options    PrintOptions
+	Records    []map[string]string
+
+	logger zerolog.Logger
+
+	mu         sync.Mutex
+	state      BatchState
+	rows       []batchRow
+	createdAt  time.Time
+	finishedAt time.Time
+	err        error
+
+	// cancelled is closed to stop the batch after its current label and
+	// stopped once the batch has stopped. Both are replaced on resume.
+	cancelled chan struct{}
+	stopped   chan struct{}
+}
+
+type batchRow struct {
+	job     *PrintJob
+	err     error
+	skipped bool
+}
+
+func newBatch(logger zerolog.Logger, template *LabelTemplate, format LabelFormat, dimensions LabelDimensions) *Batch {
+	id := xid.New().String()
+	return &Batch{
+		ID:         id,
+		Template:   template,
+		Format:     format,
+		Dimensions: dimensions,
+		logger:     logger.With().Str("batch_id", id).Logger(),
+		createdAt:  time.Now(),
+	}
+}
+
+// newTemplateBatch creates a batch of the named template from a request,
+// reading its printer, strictness and print option values. The records are added with
+// setRecords.
+func newTemplateBatch(req *http.Request, version int, formatName string) (*Batch, error) {
+	strictness, err := parseStrictness(req)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := loadTemplate(req.PathValue("name"), version)
+	if err != nil {
+		return nil, err
+	}
+
+	if formatName == "" {
+		formatName = template.Format
+	}
+	format, dimensions, exists := findLabelFormat(formatName)
+	if !exists {
+		return nil, newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", formatName)
+	}
+
+	printerName := req.FormValue("printer")
+	if printerName != "" {
+		if _, err := labelPrinters[format.Name].member(printerName, format.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	options, err := parsePrintOptions(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := labelPrinters[format.Name].checkPrintOptions(options, printerName); err != nil {
+		return nil, err
+	}
+
+	batch := newBatch(hlog.FromRequest(req).With().Logger(), template, format, dimensions)
+	batch.Printer = printerName
+	batch.Strictness = strictness
+	batch.Options = options
+	return batch, nil
+}
+
+// setRecords checks every record renders and makes them the batch's
+// labels. It must be called before the batch starts.
+func (b *Batch) setRecords(records []map[string]string) error {
+	if err := validateBatch(b.Template, b.Format, b.Dimensions, records, b.Strictness); err != nil {
+		return err
+	}
+
+	b.Records = records
+	b.rows = make([]batchRow, len(records))
+	return nil
+}
+
+// BatchLabel is the progress of one row of a batch.
+type BatchLabel struct {
+	Row       int      `json:"row"`
+	State     JobState `json:"state"`
+	JobID     string   `json:"job_id,omitempty"`
+	Printer   string   `json:"printer,omitempty"`
+	ErrorCode string   `json:"error_code,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+	// Data is the record the label was drawn from.
+	Data map[string]string `json:"data"`
+}
+
+type BatchStatus struct {
+	ID              string       `json:"id"`
+	State           BatchState   `json:"state"`
+	Template        string       `json:"template"`
+	TemplateVersion int          `json:"template_version"`
+	Format          string       `json:"format"`
+	Total           int          `json:"total"`
+	Printed         int          `json:"printed"`
+	NextRow         int          `json:"next_row,omitempty"`
+	CreatedAt       time.Time    `json:"created_at"`
+	FinishedAt      *time.Time   `json:"finished_at,omitempty"`
+	ErrorCode       string       `json:"error_code,omitempty"`
+	Error           string       `json:"error,omitempty"`
+	Labels          []BatchLabel `json:"labels"`
+}
+
+func (b *Batch) Status() BatchStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BatchStatus{
+		ID:              b.ID,
+		State:           b.state,
+		Template:        b.Template.Name,
+		TemplateVersion: b.Template.Version,
+		Format:          b.Format.Name,
+		Total:           len(b.rows),
+		NextRow:         b.nextRow(),
+		CreatedAt:       b.createdAt,
+		Labels:          make([]BatchLabel, len(b.rows)),
+	}
+	if !b.finishedAt.IsZero() {
+		finishedAt := b.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+
+	var printErr *PrintError
+	if errors.As(b.err, &printErr) {
+		status.ErrorCode = printErr.Code
+		status.Error = printErr.Detail
+	}
+
+	for i, row := range b.rows {
+		label := BatchLabel{Row: i + 1, State: LabelPending, Data: b.Records[i]}
+		switch {
+		case row.job != nil:
+			jobStatus := row.job.Status()
+			label.State = jobStatus.State
+			label.JobID = jobStatus.ID
+			label.Printer = jobStatus.Printer
+			label.ErrorCode = jobStatus.ErrorCode
+			label.Error = jobStatus.Error
+			label.Warnings = jobStatus.Warnings
+		case row.err != nil:
+			label.State = JobFailed
+			if errors.As(row.err, &printErr) {
+				label.ErrorCode = printErr.Code
+				label.Error = printErr.Detail
+			}
+		case row.skipped:
+			label.State = LabelSkipped
+		}
+		if label.State == JobCompleted {
+			status.Printed++
+		}
+		status.Labels[i] = label
+	}
+
+	return status
+}
+
+// nextRow is the first row, numbered from 1, that has not printed, or 0 if
+// every row has.
+func (b *Batch) nextRow() int {
+	for i, row := range b.rows {
+		if row.job == nil || row.job.Status().State != JobCompleted {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (b *Batch) finishedBefore(t time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.finishedAt.IsZero() && b.finishedAt.Before(t)
+}
+
+// validateBatch renders every record before any are printed so a bad row
+// fails the whole batch up front rather than part way through. It returns
+// the problem with every row that failed.
+func validateBatch(template *LabelTemplate, format LabelFormat, dimensions LabelDimensions, records []map[string]string, strictness string) error {
+	var problems []RowProblem
+	for i, data := range records {
+		label, err := template.render(format, dimensions, data)
+		if err == nil {
+			_, err = label.checkPrintableArea(strictness)
+		}
+		if err == nil {
+			continue
+		}
+
+		var printErr *PrintError
+		if !errors.As(err, &printErr) {
+			return err
+		}
+		problems = append(problems, RowProblem{Row: i + 1, Code: printErr.Code, Detail: printErr.Detail})
+	}
+
+	if len(problems) > 0 {
+		printErr := newPrintError(CodeInvalidBatch, nil, "%d of %d rows cannot be printed, starting with row %d: %s", len(problems), len(records), problems[0].Row, problems[0].Detail)
+		printErr.Rows = problems
+		return printErr
+	}
+	return nil
+}
+
+// start prints the batch from the row at index from in the background.
+// Rows before it that were never queued are marked as skipped.
+func (b *Batch) start(from int) {
+	b.mu.Lock()
+	for i := range b.rows {
+		switch {
+		case i >= from:
+			b.rows[i] = batchRow{}
+		case b.rows[i].job == nil && b.rows[i].err == nil:
+			b.rows[i].skipped = true
+		}
+	}
+	b.state = BatchRunning
+	b.err = nil
+	b.finishedAt = time.Time{}
+	b.cancelled = make(chan struct{})
+	b.stopped = make(chan struct{})
+	cancelled, stopped := b.cancelled, b.stopped
+	b.mu.Unlock()
+
+	b.logger.Info().Int("from_row", from+1).Int("total", len(b.rows)).Msg("Starting batch")
+	go b.run(from, cancelled, stopped)
+}
+
+func (b *Batch) run(from int, cancelled, stopped chan struct{}) {
+	defer close(stopped)
+
+	for i := from; i < len(b.Records); i++ {
+		select {
+		case <-cancelled:
+			b.stop(BatchCancelled, nil)
+			return
+		default:
+		}
+
+		job, err := b.submit(i)
+		if err != nil {
+			b.mu.Lock()
+			b.rows[i].err = err
+			b.mu.Unlock()
+			b.stop(BatchFailed, err)
+			return
+		}
+
+		select {
+		case <-job.done:
+		case <-cancelled:
+			// A label already being printed is left to finish.
+			if queue := printQueue(job.Status().Printer); queue != nil {
+				queue.cancel(job)
+			}
+			<-job.done
+		}
+
+		switch job.Status().State {
+		case JobCompleted:
+		case JobCancelled:
+			b.stop(BatchCancelled, nil)
+			return
+		default:
+			b.stop(BatchFailed, job.Err())
+			return
+		}
+	}
+
+	b.stop(BatchCompleted, nil)
+}
+
+// submit renders the record at index i and queues it.
+func (b *Batch) submit(i int) (*PrintJob, error) {
+	label, err := b.Template.render(b.Format, b.Dimensions, b.Records[i])
+	if err != nil {
+		return nil, err
+	}
+	warnings, err := label.checkPrintableArea(b.Strictness)
+	if err != nil {
+		return nil, err
+	}
+
+	job := newPrintJob(b.logger.With().Int("row", i+1).Logger(), b.Format.Name)
+	job.Options = b.Options
+	job.Warnings = warnings
+	if err := label.save(job.FilePath); err != nil {
+		return nil, err
+	}
+
+	pool := labelPrinters[b.Format.Name]
+	if b.Printer != "" {
+		if err := pool.SubmitTo(job, b.Printer); err != nil {
+			job.finish(JobFailed, err)
+			return nil, err
+		}
+	} else {
+		pool.Submit(job)
+	}
+
+	b.mu.Lock()
+	b.rows[i].job = job
+	b.mu.Unlock()
+	return job, nil
+}
+
+func (b *Batch) stop(state BatchState, err error) {
+	b.mu.Lock()
+	b.state = state
+	b.err = err
+	b.finishedAt = time.Now()
+	b.mu.Unlock()
+
+	b.logger.Info().Str("state", string(state)).Msg("Batch finished")
+}
+
+// cancel stops the batch once its current label has printed, or straight
+// away if that label is still waiting in the queue. It waits up to
+// PrintWaitTimeout for the batch to stop.
+func (b *Batch) cancel(req *http.Request) {
+	b.mu.Lock()
+	if b.state != BatchRunning {
+		b.mu.Unlock()
+		return
+	}
+	select {
+	case <-b.cancelled:
+	default:
+		close(b.cancelled)
+	}
+	stopped := b.stopped
+	b.mu.Unlock()
+
+	select {
+	case <-stopped:
+	case <-time.After(PrintWaitTimeout):
+	case <-req.Context().Done():
+	}
+}
+
+// resume restarts a failed or cancelled batch from a row numbered from 1,
+// or from its first row that has not printed if row is 0.
+func (b *Batch) resume(row int) error {
+	b.mu.Lock()
+	if b.state != BatchFailed && b.state != BatchCancelled {
+		defer b.mu.Unlock()
+		return newPrintError(CodeBatchNotResumable, nil, "batch is %s, only failed or cancelled batches can be resumed", b.state)
+	}
+	if row == 0 {
+		row = b.nextRow()
+	}
+	if row < 1 || row > len(b.Records) {
+		defer b.mu.Unlock()
+		return newPrintError(CodeInvalidRequest, nil, "from_row must be between 1 and %d", len(b.Records))
+	}
+	// Claim the batch so a second resume cannot start it twice.
+	b.state = BatchRunning
+	b.mu.Unlock()
+
+	b.start(row - 1)
+	return nil
+}
+
+// BatchStore keeps batches for JobRetention after they finish, like the
+// jobs they print.
+type BatchStore struct {
+	mu      sync.Mutex
+	batches map[string]*Batch
+}
+
+var batchStore = &BatchStore{batches: map[string]*Batch{}}
+
+func (s *BatchStore) add(batch *Batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[batch.ID] = batch
+}
+
+func (s *BatchStore) get(id string) (*Batch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch, exists := s.batches[id]
+	return batch, exists
+}
+
+func (s *BatchStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-JobRetention)
+	for id, batch := range s.batches {
+		if batch.finishedBefore(cutoff) {
+			delete(s.batches, id)
+		}
+	}
+}
+
+const (
+	// MaxBatchSize limits the size of a batch request body.
+	MaxBatchSize = 10 << 20
+	// MaxBatchRecords limits how many labels one batch prints.
+	MaxBatchRecords = 10000
+)
+
+// BatchRequest is the JSON body of a batch. A bare JSON array of records is
+// accepted too.
+type BatchRequest struct {
+	// Version is the template version to print, or 0 for the latest.
+	Version int `json:"version"`
+	// Format overrides the template's label format.
+	Format  string           `json:"format"`
+	Records []map[string]any `json:"records"`
+}
+
+// readBatchRequest reads the records of a batch from a CSV body, whose
+// header row names the template variables, or a JSON body. The version and
+// format can also be given in the query.
+func readBatchRequest(req *http.Request) (BatchRequest, []map[string]string, error) {
+	var batchRequest BatchRequest
+	var records []map[string]string
+
+	req.Body = http.MaxBytesReader(nil, req.Body, MaxBatchSize)
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		csvRecords, err := readCSVRecords(req.Body)
+		if err != nil {
+			return batchRequest, nil, err
+		}
+		records = csvRecords
+	case "application/json", "":
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return batchRequest, nil, batchBodyError(err, "could not read request body")
+		}
+
+		if err := decodeBatchJSON(body, &batchRequest); err != nil {
+			return batchRequest, nil, err
+		}
+
+		for _, record := range batchRequest.Records {
+			records = append(records, templateData(record))
+		}
+	default:
+		return batchRequest, nil, newPrintError(CodeInvalidRequest, nil, "batch body must be text/csv or application/json, not '%s'", mediaType)
+	}
+
+	if len(records) == 0 {
+		return batchRequest, nil, newPrintError(CodeInvalidRequest, nil, "batch has no records")
+	}
+	if len(records) > MaxBatchRecords {
+		return batchRequest, nil, newPrintError(CodeInvalidRequest, nil, "batch can have at most %d records", MaxBatchRecords)
+	}
+
+	if batchRequest.Version == 0 && req.URL.Query().Has("version") {
+		version, err := strconv.Atoi(req.URL.Query().Get("version"))
+		if err != nil || version < 1 {
+			return batchRequest, nil, newPrintError(CodeInvalidRequest, err, "version must be a positive whole number")
+		}
+		batchRequest.Version = version
+	}
+	if batchRequest.Format == "" {
+		batchRequest.Format = req.URL.Query().Get("format")
+	}
+
+	return batchRequest, records, nil
+}
+
+// batchBodyError describes an error reading a batch body, saying so if the
+// body was too large.
+func batchBodyError(err error, message string) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return newPrintError(CodeInvalidRequest, err, "batch should be fewer than %dMB", MaxBatchSize>>20)
+	}
+	return newPrintError(CodeInvalidRequest, err, "%s: %v", message, err)
+}
+
+// decodeBatchJSON decodes a BatchRequest, or a bare array of records.
+func decodeBatchJSON(body []byte, batchRequest *BatchRequest) error {
+	var err error
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = decoder.Decode(&batchRequest.Records)
+	} else {
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(batchRequest)
+	}
+	if err != nil {
+		return newPrintError(CodeInvalidRequest, err, "could not parse request body: %v", err)
+	}
+	return nil
+}
+
+// readCSVRecords reads a CSV file whose header row names the template
+// variables, one row at a time, stopping once there are more than
+// MaxBatchRecords. A byte order mark left by spreadsheet exports is ignored.
+func readCSVRecords(body io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(body)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, newPrintError(CodeInvalidRequest, nil, "CSV has no header row")
+	}
+	if err != nil {
+		return nil, batchBodyError(err, "could not parse CSV")
+	}
+	header = slices.Clone(header)
+	for i, name := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+	}
+
+	var records []map[string]string
+	for len(records) <= MaxBatchRecords {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, batchBodyError(err, "could not parse CSV")
+		}
+		record := make(map[string]string, len(header))
+		for i, name := range header {
+			record[name] = row[i]
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func templateBatch(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		batchRequest, records, err := readBatchRequest(req)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		batch, err := newTemplateBatch(req, batchRequest.Version, batchRequest.Format)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		if err := batch.setRecords(records); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		batchStore.add(batch)
+		batch.start(0)
+
+		writeBatchStatus(rw, req, batch, http.StatusAccepted)
+	}
+}
+
+func batch(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		batch, exists := batchStore.get(req.PathValue("id"))
+		if !exists {
+			hlog.FromRequest(req).Info().Msgf("Batch '%s' not found", req.PathValue("id"))
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeBatchStatus(rw, req, batch, http.StatusOK)
+	}
+}
+
+func batchCancel(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		batch, exists := batchStore.get(req.PathValue("id"))
+		if !exists {
+			hlog.FromRequest(req).Info().Msgf("Batch '%s' not found", req.PathValue("id"))
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		batch.cancel(req)
+		writeBatchStatus(rw, req, batch, http.StatusOK)
+	}
+}
+
+func batchResume(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		batch, exists := batchStore.get(req.PathValue("id"))
+		if !exists {
+			hlog.FromRequest(req).Info().Msgf("Batch '%s' not found", req.PathValue("id"))
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var fromRow int
+		if value := req.FormValue("from_row"); value != "" {
+			row, err := strconv.Atoi(value)
+			if err != nil {
+				writeProblem(rw, req, newPrintError(CodeInvalidRequest, err, "from_row must be a whole number"))
+				return
+			}
+			fromRow = row
+		}
+
+		if err := batch.resume(fromRow); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		writeBatchStatus(rw, req, batch, http.StatusAccepted)
+	}
+}
+
+// writeBatchStatus responds with the batch's progress and its Location to
+// poll.
+func writeBatchStatus(rw http.ResponseWriter, req *http.Request, batch *Batch, status int) {
+	rw.Header().Set("Location", "/batches/"+batch.ID)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	writeJSON(rw, req, batch.Status())
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// DefaultCarrierFormat is the shipping label format carrier labels are
+	// printed on unless their profile names another.
+	DefaultCarrierFormat = "102x152"
+	// BlankInkFraction is the share of a label's dots below which it is
+	// treated as blank, so stray specks on an empty page do not print.
+	BlankInkFraction = 0.002
+)
+
+// CropRegion is a part of a page as fractions of its width and height,
+// measured from its top left corner. The zero region is the whole page.
+type CropRegion struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// CarrierProfile describes where a carrier puts its label on the page it
+// is downloaded as, and how to turn that into a label to print.
+type CarrierProfile struct {
+	Crop CropRegion `json:"crop"`
+	// Trim removes the white space around the label after cropping, so the
+	// label fills the target format wherever it sits in the crop region.
+	Trim bool `json:"trim"`
+	// Rotate is auto, 0, 90, 180 or 270, as for /print.
+	Rotate string `json:"rotate"`
+	Format string `json:"format"`
+}
+
+// builtInCarrierProfiles cover the usual layouts: an A6 page that is the
+// label, and an A6 label in a quarter of an A4 page.
+var builtInCarrierProfiles = map[string]CarrierProfile{
+	"a6":              {Trim: true},
+	"a4-top-left":     {Crop: CropRegion{X: 0, Y: 0, Width: 0.5, Height: 0.5}, Trim: true},
+	"a4-top-right":    {Crop: CropRegion{X: 0.5, Y: 0, Width: 0.5, Height: 0.5}, Trim: true},
+	"a4-bottom-left":  {Crop: CropRegion{X: 0, Y: 0.5, Width: 0.5, Height: 0.5}, Trim: true},
+	"a4-bottom-right": {Crop: CropRegion{X: 0.5, Y: 0.5, Width: 0.5, Height: 0.5}, Trim: true},
+}
+
+// findCarrierProfile looks up a profile in the config, then the built-in
+// profiles, filling in its defaults.
+func findCarrierProfile(name string) (CarrierProfile, bool) {
+	profile, exists := config.CarrierProfiles[name]
+	if !exists {
+		profile, exists = builtInCarrierProfiles[name]
+	}
+	if !exists {
+		return profile, false
+	}
+
+	if profile.Crop == (CropRegion{}) {
+		profile.Crop = CropRegion{Width: 1, Height: 1}
+	}
+	if profile.Rotate == "" {
+		profile.Rotate = RotateAuto
+	}
+	if profile.Format == "" {
+		profile.Format = DefaultCarrierFormat
+	}
+	return profile, true
+}
+
+func (p CarrierProfile) validate() error {
+	if p.Crop != (CropRegion{}) {
+		crop := p.Crop
+		if crop.X < 0 || crop.Y < 0 || crop.Width <= 0 || crop.Height <= 0 || crop.X+crop.Width > 1 || crop.Y+crop.Height > 1 {
+			return fmt.Errorf("crop must be fractions of the page that lie inside it")
+		}
+	}
+
+	switch p.Rotate {
+	case "", RotateAuto, "0", "90", "180", "270":
+	default:
+		return fmt.Errorf("rotate must be auto, 0, 90, 180 or 270, not '%s'", p.Rotate)
+	}
+
+	if p.Format != "" {
+		if _, _, exists := findLabelFormat(p.Format); !exists {
+			return fmt.Errorf("label format '%s' does not exist", p.Format)
+		}
+	}
+	return nil
+}
+
+// CarrierProfileInfo is a carrier profile as listed by the API.
+type CarrierProfileInfo struct {
+	Name    string `json:"name"`
+	BuiltIn bool   `json:"built_in"`
+	CarrierProfile
+}
+
+func listCarrierProfiles() []CarrierProfileInfo {
+	var profiles []CarrierProfileInfo
+	for name := range builtInCarrierProfiles {
+		if _, overridden := config.CarrierProfiles[name]; overridden {
+			continue
+		}
+		profile, _ := findCarrierProfile(name)
+		profiles = append(profiles, CarrierProfileInfo{Name: name, BuiltIn: true, CarrierProfile: profile})
+	}
+	for name := range config.CarrierProfiles {
+		profile, _ := findCarrierProfile(name)
+		profiles = append(profiles, CarrierProfileInfo{Name: name, CarrierProfile: profile})
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles
+}
+
+// crop cuts the profile's region out of the page and, if the profile trims,
+// the white space around what is left. cutoff is the luminance below which
+// a pixel counts as printed. It also returns the region's orientation, as
+// trimming can leave a label that is wider than it is tall.
+func (p CarrierProfile) crop(page image.Image, cutoff float64) (*image.RGBA, bool, error) {
+	img := flattenImage(page)
+	width, height := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+
+	region := image.Rect(
+		int(math.Round(p.Crop.X*width)),
+		int(math.Round(p.Crop.Y*height)),
+		int(math.Round((p.Crop.X+p.Crop.Width)*width)),
+		int(math.Round((p.Crop.Y+p.Crop.Height)*height)),
+	).Intersect(img.Bounds())
+	if region.Empty() {
+		return nil, false, newPrintError(CodeInvalidImage, nil, "the crop region of the page is empty")
+	}
+	landscape := region.Dx() > region.Dy()
+
+	if p.Trim {
+		region = contentBounds(img, region, cutoff)
+		if region.Empty() {
+			return nil, false, newPrintError(CodeBlankLabel, nil, "nothing is printed in the crop region of the page")
+		}
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, region.Min, draw.Src)
+	return cropped, landscape, nil
+}
+
+// contentBounds is the smallest rectangle within region holding every pixel
+// darker than cutoff.
+func contentBounds(img *image.RGBA, region image.Rectangle, cutoff float64) image.Rectangle {
+	var bounds image.Rectangle
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if 0.299*float64(c.R)+0.587*float64(c.G)+0.114*float64(c.B) >= cutoff {
+				continue
+			}
+			bounds = bounds.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	return bounds
+}
+
+// inkFraction is the share of the label's dots that print.
+func (l *RenderedLabel) inkFraction() float64 {
+	printed := 0
+	for _, index := range l.Image.Pix {
+		if index != dotWhite {
+			printed++
+		}
+	}
+	return float64(printed) / float64(len(l.Image.Pix))
+}
+
+// renderCarrierLabel crops a carrier's page with the profile and scales it
+// to fit the printable area of the profile's label format, refusing labels
+// that come out blank.
+func renderCarrierLabel(req *http.Request, profile CarrierProfile, page image.Image) (*RenderedLabel, error) {
+	format, dimensions, exists := findLabelFormat(profile.Format)
+	if !exists {
+		return nil, newPrintError(CodeInternal, nil, "label format '%s' does not exist", profile.Format)
+	}
+
+	options, err := parsePipelineOptions(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cropped, landscape, err := profile.crop(page, float64(100-options.Threshold)/100*255)
+	if err != nil {
+		return nil, err
+	}
+
+	rotate := 0
+	if profile.Rotate == RotateAuto {
+		if landscape != (dimensions.X > dimensions.Y) {
+			rotate = 90
+		}
+	} else {
+		rotate, _ = strconv.Atoi(profile.Rotate)
+	}
+	if rotate != 0 {
+		cropped = rotateImage(cropped, rotate)
+	}
+
+	margins := format.Margins
+	printable := image.Rect(margins.Left, margins.Top, dimensions.X-margins.Right, dimensions.Y-margins.Bottom)
+	img := image.NewRGBA(image.Rect(0, 0, dimensions.X, dimensions.Y))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, printable, fitImage(cropped, LabelDimensions{X: printable.Dx(), Y: printable.Dy()}), image.Point{}, draw.Src)
+
+	options.Rotate = "0"
+	label, err := renderLabel(img, format, dimensions, options)
+	if err != nil {
+		return nil, err
+	}
+	if label.inkFraction() < BlankInkFraction {
+		return nil, newPrintError(CodeBlankLabel, nil, "the cropped label is blank, check the page matches the carrier profile")
+	}
+	return label, nil
+}
+
+func carrierProfiles(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, req, listCarrierProfiles())
+	}
+}
+
+func carrierPrint(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		name := req.PathValue("name")
+		profile, exists := findCarrierProfile(name)
+		if !exists {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "carrier profile '%s' does not exist", name))
+			return
+		}
+
+		var pageImage LabelImage
+		if err := pageImage.retrieveImageFromForm(req); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		defer pageImage.remove(hlog.FromRequest(req).With().Logger())
+
+		// The label is cropped out of the page, so pages are rendered at
+		// the printer's resolution rather than fitted to the format.
+		var labels []*RenderedLabel
+		err := pageImage.eachPage(req.Context(), req.FormValue("pages"), nil, func(page image.Image) error {
+			label, err := renderCarrierLabel(req, profile, page)
+			if err != nil {
+				return err
+			}
+			labels = append(labels, label)
+			return nil
+		})
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		hlog.FromRequest(req).Info().
+			Str("Profile", name).
+			Int("X", pageImage.Dimensions.X).
+			Int("Y", pageImage.Dimensions.Y).
+			Int("Pages", len(labels)).
+			Msg("Cropping carrier label")
+
+		respondWithLabels(rw, req, labels)
+	}
+}
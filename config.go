@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+const (
+	ConfigPathEnvironmentVariable = "LABEL_PRINTER_CONFIG"
+	DefaultConfigPath             = "config.json"
+)
+
+// Duration is a time.Duration that reads and writes as a Go duration string
+// such as "90s" or "1h" in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type Config struct {
+	// StatusPollInterval is how often each printer queue checks whether its
+	// printer is connected and has media loaded.
+	StatusPollInterval Duration `json:"status_poll_interval"`
+	// HeldJobTTL is how long a job may wait for an unavailable printer
+	// before it is expired.
+	HeldJobTTL Duration `json:"held_job_ttl"`
+	// PrinterPools replaces the built-in printer for each label format named
+	// here with a pool of printers and a routing strategy.
+	PrinterPools map[string]PrinterPoolConfig `json:"printer_pools"`
+	// HotplugPollInterval is how often sysfs is scanned for printers being
+	// plugged in or unplugged, as well as whenever the kernel reports it.
+	HotplugPollInterval Duration `json:"hotplug_poll_interval"`
+	// AutoRegisterPrinters adds printers that match no configured printer to
+	// the pools of the label formats their model already prints.
+	AutoRegisterPrinters bool `json:"auto_register_printers"`
+	// PrintableAreaStrictness is what happens to labels with content in the
+	// margins that may be clipped: off, warn or reject. Requests can
+	// override it with their strictness value.
+	PrintableAreaStrictness string `json:"printable_area_strictness"`
+	// FormatMargins sets the margins of the label formats named here, as
+	// measured on the printers, for the printable area checks.
+	FormatMargins map[string]LabelMargins `json:"format_margins"`
+	// FontDirectories are searched for TrueType and OpenType fonts to use
+	// on text labels, alongside the bundled Go fonts.
+	FontDirectories []string `json:"font_directories"`
+	// TemplateDirectory is where label templates are stored, one
+	// subdirectory per template holding a file per version.
+	TemplateDirectory string `json:"template_directory"`
+	// CounterFile is where the serial number counters are saved.
+	CounterFile string `json:"counter_file"`
+	// CarrierProfiles add to or replace the built-in profiles used to crop
+	// carrier shipping labels out of the pages they are downloaded as.
+	CarrierProfiles map[string]CarrierProfile `json:"carrier_profiles"`
+	// ImageURLHosts are the hosts /print may fetch an image_url from. An
+	// entry such as "*.example.com" allows every subdomain. With none,
+	// image URLs are refused.
+	ImageURLHosts []string `json:"image_url_hosts"`
+	// HotFolders are directories watched for label files to print.
+	HotFolders []HotFolderConfig `json:"hot_folders"`
+	// HotFolderPollInterval is how often hot folders are scanned. A file is
+	// printed once it has not changed for one interval.
+	HotFolderPollInterval Duration `json:"hot_folder_poll_interval"`
+	// SQS pulls print jobs from a queue, for when the server should not be
+	// reachable from outside.
+	SQS SQSConfig `json:"sqs"`
+	// Tunnel opens a localtunnel to the HTTP API and saves its URL in
+	// Parameter Store. With it off the API only listens on localhost.
+	Tunnel bool `json:"tunnel"`
+	// IPPAddress is the address the IPP server listens on, such as ":631".
+	// The IPP server is off if it is not set.
+	IPPAddress string `json:"ipp_address"`
+	// RawPrinters take jobs sent straight to a socket, as to port 9100 of a
+	// network printer.
+	RawPrinters []RawPrinterConfig `json:"raw_printers"`
+	// LPDAddress is the address the LPD server listens on, such as ":515".
+	// The LPD server is off if it is not set.
+	LPDAddress string `json:"lpd_address"`
+	// NetworkClients are the addresses and prefixes, such as "10.1.0.0/16",
+	// raw and LPD clients may print from. With none, only this host may.
+	NetworkClients []string `json:"network_clients"`
+}
+
+var config = Config{
+	StatusPollInterval:      Duration(10 * time.Second),
+	HeldJobTTL:              Duration(time.Hour),
+	HotplugPollInterval:     Duration(5 * time.Second),
+	AutoRegisterPrinters:    true,
+	PrintableAreaStrictness: StrictnessWarn,
+	FontDirectories:         []string{"fonts", "/usr/share/fonts"},
+	TemplateDirectory:       "templates",
+	CounterFile:             "counters.json",
+	HotFolderPollInterval:   Duration(2 * time.Second),
+	SQS: SQSConfig{
+		WaitTime:          Duration(SQSMaxWaitTime),
+		VisibilityTimeout: Duration(time.Minute),
+		MaxMessages:       1,
+	},
+	Tunnel: true,
+}
+
+// loadConfig overlays the JSON file named by LABEL_PRINTER_CONFIG, or
+// config.json in the working directory, onto the defaults. A missing file is
+// not an error so the server still runs with no configuration at all.
+func loadConfig() error {
+	path := os.Getenv(ConfigPathEnvironmentVariable)
+	if path == "" {
+		path = DefaultConfigPath
+	}
+
+	configBytes, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Info().Str("path", path).Msg("No config file, using defaults")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read config file '%s': %w", path, err)
+	}
+
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return fmt.Errorf("could not parse config file '%s': %w", path, err)
+	}
+
+	if !strictnessLevels[config.PrintableAreaStrictness] {
+		return fmt.Errorf("printable_area_strictness must be off, warn or reject, not '%s'", config.PrintableAreaStrictness)
+	}
+
+	intervals := []struct {
+		name  string
+		value Duration
+	}{
+		{"status_poll_interval", config.StatusPollInterval},
+		{"held_job_ttl", config.HeldJobTTL},
+		{"hotplug_poll_interval", config.HotplugPollInterval},
+		{"hot_folder_poll_interval", config.HotFolderPollInterval},
+	}
+	for _, interval := range intervals {
+		if interval.value <= 0 {
+			return fmt.Errorf("%s must be more than 0, not '%s'", interval.name, time.Duration(interval.value))
+		}
+	}
+
+	if config.CounterFile == "" {
+		return errors.New("counter_file must not be empty")
+	}
+
+	for name, profile := range config.CarrierProfiles {
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("carrier profile '%s': %w", name, err)
+		}
+	}
+
+	for _, folder := range config.HotFolders {
+		if err := folder.validate(); err != nil {
+			return fmt.Errorf("hot folder '%s': %w", folder.Path, err)
+		}
+	}
+
+	if config.SQS.QueueURL != "" {
+		if err := config.SQS.validate(); err != nil {
+			return fmt.Errorf("sqs: %w", err)
+		}
+	}
+
+	for _, rawPrinter := range config.RawPrinters {
+		if err := rawPrinter.validate(); err != nil {
+			return fmt.Errorf("raw printer '%s': %w", rawPrinter.Address, err)
+		}
+	}
+
+	networkClients, err = parseNetworkClients(config.NetworkClients)
+	if err != nil {
+		return fmt.Errorf("network_clients: %w", err)
+	}
+
+	log.Info().Str("path", path).Msg("Loaded config")
+	return nil
+}
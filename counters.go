@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// DefaultSerialVariable is the template variable serial numbers are put in
+// unless a request names another.
+const DefaultSerialVariable = "serial"
+
+var counterNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Counter hands out serial numbers such as CAR-000123, with the number
+// padded with zeros to Padding digits.
+type Counter struct {
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Padding   int       `json:"padding"`
+	Next      int64     `json:"next"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (c Counter) validate() error {
+	if !counterNamePattern.MatchString(c.Name) {
+		return newPrintError(CodeInvalidRequest, nil, "counter names may only contain letters, digits, '-' and '_'")
+	}
+	if c.Padding < 0 || c.Padding > 20 {
+		return newPrintError(CodeInvalidRequest, nil, "padding must be between 0 and 20 digits")
+	}
+	if c.Next < 0 {
+		return newPrintError(CodeInvalidRequest, nil, "counters cannot go below 0")
+	}
+	return nil
+}
+
+func (c Counter) format(number int64) string {
+	return fmt.Sprintf("%s%0*d", c.Prefix, c.Padding, number)
+}
+
+// Counters are saved to config.CounterFile every time they change, under
+// countersMu, so a number is never handed out twice, even across restarts.
+var (
+	countersMu sync.Mutex
+	counters   = map[string]*Counter{}
+)
+
+// loadCounters reads the saved counters. A missing file means no counter
+// has been used yet.
+func loadCounters() error {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	counterBytes, err := os.ReadFile(config.CounterFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read counter file '%s': %w", config.CounterFile, err)
+	}
+
+	var saved []*Counter
+	if err := json.Unmarshal(counterBytes, &saved); err != nil {
+		return fmt.Errorf("could not parse counter file '%s': %w", config.CounterFile, err)
+	}
+	for _, counter := range saved {
+		counters[counter.Name] = counter
+	}
+
+	log.Info().Int("Counters", len(counters)).Msg("Loaded counters")
+	return nil
+}
+
+// saveCounters writes every counter to the counter file under a temporary
+// name and renames it, so the file is never left half written. countersMu
+// must be held.
+func saveCounters() error {
+	saved := make([]*Counter, 0, len(counters))
+	for _, counter := range counters {
+		saved = append(saved, counter)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].Name < saved[j].Name
+	})
+
+	counterBytes, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return newPrintError(CodeInternal, err, "could not encode counters")
+	}
+
+	path := config.CounterFile
+	if err := os.WriteFile(path+".tmp", counterBytes, 0644); err != nil {
+		return newPrintError(CodeInternal, err, "could not write counters")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return newPrintError(CodeInternal, err, "could not write counters")
+	}
+	return nil
+}
+
+func listCounters() []Counter {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	list := make([]Counter, 0, len(counters))
+	for _, counter := range counters {
+		list = append(list, *counter)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func findCounter(name string) (Counter, bool) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	counter, exists := counters[name]
+	if !exists {
+		return Counter{}, false
+	}
+	return *counter, true
+}
+
+// setCounter creates a counter or changes its prefix, padding and next
+// number. The next number cannot go back, as that would repeat numbers
+// already printed.
+func setCounter(update Counter) (Counter, error) {
+	if err := update.validate(); err != nil {
+		return Counter{}, err
+	}
+
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	if existing, exists := counters[update.Name]; exists && update.Next < existing.Next {
+		return Counter{}, newPrintError(CodeInvalidRequest, nil, "counter '%s' has already reached %d, next cannot go back to %d", update.Name, existing.Next, update.Next)
+	}
+
+	previous, existed := counters[update.Name]
+	update.UpdatedAt = time.Now().UTC()
+	counters[update.Name] = &update
+	if err := saveCounters(); err != nil {
+		if existed {
+			counters[update.Name] = previous
+		} else {
+			delete(counters, update.Name)
+		}
+		return Counter{}, err
+	}
+	return update, nil
+}
+
+// reserveSerials takes the next count numbers of a counter, creating it
+// from initial if it does not exist, and returns the counter and the first
+// number taken. The numbers are only taken once the counter is saved.
+func reserveSerials(initial Counter, count int) (Counter, int64, error) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	counter, exists := counters[initial.Name]
+	if !exists {
+		if err := initial.validate(); err != nil {
+			return Counter{}, 0, err
+		}
+		counter = &initial
+	}
+
+	first := counter.Next
+	reserved := *counter
+	reserved.Next = first + int64(count)
+	reserved.UpdatedAt = time.Now().UTC()
+	counters[reserved.Name] = &reserved
+	if err := saveCounters(); err != nil {
+		if exists {
+			counters[reserved.Name] = counter
+		} else {
+			delete(counters, reserved.Name)
+		}
+		return Counter{}, 0, err
+	}
+	return reserved, first, nil
+}
+
+func counterList(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, req, listCounters())
+	}
+}
+
+func counter(rw http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+
+	switch req.Method {
+	case http.MethodGet:
+		counter, exists := findCounter(name)
+		if !exists {
+			hlog.FromRequest(req).Info().Msgf("Counter '%s' not found", name)
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(rw, req, counter)
+
+	case http.MethodPut:
+		var update Counter
+		if err := decodeJSONBody(req, &update); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		update.Name = name
+
+		counter, err := setCounter(update)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		hlog.FromRequest(req).Info().
+			Str("Counter", counter.Name).
+			Int64("Next", counter.Next).
+			Msg("Set counter")
+		writeJSON(rw, req, counter)
+	}
+}
+
+// SerialRequest prints Count labels of a template, each with the next
+// number of a counter in Variable.
+type SerialRequest struct {
+	// Version is the template version to print, or 0 for the latest.
+	Version int `json:"version"`
+	// Format overrides the template's label format.
+	Format   string `json:"format"`
+	Counter  string `json:"counter"`
+	Variable string `json:"variable"`
+	Count    int    `json:"count"`
+	// Prefix, Padding and Start set up the counter the first time it is
+	// used and are ignored after that.
+	Prefix  string         `json:"prefix"`
+	Padding int            `json:"padding"`
+	Start   *int64         `json:"start"`
+	Data    map[string]any `json:"data"`
+}
+
+// MaxSerialCount limits how many labels one serial request prints.
+const MaxSerialCount = 1000
+
+func templateSerials(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		var serialRequest SerialRequest
+		if err := decodeJSONBody(req, &serialRequest); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		if serialRequest.Counter == "" {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "counter is required"))
+			return
+		}
+		if serialRequest.Count < 1 || serialRequest.Count > MaxSerialCount {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "count must be between 1 and %d", MaxSerialCount))
+			return
+		}
+		variable := serialRequest.Variable
+		if variable == "" {
+			variable = DefaultSerialVariable
+		}
+
+		batch, err := newTemplateBatch(req, serialRequest.Version, serialRequest.Format)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		if !slices.Contains(batch.Template.variables(), variable) {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "template '%s' has no {{%s}} variable to put the serial number in", batch.Template.Name, variable))
+			return
+		}
+
+		initial := Counter{
+			Name:    serialRequest.Counter,
+			Prefix:  serialRequest.Prefix,
+			Padding: serialRequest.Padding,
+			Next:    1,
+		}
+		if serialRequest.Start != nil {
+			initial.Next = *serialRequest.Start
+		}
+
+		// The labels are drawn and checked with the numbers the counter
+		// would give now, without holding it, so other requests can take
+		// numbers meanwhile. Once the numbers are taken they replace these.
+		placeholder, exists := findCounter(initial.Name)
+		if !exists {
+			if err := initial.validate(); err != nil {
+				writeProblem(rw, req, err)
+				return
+			}
+			placeholder = initial
+		}
+
+		data := templateData(serialRequest.Data)
+		records := make([]map[string]string, serialRequest.Count)
+		for i := range records {
+			record := make(map[string]string, len(data)+1)
+			for name, value := range data {
+				record[name] = value
+			}
+			record[variable] = placeholder.format(placeholder.Next + int64(i))
+			records[i] = record
+		}
+		if err := batch.setRecords(records); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		counter, first, err := reserveSerials(initial, serialRequest.Count)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		for i, record := range records {
+			record[variable] = counter.format(first + int64(i))
+		}
+
+		hlog.FromRequest(req).Info().
+			Str("Counter", counter.Name).
+			Str("First", batch.Records[0][variable]).
+			Str("Last", batch.Records[len(batch.Records)-1][variable]).
+			Str("BatchID", batch.ID).
+			Msg("Reserved serial numbers")
+
+		batchStore.add(batch)
+		batch.start(0)
+
+		writeBatchStatus(rw, req, batch, http.StatusAccepted)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// Stable error codes returned to clients in the "code" member of a problem
+// response. Clients can switch on these, so existing values must not change.
+const (
+	CodeDeviceNotFound       = "device_not_found"
+	CodePermissionDenied     = "permission_denied"
+	CodeNoMedia              = "no_media"
+	CodeWrongMedia           = "wrong_media"
+	CodeCoverOpen            = "cover_open"
+	CodeCutterJam            = "cutter_jam"
+	CodeTimeout              = "timeout"
+	CodeJobExpired           = "job_expired"
+	CodeUnknownPrinter       = "unknown_printer"
+	CodeUnknownTemplate      = "unknown_template"
+	CodeInvalidBatch         = "invalid_batch"
+	CodeBatchNotResumable    = "batch_not_resumable"
+	CodeInvalidUpload        = "invalid_upload"
+	CodeOutsidePrintableArea = "outside_printable_area"
+	CodeTextDoesNotFit       = "text_does_not_fit"
+	CodeBarcodeDoesNotFit    = "barcode_does_not_fit"
+	CodeInvalidImage         = "invalid_image"
+	CodeUnsupportedOption    = "unsupported_option"
+	CodeBlankLabel           = "blank_label"
+	CodeUnsupportedPDF       = "unsupported_pdf"
+	CodeURLNotAllowed        = "url_not_allowed"
+	CodeFetchFailed          = "fetch_failed"
+	CodeInvalidRequest       = "invalid_request"
+	CodePrintFailed          = "print_failed"
+	CodeInternal             = "internal_error"
+)
+
+const ProblemContentType = "application/problem+json"
+
+type problemKind struct {
+	Status int
+	Title  string
+}
+
+var problemKinds = map[string]problemKind{
+	CodeDeviceNotFound:       {Status: http.StatusServiceUnavailable, Title: "Printer not found"},
+	CodePermissionDenied:     {Status: http.StatusServiceUnavailable, Title: "Permission denied accessing printer"},
+	CodeNoMedia:              {Status: http.StatusServiceUnavailable, Title: "No media loaded"},
+	CodeWrongMedia:           {Status: http.StatusConflict, Title: "Wrong media loaded"},
+	CodeCoverOpen:            {Status: http.StatusServiceUnavailable, Title: "Printer cover open"},
+	CodeCutterJam:            {Status: http.StatusServiceUnavailable, Title: "Cutter jammed"},
+	CodeTimeout:              {Status: http.StatusServiceUnavailable, Title: "Printer timed out"},
+	CodeJobExpired:           {Status: http.StatusServiceUnavailable, Title: "Job expired waiting for printer"},
+	CodeUnknownPrinter:       {Status: http.StatusNotFound, Title: "Unknown printer"},
+	CodeUnknownTemplate:      {Status: http.StatusNotFound, Title: "Unknown template"},
+	CodeInvalidBatch:         {Status: http.StatusUnprocessableEntity, Title: "Batch has invalid rows"},
+	CodeBatchNotResumable:    {Status: http.StatusConflict, Title: "Batch cannot be resumed"},
+	CodeInvalidUpload:        {Status: http.StatusUnprocessableEntity, Title: "Upload has invalid files"},
+	CodeOutsidePrintableArea: {Status: http.StatusUnprocessableEntity, Title: "Content outside printable area"},
+	CodeTextDoesNotFit:       {Status: http.StatusUnprocessableEntity, Title: "Text does not fit on label"},
+	CodeBarcodeDoesNotFit:    {Status: http.StatusUnprocessableEntity, Title: "Barcode does not fit on label"},
+	CodeInvalidImage:         {Status: http.StatusBadRequest, Title: "Invalid label image"},
+	CodeUnsupportedOption:    {Status: http.StatusUnprocessableEntity, Title: "Printer cannot print with these options"},
+	CodeBlankLabel:           {Status: http.StatusUnprocessableEntity, Title: "Label is blank"},
+	CodeUnsupportedPDF:       {Status: http.StatusUnprocessableEntity, Title: "PDF cannot be printed"},
+	CodeURLNotAllowed:        {Status: http.StatusForbidden, Title: "Image URL not allowed"},
+	CodeFetchFailed:          {Status: http.StatusBadGateway, Title: "Could not fetch image URL"},
+	CodeInvalidRequest:       {Status: http.StatusBadRequest, Title: "Invalid request"},
+	CodePrintFailed:          {Status: http.StatusInternalServerError, Title: "Printing failed"},
+	CodeInternal:             {Status: http.StatusInternalServerError, Title: "Internal server error"},
+}
+
+// PrintError is a failure that can be reported to a client as an RFC 7807
+// problem. Code is one of the Code* constants.
+type PrintError struct {
+	Code   string
+	Detail string
+	Err    error
+	// Rows lists the problem with each failing row of a batch.
+	Rows []RowProblem
+	// Files lists the problem with each failing file of an upload.
+	Files []FileProblem
+}
+
+// RowProblem is why one row of a batch could not be printed. Rows are
+// numbered from 1, not counting a CSV header.
+type RowProblem struct {
+	Row    int    `json:"row"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// FileProblem is why one file of an upload could not be printed.
+type FileProblem struct {
+	File   string `json:"file"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func newPrintError(code string, err error, format string, args ...any) *PrintError {
+	return &PrintError{
+		Code:   code,
+		Detail: fmt.Sprintf(format, args...),
+		Err:    err,
+	}
+}
+
+func (e *PrintError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Detail, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Detail)
+}
+
+func (e *PrintError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PrintError) Status() int {
+	if kind, exists := problemKinds[e.Code]; exists {
+		return kind.Status
+	}
+	return http.StatusInternalServerError
+}
+
+func (e *PrintError) Title() string {
+	if kind, exists := problemKinds[e.Code]; exists {
+		return kind.Title
+	}
+	return problemKinds[CodeInternal].Title
+}
+
+// brotherQLFailures maps fragments of brother_ql output to error codes. The
+// status error names come from brother_ql/reader.py; the rest are raised by
+// the pyusb backend or by the raster conversion. Order matters: the first
+// match wins, so the more specific fragments come first.
+var brotherQLFailures = []struct {
+	Fragment string
+	Code     string
+}{
+	{"Device not found", CodeDeviceNotFound},
+	{"No such device", CodeDeviceNotFound},
+	{"NoBackendError", CodeDeviceNotFound},
+	{"Printer turned off", CodeDeviceNotFound},
+	{"Access denied", CodePermissionDenied},
+	{"Permission denied", CodePermissionDenied},
+	{"Errno 13", CodePermissionDenied},
+	{"No media when printing", CodeNoMedia},
+	{"End of media", CodeNoMedia},
+	{"Media cannot be fed", CodeNoMedia},
+	{"Replace media error", CodeWrongMedia},
+	{"not compatible", CodeWrongMedia},
+	{"Cover opened", CodeCoverOpen},
+	{"Tape cutter jam", CodeCutterJam},
+	{"Operation timed out", CodeTimeout},
+	{"Errno 110", CodeTimeout},
+	{"Bad image dimensions", CodeInvalidImage},
+	{"cannot identify image file", CodeInvalidImage},
+}
+
+// classifyPrintFailure turns a failed brother_ql run into a PrintError,
+// keeping the tool output as the problem detail so it reaches the client
+// instead of only the debug log.
+func classifyPrintFailure(err error, output []byte) *PrintError {
+	detail := strings.TrimSpace(string(output))
+	if detail == "" && err != nil {
+		detail = err.Error()
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &PrintError{Code: CodeTimeout, Detail: detail, Err: err}
+	}
+
+	for _, failure := range brotherQLFailures {
+		if strings.Contains(detail, failure.Fragment) {
+			return &PrintError{Code: failure.Code, Detail: detail, Err: err}
+		}
+	}
+
+	return &PrintError{Code: CodePrintFailed, Detail: detail, Err: err}
+}
+
+type Problem struct {
+	Type     string        `json:"type"`
+	Title    string        `json:"title"`
+	Status   int           `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Instance string        `json:"instance,omitempty"`
+	Code     string        `json:"code"`
+	Rows     []RowProblem  `json:"rows,omitempty"`
+	Files    []FileProblem `json:"files,omitempty"`
+}
+
+// writeProblem responds with an application/problem+json body describing
+// err. Errors that are not a PrintError are reported as internal errors
+// without exposing their message.
+func writeProblem(rw http.ResponseWriter, req *http.Request, err error) {
+	var printErr *PrintError
+	if !errors.As(err, &printErr) {
+		printErr = &PrintError{Code: CodeInternal, Err: err}
+	}
+
+	hlog.FromRequest(req).Error().Err(err).Str("code", printErr.Code).Msg("")
+
+	problem := Problem{
+		Type:     "urn:label-printer:error:" + printErr.Code,
+		Title:    printErr.Title(),
+		Status:   printErr.Status(),
+		Detail:   printErr.Detail,
+		Instance: req.URL.Path,
+		Code:     printErr.Code,
+		Rows:     printErr.Rows,
+		Files:    printErr.Files,
+	}
+
+	responseBytes, err := json.Marshal(problem)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Msg("")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", ProblemContentType)
+	if problem.Status == http.StatusServiceUnavailable {
+		rw.Header().Set("Retry-After", "30")
+	}
+	rw.WriteHeader(problem.Status)
+	if _, err := rw.Write(responseBytes); err != nil {
+		hlog.FromRequest(req).Err(err).Msg("")
+	}
+}
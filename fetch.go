@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// ImageURLTimeout limits how long fetching an image_url may take, from
+	// connecting to reading the last byte.
+	ImageURLTimeout = 15 * time.Second
+	// MaxImageURLRedirects limits how many redirects are followed when
+	// fetching an image_url. Each must still be to an allowed host.
+	MaxImageURLRedirects = 3
+)
+
+// imageURLContentTypes are the content types accepted from an image_url.
+var imageURLContentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"application/pdf": true,
+}
+
+// blockedPrefixes are address ranges an image_url may not reach even if its
+// host is allowed, so a host name pointed at them cannot be used to probe
+// the network the server runs on. Loopback, private, link-local and
+// multicast addresses are blocked as well.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// Carrier-grade NAT, which also holds Alibaba Cloud's metadata service.
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// NAT64, which can reach any IPv4 address including private ones.
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// blockedAddress reports whether an image_url may not connect to addr.
+func blockedAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedImageHost reports whether host is in config.ImageURLHosts, either
+// by name or by matching a "*.example.com" entry, which allows every
+// subdomain of example.com.
+func allowedImageHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range config.ImageURLHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, wildcard := strings.CutPrefix(allowed, "*"); wildcard {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkImageURL checks an image_url is http or https and to an allowed host.
+func checkImageURL(imageURL *url.URL) error {
+	if imageURL.Scheme != "http" && imageURL.Scheme != "https" {
+		return newPrintError(CodeURLNotAllowed, nil, "image_url must be http or https, not '%s'", imageURL.Scheme)
+	}
+	if imageURL.Host == "" {
+		return newPrintError(CodeInvalidRequest, nil, "image_url must be an absolute URL")
+	}
+	if imageURL.User != nil {
+		return newPrintError(CodeURLNotAllowed, nil, "image_url may not hold a user name or password")
+	}
+	if !allowedImageHost(imageURL.Hostname()) {
+		return newPrintError(CodeURLNotAllowed, nil, "host '%s' is not in image_url_hosts", imageURL.Hostname())
+	}
+	return nil
+}
+
+// errBlockedAddress is returned when an allowed host resolves to an address
+// an image_url may not reach.
+var errBlockedAddress = errors.New("address is blocked")
+
+// imageClient fetches image URLs. Addresses are checked as each connection
+// is made, after the host name is resolved, so a host cannot pass the check
+// with one address and then resolve to another. Proxies are not used, as
+// the check would then only see the proxy.
+var imageClient = &http.Client{
+	Timeout: ImageURLTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: ImageURLTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addrPort, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				if blockedAddress(addrPort.Addr()) {
+					return fmt.Errorf("%w: %s", errBlockedAddress, addrPort.Addr())
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   ImageURLTimeout,
+		ResponseHeaderTimeout: ImageURLTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > MaxImageURLRedirects {
+			return newPrintError(CodeFetchFailed, nil, "image_url redirected more than %d times", MaxImageURLRedirects)
+		}
+		return checkImageURL(req.URL)
+	},
+}
+
+// fetchImageURL downloads a label from an allowed host into the upload
+// directory, ready to be decoded like an uploaded file.
+func fetchImageURL(ctx context.Context, rawURL string) (*LabelImage, error) {
+	imageURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, newPrintError(CodeInvalidRequest, err, "image_url must be an absolute URL")
+	}
+	if err := checkImageURL(imageURL); err != nil {
+		return nil, err
+	}
+
+	fetchReq, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL.String(), nil)
+	if err != nil {
+		return nil, newPrintError(CodeInvalidRequest, err, "image_url must be an absolute URL")
+	}
+	fetchReq.Header.Set("Accept", "image/png, image/jpeg, application/pdf")
+	fetchReq.Header.Set("User-Agent", ServiceName)
+
+	resp, err := imageClient.Do(fetchReq)
+	if err != nil {
+		var printErr *PrintError
+		switch {
+		case errors.As(err, &printErr):
+			return nil, printErr
+		case errors.Is(err, errBlockedAddress):
+			return nil, newPrintError(CodeURLNotAllowed, err, "host '%s' resolves to an address that may not be fetched", imageURL.Hostname())
+		}
+		return nil, newPrintError(CodeFetchFailed, err, "could not fetch image_url: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newPrintError(CodeFetchFailed, nil, "fetching image_url returned %s", resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !imageURLContentTypes[mediaType] {
+		return nil, newPrintError(CodeFetchFailed, nil, "image_url must be a PNG, JPEG or PDF, not '%s'", resp.Header.Get("Content-Type"))
+	}
+	if resp.ContentLength > MaxImageSize {
+		return nil, newPrintError(CodeFetchFailed, nil, "image_url is larger than %dMB", MaxImageSize>>20)
+	}
+
+	upload, err := saveUpload(path.Base(resp.Request.URL.Path), io.LimitReader(resp.Body, MaxImageSize+1))
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, newPrintError(CodeFetchFailed, err, "fetching image_url took longer than %s", ImageURLTimeout)
+		}
+		return nil, newPrintError(CodeFetchFailed, err, "could not read image_url")
+	}
+	if info, err := os.Stat(upload.File.Name()); err == nil && info.Size() > MaxImageSize {
+		upload.remove(log)
+		return nil, newPrintError(CodeFetchFailed, nil, "image_url is larger than %dMB", MaxImageSize>>20)
+	}
+	return upload, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomedium"
+	"golang.org/x/image/font/gofont/gomediumitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/gofont/gosmallcaps"
+	"golang.org/x/image/font/gofont/gosmallcapsitalic"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// PrinterDPI is the resolution of every supported printer, so font sizes
+// in points come out at their real size on the label.
+const PrinterDPI = 300
+
+const DefaultFontName = "Go Regular"
+
+var (
+	regularFont = mustParseFont(goregular.TTF)
+	boldFont    = mustParseFont(gobold.TTF)
+)
+
+// bundledFonts are compiled into the server so text labels work without any
+// fonts installed.
+var bundledFonts = [][]byte{
+	goregular.TTF,
+	gobold.TTF,
+	goitalic.TTF,
+	gobolditalic.TTF,
+	gomedium.TTF,
+	gomediumitalic.TTF,
+	gomono.TTF,
+	gomonobold.TTF,
+	gomonoitalic.TTF,
+	gomonobolditalic.TTF,
+	gosmallcaps.TTF,
+	gosmallcapsitalic.TTF,
+}
+
+const (
+	// MaxOpenFonts limits how many installed fonts are kept open. Their
+	// glyphs are read from the file as they are drawn rather than held in
+	// memory, so this bounds open files rather than memory.
+	MaxOpenFonts = 32
+	// MaxFallbackRunes limits how many characters' fallback fonts are
+	// remembered.
+	MaxFallbackRunes = 4096
+)
+
+// FontFile is a TrueType or OpenType font found in one of the font
+// directories. Fonts are only opened to draw the first time a label uses
+// them.
+type FontFile struct {
+	Name  string
+	Path  string
+	Index int
+
+	// glyphs holds the font's tables, parsed when the fonts are loaded, to
+	// look up which characters it has glyphs for. The file is only read
+	// for the few lookups the tables do not answer.
+	glyphs *sfnt.Font
+}
+
+// fontFileReader reads a font file, opening it for each read so parsed
+// fonts do not hold files open.
+type fontFileReader string
+
+func (path fontFileReader) ReadAt(p []byte, offset int64) (int, error) {
+	file, err := os.Open(string(path))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(p, offset)
+}
+
+// Fonts are keyed by their lower case full name, such as "go bold".
+// openFonts are the installed fonts used most recently, least recent first
+// in openOrder. fallbackFiles are the installed fonts in the order they are
+// tried for characters a font has no glyph for, and fallbackFonts remembers
+// the name of the one found for each character, or "" if none has it, for
+// the characters in fallbackOrder, oldest first.
+var (
+	fontsMu       sync.Mutex
+	fontFiles     = map[string]FontFile{}
+	loadedFonts   = map[string]*opentype.Font{}
+	openFonts     = map[string]*opentype.Font{}
+	openOrder     []string
+	fallbackFiles []FontFile
+	fallbackFonts = map[rune]string{}
+	fallbackOrder []rune
+)
+
+func mustParseFont(ttf []byte) *opentype.Font {
+	parsed, err := opentype.Parse(ttf)
+	if err != nil {
+		panic(fmt.Sprintf("could not parse bundled font: %v", err))
+	}
+	return parsed
+}
+
+func fontKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func fontName(f *opentype.Font) (string, error) {
+	return f.Name(nil, sfnt.NameIDFull)
+}
+
+// loadFonts registers the bundled fonts and every .ttf, .otf and .ttc file
+// in the configured font directories. Directories that do not exist are
+// skipped.
+func loadFonts() error {
+	fontsMu.Lock()
+	defer fontsMu.Unlock()
+
+	for _, ttf := range bundledFonts {
+		parsed := mustParseFont(ttf)
+		name, err := fontName(parsed)
+		if err != nil {
+			return fmt.Errorf("could not read name of bundled font: %w", err)
+		}
+		loadedFonts[fontKey(name)] = parsed
+	}
+
+	for _, directory := range config.FontDirectories {
+		err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if path == directory && os.IsNotExist(err) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".ttf", ".otf", ".ttc":
+			default:
+				return nil
+			}
+
+			files, err := readFontNames(path)
+			if err != nil {
+				log.Warn().Err(err).Str("path", path).Msg("Skipping unreadable font")
+				return nil
+			}
+			for _, file := range files {
+				key := fontKey(file.Name)
+				if _, exists := loadedFonts[key]; exists {
+					continue
+				}
+				if _, exists := fontFiles[key]; !exists {
+					fontFiles[key] = file
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not read font directory '%s': %w", directory, err)
+		}
+	}
+
+	fallbackFiles = make([]FontFile, 0, len(fontFiles))
+	for _, file := range fontFiles {
+		fallbackFiles = append(fallbackFiles, file)
+	}
+	sort.Slice(fallbackFiles, func(i, j int) bool {
+		return fallbackFiles[i].Name < fallbackFiles[j].Name
+	})
+
+	log.Info().
+		Int("Bundled", len(loadedFonts)).
+		Int("Installed", len(fontFiles)).
+		Msg("Loaded fonts")
+	return nil
+}
+
+// readFontNames reads the name of each font in a font file, and the tables
+// to look up its glyphs, without keeping the file in memory or open.
+func readFontNames(path string) ([]FontFile, error) {
+	collection, err := sfnt.ParseCollectionReaderAt(fontFileReader(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []FontFile
+	for index := 0; index < collection.NumFonts(); index++ {
+		f, err := collection.Font(index)
+		if err != nil {
+			return nil, err
+		}
+		name, err := fontName(f)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, FontFile{Name: name, Path: path, Index: index, glyphs: f})
+	}
+	return files, nil
+}
+
+// openFontFile opens a font in a font directory. Only the tables that
+// describe the font are read; glyphs are read from the file as they are
+// drawn. The file stays open for that and is closed once the font is no
+// longer used and is garbage collected.
+func openFontFile(file FontFile) (*opentype.Font, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := opentype.ParseCollectionReaderAt(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	opened, err := collection.Font(file.Index)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return opened, nil
+}
+
+// findFont returns the font with the given full name, opening it from its
+// font directory if it is not one of the fonts open already. A font that
+// cannot draw text is refused here rather than when a label is drawn.
+func findFont(name string) (*opentype.Font, error) {
+	fontsMu.Lock()
+	defer fontsMu.Unlock()
+
+	key := fontKey(name)
+	if loaded, exists := loadedFonts[key]; exists {
+		return loaded, nil
+	}
+	if opened, exists := openFonts[key]; exists {
+		openOrder = append(slices.DeleteFunc(openOrder, func(k string) bool { return k == key }), key)
+		return opened, nil
+	}
+
+	file, exists := fontFiles[key]
+	if !exists {
+		return nil, newPrintError(CodeInvalidRequest, nil, "font '%s' does not exist", name)
+	}
+
+	opened, err := openFontFile(file)
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not read font '%s'", name)
+	}
+	if _, err := newFace(opened, DefaultMinFontSize); err != nil {
+		return nil, newPrintError(CodeInternal, err, "font '%s' cannot be drawn", name)
+	}
+
+	if len(openOrder) == MaxOpenFonts {
+		delete(openFonts, openOrder[0])
+		openOrder = openOrder[1:]
+	}
+	openFonts[key] = opened
+	openOrder = append(openOrder, key)
+	return opened, nil
+}
+
+// fallbackFont returns the name of the first installed font, by name, with
+// a glyph for the rune, or "" if none has one. The answer is remembered for
+// the last MaxFallbackRunes characters looked up.
+func fallbackFont(r rune) string {
+	fontsMu.Lock()
+	name, known := fallbackFonts[r]
+	files := fallbackFiles
+	fontsMu.Unlock()
+	if known {
+		return name
+	}
+
+	var buf sfnt.Buffer
+	var found FontFile
+	for _, file := range files {
+		if glyph, err := file.glyphs.GlyphIndex(&buf, r); err == nil && glyph != 0 {
+			found = file
+			break
+		}
+	}
+
+	fontsMu.Lock()
+	defer fontsMu.Unlock()
+	if _, known := fallbackFonts[r]; !known {
+		if len(fallbackOrder) == MaxFallbackRunes {
+			delete(fallbackFonts, fallbackOrder[0])
+			fallbackOrder = fallbackOrder[1:]
+		}
+		fallbackFonts[r] = found.Name
+		fallbackOrder = append(fallbackOrder, r)
+	}
+	return found.Name
+}
+
+// FontInfo describes a font text labels can use.
+type FontInfo struct {
+	Name    string `json:"name"`
+	Bundled bool   `json:"bundled"`
+	Path    string `json:"path,omitempty"`
+}
+
+func listFonts() []FontInfo {
+	fontsMu.Lock()
+	defer fontsMu.Unlock()
+
+	var fonts []FontInfo
+	for _, loaded := range loadedFonts {
+		name, _ := fontName(loaded)
+		if _, installed := fontFiles[fontKey(name)]; installed {
+			continue
+		}
+		fonts = append(fonts, FontInfo{Name: name, Bundled: true})
+	}
+	for _, file := range fontFiles {
+		fonts = append(fonts, FontInfo{Name: file.Name, Path: file.Path})
+	}
+
+	sort.Slice(fonts, func(i, j int) bool {
+		return fonts[i].Name < fonts[j].Name
+	})
+	return fonts
+}
+
+// newFace makes a face of the font at a size in points.
+func newFace(f *opentype.Font, sizePoints float64) (font.Face, error) {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    sizePoints,
+		DPI:     PrinterDPI,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create font face: %w", err)
+	}
+	return face, nil
+}
+
+// drawText draws black text with its baseline starting at (x, y).
+func drawText(dst draw.Image, face font.Face, x, y int, text string) {
+	drawer := font.Drawer{
+		Dst:  dst,
+		Src:  image.Black,
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	drawer.DrawString(text)
+}
+
+func textWidth(face font.Face, text string) int {
+	return font.MeasureString(face, text).Ceil()
+}
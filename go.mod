@@ -3,17 +3,20 @@ module github.com/control-alt-repeat/label-printer
 go 1.23.1
 
 require (
+	github.com/boombuler/barcode v1.1.0
 	github.com/justinas/alice v1.2.0
 	github.com/localtunnel/go-localtunnel v0.0.0-20170326223115-8a804488f275
+	github.com/rs/xid v1.5.0
 	github.com/rs/zerolog v1.33.0
+	golang.org/x/image v0.29.0
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/rs/xid v1.5.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/text v0.27.0 // indirect
 )
 
 require (
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// HotFolderDoneDirectory is the subdirectory of a hot folder printed
+	// files are moved to, each with a .json file of its job statuses.
+	HotFolderDoneDirectory = "done"
+	// HotFolderFailedDirectory is the subdirectory of a hot folder files that
+	// could not be printed are moved to, each with a .err file saying why.
+	HotFolderFailedDirectory = "failed"
+)
+
+// hotFolderExtensions are the files a hot folder picks up. Anything else,
+// such as the temporary files some software writes before renaming, is left
+// alone.
+var hotFolderExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".pdf":  true,
+}
+
+// HotFolderConfig is a directory to watch for labels to print, for software
+// that can only save files, for example to a network share.
+type HotFolderConfig struct {
+	Path string `json:"path"`
+	// Format is the label format files are printed on. If it is not set the
+	// format is chosen from each image's size, as for /print.
+	Format string `json:"format"`
+	// Printer sends every file to the named printer instead of the format's
+	// pool.
+	Printer    string       `json:"printer"`
+	Strictness string       `json:"strictness"`
+	Dither     bool         `json:"dither"`
+	Threshold  *int         `json:"threshold"`
+	Options    PrintOptions `json:"print_options"`
+}
+
+func (c HotFolderConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("path is required")
+	}
+	if c.Strictness != "" && !strictnessLevels[c.Strictness] {
+		return fmt.Errorf("strictness must be off, warn or reject, not '%s'", c.Strictness)
+	}
+	if err := c.pipelineOptions().validate(); err != nil {
+		return err
+	}
+	return c.Options.validate()
+}
+
+func (c HotFolderConfig) pipelineOptions() PipelineOptions {
+	options := PipelineOptions{
+		Rotate:    RotateAuto,
+		Dither:    c.Dither,
+		Threshold: DefaultThreshold,
+	}
+	if c.Threshold != nil {
+		options.Threshold = *c.Threshold
+	}
+	return options
+}
+
+// checkPrinter checks the folder's format exists and its printer can print
+// it with the folder's options. It needs the printer pools, so it is run once
+// they are set up rather than when the config is loaded.
+func (c HotFolderConfig) checkPrinter() error {
+	if c.Format == "" {
+		if c.Printer != "" && printQueue(c.Printer) == nil {
+			return newPrintError(CodeUnknownPrinter, nil, "no printer is named '%s'", c.Printer)
+		}
+		return nil
+	}
+
+	pool, exists := labelPrinters[c.Format]
+	if !exists {
+		return newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", c.Format)
+	}
+	if c.Printer != "" {
+		if _, err := pool.member(c.Printer, c.Format); err != nil {
+			return err
+		}
+	}
+	return pool.checkPrintOptions(c.Options, c.Printer)
+}
+
+// hotFile is what a hot folder last saw of a file, so it can tell when the
+// file has finished being written.
+type hotFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// HotFolder prints the files saved into a watched directory. The directory
+// is scanned every HotFolderPollInterval, and a file is picked up once its
+// size and modification time are the same as on the scan before, so files
+// still being copied in are not printed half written. Each file is moved to
+// done/ once every label in it has printed, or to failed/ if any could not
+// be, so it is never printed twice. A file that cannot be moved, for example
+// because the share does not allow renaming, is left alone from then on
+// until it is taken out of the folder.
+type HotFolder struct {
+	HotFolderConfig
+
+	logger zerolog.Logger
+
+	mu       sync.Mutex
+	seen     map[string]hotFile
+	printing map[string]bool
+	stuck    map[string]bool
+}
+
+func newHotFolder(folderConfig HotFolderConfig) *HotFolder {
+	return &HotFolder{
+		HotFolderConfig: folderConfig,
+		logger:          log.With().Str("hot_folder", folderConfig.Path).Logger(),
+		seen:            map[string]hotFile{},
+		printing:        map[string]bool{},
+		stuck:           map[string]bool{},
+	}
+}
+
+// startHotFolders starts watching every configured hot folder, creating
+// them and their done/ and failed/ subdirectories if need be.
+func startHotFolders(ctx context.Context) error {
+	for _, folderConfig := range config.HotFolders {
+		if err := folderConfig.checkPrinter(); err != nil {
+			return fmt.Errorf("hot folder '%s': %w", folderConfig.Path, err)
+		}
+		for _, dir := range []string{HotFolderDoneDirectory, HotFolderFailedDirectory} {
+			if err := os.MkdirAll(filepath.Join(folderConfig.Path, dir), os.ModePerm); err != nil {
+				return fmt.Errorf("hot folder '%s': %w", folderConfig.Path, err)
+			}
+		}
+
+		newHotFolder(folderConfig).Start(ctx)
+	}
+	return nil
+}
+
+func (f *HotFolder) Start(ctx context.Context) {
+	f.logger.Info().Msg("Watching hot folder")
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.HotFolderPollInterval))
+		defer ticker.Stop()
+
+		for {
+			f.scan(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// scan prints the files that have not changed since the last scan.
+func (f *HotFolder) scan(ctx context.Context) {
+	entries, err := os.ReadDir(f.Path)
+	if err != nil {
+		f.logger.Err(err).Msg("Cannot read hot folder")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seen := make(map[string]hotFile, len(entries))
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || !hotFolderExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		present[name] = true
+		if f.printing[name] || f.stuck[name] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		file := hotFile{size: info.Size(), modTime: info.ModTime()}
+		seen[name] = file
+
+		if last, found := f.seen[name]; found && last == file {
+			f.printing[name] = true
+			delete(seen, name)
+			go f.printFile(ctx, name)
+		}
+	}
+	f.seen = seen
+
+	for name := range f.stuck {
+		if !present[name] {
+			delete(f.stuck, name)
+		}
+	}
+}
+
+// printFile prints every label in a file, waits for them all to finish and
+// moves the file to done/ or failed/.
+func (f *HotFolder) printFile(ctx context.Context, name string) {
+	logger := f.logger.With().Str("file", name).Logger()
+	defer func() {
+		f.mu.Lock()
+		delete(f.printing, name)
+		f.mu.Unlock()
+	}()
+
+	printJobs, err := f.queueFile(ctx, logger, name)
+	if err == nil {
+		for _, printJob := range printJobs {
+			select {
+			case <-printJob.done:
+			case <-ctx.Done():
+				return
+			}
+			if status := printJob.Status(); status.State != JobCompleted && err == nil {
+				err = printJob.Err()
+				if err == nil {
+					err = fmt.Errorf("job %s was %s", status.ID, status.State)
+				}
+			}
+		}
+	}
+
+	statuses := make([]JobStatus, len(printJobs))
+	for i, printJob := range printJobs {
+		statuses[i] = printJob.Status()
+	}
+
+	if err != nil {
+		logger.Err(err).Msg("Hot folder file failed")
+	} else {
+		logger.Info().Int("Jobs", len(printJobs)).Msg("Hot folder file printed")
+	}
+	if err := f.finish(name, statuses, err); err != nil {
+		logger.Err(err).Msg("Cannot move hot folder file, it will not be printed again until it is taken out of the folder")
+		f.mu.Lock()
+		f.stuck[name] = true
+		f.mu.Unlock()
+	}
+}
+
+// queueFile draws and checks every label in a file, then queues them.
+func (f *HotFolder) queueFile(ctx context.Context, logger zerolog.Logger, name string) ([]*PrintJob, error) {
+	file, err := os.Open(filepath.Join(f.Path, name))
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not open '%s'", name)
+	}
+	defer file.Close()
+
+	upload := &LabelImage{Name: name, File: file}
+	labels, err := upload.labels(ctx, "", f.Format, f.pipelineOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	strictness := f.Strictness
+	if strictness == "" {
+		strictness = config.PrintableAreaStrictness
+	}
+	warnings, err := checkLabels(labels, strictness, f.Printer, f.Options)
+	if err != nil {
+		return nil, err
+	}
+	return queueLabels(logger, labels, warnings, f.Printer, f.Options)
+}
+
+// finish moves a file to done/ with a .json file of its job statuses, or to
+// failed/ with a .err file holding the error. A file whose name is already
+// taken there is given a unique suffix.
+func (f *HotFolder) finish(name string, statuses []JobStatus, printErr error) error {
+	dir := HotFolderDoneDirectory
+	sidecarExt := ".json"
+	var sidecar []byte
+	if printErr != nil {
+		dir = HotFolderFailedDirectory
+		sidecarExt = ".err"
+		sidecar = []byte(hotFolderError(printErr) + "\n")
+	} else {
+		var err error
+		sidecar, err = json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			return err
+		}
+	}
+
+	target := filepath.Join(f.Path, dir, name)
+	if _, err := os.Stat(target); err == nil {
+		ext := filepath.Ext(name)
+		target = filepath.Join(f.Path, dir, strings.TrimSuffix(name, ext)+"-"+xid.New().String()+ext)
+	}
+
+	if err := os.WriteFile(target+sidecarExt, sidecar, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(f.Path, name), target)
+}
+
+// hotFolderError describes why a file could not be printed, leading with
+// the error code when there is one.
+func hotFolderError(err error) string {
+	var printErr *PrintError
+	if errors.As(err, &printErr) {
+		return printErr.Code + ": " + printErr.Detail
+	}
+	return err.Error()
+}
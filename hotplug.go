@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PrinterEventType string
+
+const (
+	PrinterAdded   PrinterEventType = "added"
+	PrinterRemoved PrinterEventType = "removed"
+)
+
+// PrinterEvent reports a Brother printer being plugged in or unplugged.
+// Printer is the name of the configured or auto-registered printer the
+// device was matched to, if any.
+type PrinterEvent struct {
+	Type    PrinterEventType `json:"type"`
+	Device  USBDevice        `json:"device"`
+	Printer string           `json:"printer,omitempty"`
+	Time    time.Time        `json:"time"`
+}
+
+// HotplugWatcher keeps track of which Brother printers are attached. It
+// rescans sysfs whenever the kernel reports a USB device being added or
+// removed, and also on a timer in case uevents are not delivered, as happens
+// in some containers. The last time each printer was plugged in or
+// unplugged is shown by /printers.
+type HotplugWatcher struct {
+	mu             sync.Mutex
+	attached       map[string]USBDevice
+	autoRegistered map[string]bool
+	lastEvents     map[string]PrinterEvent
+
+	rescan chan struct{}
+}
+
+var hotplugWatcher = &HotplugWatcher{
+	attached:       map[string]USBDevice{},
+	autoRegistered: map[string]bool{},
+	lastEvents:     map[string]PrinterEvent{},
+	rescan:         make(chan struct{}, 1),
+}
+
+func (w *HotplugWatcher) Start(ctx context.Context) {
+	if err := listenUevents(ctx, w.triggerRescan); err != nil {
+		log.Warn().Err(err).Msg("Cannot listen for USB uevents, polling sysfs instead")
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.HotplugPollInterval))
+		defer ticker.Stop()
+
+		for {
+			w.scan(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-w.rescan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (w *HotplugWatcher) triggerRescan() {
+	select {
+	case w.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// LastEvent returns the last time the named printer was plugged in or
+// unplugged since the server started.
+func (w *HotplugWatcher) LastEvent(name string) (PrinterEvent, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	event, exists := w.lastEvents[name]
+	return event, exists
+}
+
+// Attached lists the Brother printers plugged in at the last scan.
+func (w *HotplugWatcher) Attached() []USBDevice {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	devices := make([]USBDevice, 0, len(w.attached))
+	for _, device := range w.attached {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+func (w *HotplugWatcher) scan(ctx context.Context) {
+	devices, err := discoverUSBPrinters()
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not scan for USB printers")
+		return
+	}
+
+	current := map[string]USBDevice{}
+	for _, device := range devices {
+		current[device.SysfsPath] = device
+	}
+
+	w.mu.Lock()
+	previous := w.attached
+	w.attached = current
+	w.mu.Unlock()
+
+	for path, device := range current {
+		if _, exists := previous[path]; !exists {
+			w.deviceAdded(ctx, device)
+		}
+	}
+	for path, device := range previous {
+		if _, exists := current[path]; !exists {
+			w.deviceRemoved(device)
+		}
+	}
+}
+
+func (w *HotplugWatcher) deviceAdded(ctx context.Context, device USBDevice) {
+	name := matchPrinter(device)
+
+	w.mu.Lock()
+	autoRegistered := w.autoRegistered[name]
+	w.mu.Unlock()
+
+	switch {
+	case autoRegistered:
+		if queue := printQueue(name); queue != nil {
+			joinPools(queue.Printer)
+		}
+	case name == "" && config.AutoRegisterPrinters:
+		name = w.autoRegister(ctx, device)
+	}
+
+	log.Info().
+		Str("model", device.Model).
+		Str("serial", device.Serial).
+		Str("printer", name).
+		Msg("Printer attached")
+
+	if queue := printQueue(name); queue != nil {
+		queue.checkStatus()
+	}
+
+	w.record(PrinterEvent{Type: PrinterAdded, Device: device, Printer: name, Time: time.Now()})
+}
+
+func (w *HotplugWatcher) deviceRemoved(device USBDevice) {
+	name := matchPrinter(device)
+
+	log.Info().
+		Str("model", device.Model).
+		Str("serial", device.Serial).
+		Str("printer", name).
+		Msg("Printer detached")
+
+	if queue := printQueue(name); queue != nil {
+		queue.checkStatus()
+	}
+
+	w.mu.Lock()
+	autoRegistered := w.autoRegistered[name]
+	w.mu.Unlock()
+
+	if autoRegistered {
+		for _, pool := range labelPrinters {
+			pool.remove(name)
+		}
+	}
+
+	w.record(PrinterEvent{Type: PrinterRemoved, Device: device, Printer: name, Time: time.Now()})
+}
+
+// autoRegister creates a printer for a device that matches no configured
+// printer and adds it to the pools of every label format already printed by
+// that model. It is taken out of the pools again when unplugged, and put
+// back when plugged in again.
+func (w *HotplugWatcher) autoRegister(ctx context.Context, device USBDevice) string {
+	if device.Model == "" {
+		return ""
+	}
+
+	name := strings.ToLower(device.Model)
+	if device.Serial != "" {
+		name = fmt.Sprintf("%s-%s", name, device.Serial)
+	}
+
+	printer := Printer{
+		Name:   name,
+		Model:  device.Model,
+		Port:   device.Port(),
+		Serial: device.Serial,
+	}
+	startPrintQueue(ctx, printer)
+	joinPools(printer)
+
+	w.mu.Lock()
+	w.autoRegistered[name] = true
+	w.mu.Unlock()
+
+	return name
+}
+
+// joinPools adds an auto-registered printer to the pool of every label
+// format printed by its model that it is not in already.
+func joinPools(printer Printer) {
+	for format, pool := range labelPrinters {
+		if !pool.models()[printer.Model] {
+			continue
+		}
+		if _, found := pool.find(printer.Name); found {
+			continue
+		}
+		pool.add(printer)
+		log.Info().Str("printer", printer.Name).Str("format", format).Msg("Auto-registered printer")
+	}
+}
+
+// record keeps an event as the last of its printer. Events for devices that
+// matched no printer are only logged.
+func (w *HotplugWatcher) record(event PrinterEvent) {
+	if event.Printer == "" {
+		return
+	}
+
+	w.mu.Lock()
+	w.lastEvents[event.Printer] = event
+	w.mu.Unlock()
+}
+
+// matchPrinter returns the name of the known printer for a device,
+// preferring a printer bound to the device's serial number over one that
+// matches any printer of that model.
+func matchPrinter(device USBDevice) string {
+	var modelMatch string
+	for _, queue := range allPrintQueues() {
+		vendor, product, serial, err := parseUSBPort(queue.Printer.Port)
+		if err != nil || vendor != device.Vendor || product != device.Product {
+			continue
+		}
+		if serial == device.Serial && serial != "" {
+			return queue.Printer.Name
+		}
+		if serial == "" && modelMatch == "" {
+			modelMatch = queue.Printer.Name
+		}
+	}
+	return modelMatch
+}
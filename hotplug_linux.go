@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// listenUevents calls notify for every kernel uevent about a Brother USB
+// device. It returns an error if the netlink socket cannot be opened, and
+// otherwise listens in the background until ctx is done.
+func listenUevents(ctx context.Context, notify func()) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("could not open uevent socket: %w", err)
+	}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("could not bind uevent socket: %w", err)
+	}
+
+	// A receive timeout lets the loop notice ctx being cancelled.
+	timeout := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("could not set uevent socket timeout: %w", err)
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+
+		buffer := make([]byte, 64*1024)
+		for ctx.Err() == nil {
+			n, _, err := syscall.Recvfrom(fd, buffer, 0)
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			if err != nil {
+				log.Warn().Err(err).Msg("Stopped listening for USB uevents")
+				return
+			}
+
+			if isBrotherUSBUevent(buffer[:n]) {
+				notify()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isBrotherUSBUevent reports whether a uevent is a Brother USB device being
+// added or removed. Uevents are NUL separated KEY=value pairs after an
+// "action@devpath" header, and PRODUCT is vendor/product/bcdDevice in hex
+// without leading zeros.
+func isBrotherUSBUevent(message []byte) bool {
+	fields := map[string]string{}
+	for _, field := range bytes.Split(message, []byte{0}) {
+		key, value, found := bytes.Cut(field, []byte("="))
+		if found {
+			fields[string(key)] = string(value)
+		}
+	}
+
+	if fields["SUBSYSTEM"] != "usb" || fields["DEVTYPE"] != "usb_device" {
+		return false
+	}
+	if fields["ACTION"] != "add" && fields["ACTION"] != "remove" {
+		return false
+	}
+
+	vendor, _, _ := bytes.Cut([]byte(fields["PRODUCT"]), []byte("/"))
+	return string(vendor) == "4f9"
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func listenUevents(ctx context.Context, notify func()) error {
+	return errors.New("USB uevents are only available on Linux")
+}
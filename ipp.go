@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxIPPAttributes limits how many attribute values an IPP request can
+// hold. Real requests have a few dozen.
+const MaxIPPAttributes = 1000
+
+// IPP operations, from RFC 8011.
+const (
+	IPPPrintJob             = 0x0002
+	IPPValidateJob          = 0x0004
+	IPPCancelJob            = 0x0008
+	IPPGetJobAttributes     = 0x0009
+	IPPGetJobs              = 0x000a
+	IPPGetPrinterAttributes = 0x000b
+)
+
+// IPP status codes.
+const (
+	IPPStatusOK                        = 0x0000
+	IPPStatusOKIgnoredOrSubstituted    = 0x0001
+	IPPStatusBadRequest                = 0x0400
+	IPPStatusNotPossible               = 0x0404
+	IPPStatusNotFound                  = 0x0406
+	IPPStatusRequestTooLarge           = 0x0409
+	IPPStatusDocumentFormatUnsupported = 0x040a
+	IPPStatusAttributesUnsupported     = 0x040b
+	IPPStatusDocumentFormatError       = 0x0411
+	IPPStatusInternalError             = 0x0500
+	IPPStatusOperationUnsupported      = 0x0501
+	IPPStatusVersionUnsupported        = 0x0503
+)
+
+// IPP delimiter tags, which start each group of attributes.
+const (
+	ippTagOperation   = 0x01
+	ippTagJob         = 0x02
+	ippTagEnd         = 0x03
+	ippTagPrinter     = 0x04
+	ippTagUnsupported = 0x05
+)
+
+// IPP value tags.
+const (
+	ippTagUnsupportedValue = 0x10
+	ippTagUnknown          = 0x12
+	ippTagNoValue          = 0x13
+	ippTagInteger          = 0x21
+	ippTagBoolean          = 0x22
+	ippTagEnum             = 0x23
+	ippTagOctetString      = 0x30
+	ippTagDateTime         = 0x31
+	ippTagResolution       = 0x32
+	ippTagRange            = 0x33
+	ippTagBeginCollection  = 0x34
+	ippTagEndCollection    = 0x37
+	ippTagText             = 0x41
+	ippTagName             = 0x42
+	ippTagKeyword          = 0x44
+	ippTagURI              = 0x45
+	ippTagCharset          = 0x47
+	ippTagLanguage         = 0x48
+	ippTagMimeType         = 0x49
+	ippTagMemberName       = 0x4a
+)
+
+// IPPValue is one value of an attribute, as the raw bytes of its tag's
+// encoding.
+type IPPValue struct {
+	Tag  byte
+	Data []byte
+}
+
+// IPPAttribute is a named attribute and its values, which all share the
+// first value's tag unless the attribute mixes types.
+type IPPAttribute struct {
+	Name   string
+	Values []IPPValue
+}
+
+// IPPGroup is a group of attributes under one delimiter tag.
+type IPPGroup struct {
+	Tag        byte
+	Attributes []IPPAttribute
+}
+
+// IPPMessage is an IPP request or response. Code is the operation of a
+// request or the status of a response.
+type IPPMessage struct {
+	Version   uint16
+	Code      uint16
+	RequestID uint32
+	Groups    []IPPGroup
+}
+
+// readIPPMessage reads the attributes of an IPP request, leaving r at the
+// document that follows them. Collections, which the printer has no use
+// for, are skipped.
+func readIPPMessage(r *bufio.Reader) (*IPPMessage, error) {
+	var header struct {
+		Version   uint16
+		Code      uint16
+		RequestID uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("could not read IPP header: %w", err)
+	}
+	message := &IPPMessage{Version: header.Version, Code: header.Code, RequestID: header.RequestID}
+
+	var group *IPPGroup
+	collectionDepth := 0
+	for values := 0; ; values++ {
+		if values == MaxIPPAttributes {
+			return nil, fmt.Errorf("IPP requests can have at most %d attributes", MaxIPPAttributes)
+		}
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("could not read IPP attributes: %w", err)
+		}
+		if tag == ippTagEnd {
+			return message, nil
+		}
+		if tag < 0x10 {
+			message.Groups = append(message.Groups, IPPGroup{Tag: tag})
+			group = &message.Groups[len(message.Groups)-1]
+			continue
+		}
+		if group == nil {
+			return nil, errors.New("IPP attribute outside a group")
+		}
+
+		name, err := readIPPField(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readIPPField(r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case tag == ippTagBeginCollection:
+			collectionDepth++
+			continue
+		case tag == ippTagEndCollection:
+			collectionDepth--
+			continue
+		case collectionDepth > 0:
+			continue
+		}
+
+		value := IPPValue{Tag: tag, Data: data}
+		if len(name) == 0 && len(group.Attributes) > 0 {
+			last := &group.Attributes[len(group.Attributes)-1]
+			last.Values = append(last.Values, value)
+			continue
+		}
+		group.Attributes = append(group.Attributes, IPPAttribute{Name: string(name), Values: []IPPValue{value}})
+	}
+}
+
+// readIPPField reads a length-prefixed name or value.
+func readIPPField(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("could not read IPP attribute: %w", err)
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, fmt.Errorf("could not read IPP attribute: %w", err)
+	}
+	return field, nil
+}
+
+// encode writes the message in IPP's binary encoding.
+func (m *IPPMessage) encode() []byte {
+	var out bytes.Buffer
+	binary.Write(&out, binary.BigEndian, m.Version)
+	binary.Write(&out, binary.BigEndian, m.Code)
+	binary.Write(&out, binary.BigEndian, m.RequestID)
+
+	for _, group := range m.Groups {
+		out.WriteByte(group.Tag)
+		for _, attribute := range group.Attributes {
+			for i, value := range attribute.Values {
+				out.WriteByte(value.Tag)
+				name := attribute.Name
+				if i > 0 {
+					name = ""
+				}
+				binary.Write(&out, binary.BigEndian, uint16(len(name)))
+				out.WriteString(name)
+				binary.Write(&out, binary.BigEndian, uint16(len(value.Data)))
+				out.Write(value.Data)
+			}
+		}
+	}
+	out.WriteByte(ippTagEnd)
+	return out.Bytes()
+}
+
+// attribute finds an attribute in the message's operation or job group.
+func (m *IPPMessage) attribute(name string) (IPPAttribute, bool) {
+	for _, group := range m.Groups {
+		if group.Tag != ippTagOperation && group.Tag != ippTagJob {
+			continue
+		}
+		for _, attribute := range group.Attributes {
+			if attribute.Name == name {
+				return attribute, true
+			}
+		}
+	}
+	return IPPAttribute{}, false
+}
+
+// stringAttribute returns the first value of an attribute as a string.
+func (m *IPPMessage) stringAttribute(name string) string {
+	attribute, found := m.attribute(name)
+	if !found || len(attribute.Values) == 0 {
+		return ""
+	}
+	return string(attribute.Values[0].Data)
+}
+
+// intAttribute returns the first value of an integer or enum attribute.
+func (m *IPPMessage) intAttribute(name string) (int, bool) {
+	attribute, found := m.attribute(name)
+	if !found || len(attribute.Values) == 0 || len(attribute.Values[0].Data) != 4 {
+		return 0, false
+	}
+	return int(int32(binary.BigEndian.Uint32(attribute.Values[0].Data))), true
+}
+
+// stringsAttribute returns every value of an attribute as strings.
+func (m *IPPMessage) stringsAttribute(name string) []string {
+	attribute, _ := m.attribute(name)
+	values := make([]string, len(attribute.Values))
+	for i, value := range attribute.Values {
+		values[i] = string(value.Data)
+	}
+	return values
+}
+
+// add appends an attribute to the group, with one value per string.
+func (g *IPPGroup) add(name string, tag byte, values ...string) {
+	attribute := IPPAttribute{Name: name}
+	for _, value := range values {
+		attribute.Values = append(attribute.Values, IPPValue{Tag: tag, Data: []byte(value)})
+	}
+	g.Attributes = append(g.Attributes, attribute)
+}
+
+// addInt appends an integer or enum attribute.
+func (g *IPPGroup) addInt(name string, tag byte, values ...int) {
+	attribute := IPPAttribute{Name: name}
+	for _, value := range values {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(int32(value)))
+		attribute.Values = append(attribute.Values, IPPValue{Tag: tag, Data: data})
+	}
+	g.Attributes = append(g.Attributes, attribute)
+}
+
+func (g *IPPGroup) addBool(name string, value bool) {
+	data := []byte{0}
+	if value {
+		data[0] = 1
+	}
+	g.Attributes = append(g.Attributes, IPPAttribute{Name: name, Values: []IPPValue{{Tag: ippTagBoolean, Data: data}}})
+}
+
+func (g *IPPGroup) addRange(name string, lower, upper int) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(int32(lower)))
+	binary.BigEndian.PutUint32(data[4:], uint32(int32(upper)))
+	g.Attributes = append(g.Attributes, IPPAttribute{Name: name, Values: []IPPValue{{Tag: ippTagRange, Data: data}}})
+}
+
+// addResolution appends a resolution in dots per inch.
+func (g *IPPGroup) addResolution(name string, dpi int) {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint32(data, uint32(dpi))
+	binary.BigEndian.PutUint32(data[4:], uint32(dpi))
+	data[8] = 3
+	g.Attributes = append(g.Attributes, IPPAttribute{Name: name, Values: []IPPValue{{Tag: ippTagResolution, Data: data}}})
+}
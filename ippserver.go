@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// IPPDocumentFormats are the document formats IPP printers accept.
+var IPPDocumentFormats = []string{"image/pwg-raster", "image/png", "image/jpeg"}
+
+// IPP job states.
+const (
+	ippJobPending    = 3
+	ippJobHeld       = 4
+	ippJobProcessing = 5
+	ippJobCanceled   = 7
+	ippJobAborted    = 8
+	ippJobCompleted  = 9
+)
+
+// IPP printer states.
+const (
+	ippPrinterIdle       = 3
+	ippPrinterProcessing = 4
+	ippPrinterStopped    = 5
+)
+
+// ippOperations are the operations every IPP printer supports.
+var ippOperations = []int{
+	IPPPrintJob,
+	IPPValidateJob,
+	IPPCancelJob,
+	IPPGetJobAttributes,
+	IPPGetJobs,
+	IPPGetPrinterAttributes,
+}
+
+// IPPJob is a document printed through IPP. IPP job IDs are numbers, and a
+// document can have several pages, so it keeps the print job of each page.
+type IPPJob struct {
+	ID        int
+	Printer   string
+	Format    string
+	Name      string
+	User      string
+	CreatedAt time.Time
+	Jobs      []*PrintJob
+}
+
+// state is the IPP job state and reason summing up the job's print jobs.
+func (j *IPPJob) state() (int, string) {
+	states := make([]JobState, len(j.Jobs))
+	for i, printJob := range j.Jobs {
+		states[i] = printJob.Status().State
+	}
+
+	switch {
+	case slices.Contains(states, JobFailed) || slices.Contains(states, JobExpired):
+		return ippJobAborted, "aborted-by-system"
+	case slices.Contains(states, JobCancelled):
+		return ippJobCanceled, "job-canceled-by-user"
+	case !slices.ContainsFunc(states, func(state JobState) bool { return state != JobCompleted }):
+		return ippJobCompleted, "job-completed-successfully"
+	case slices.Contains(states, JobPrinting):
+		return ippJobProcessing, "job-printing"
+	case slices.Contains(states, JobHeld):
+		return ippJobHeld, "printer-stopped"
+	}
+	return ippJobPending, "none"
+}
+
+func (j *IPPJob) finished() bool {
+	state, _ := j.state()
+	return state >= ippJobCanceled
+}
+
+// ippStartTime is when the server started, which IPP times count from.
+var ippStartTime = time.Now()
+
+type IPPJobStore struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[int]*IPPJob
+}
+
+var ippJobStore = &IPPJobStore{nextID: 1, jobs: map[int]*IPPJob{}}
+
+// add gives the job the next ID and stores it, forgetting finished jobs
+// older than JobRetention.
+func (s *IPPJobStore) add(job *IPPJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, stored := range s.jobs {
+		if stored.CreatedAt.Before(time.Now().Add(-JobRetention)) && stored.finished() {
+			delete(s.jobs, id)
+		}
+	}
+
+	job.ID = s.nextID
+	s.nextID++
+	s.jobs[job.ID] = job
+}
+
+func (s *IPPJobStore) get(id int) (*IPPJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, found := s.jobs[id]
+	return job, found
+}
+
+// list returns the jobs of an IPP printer in the order they were created.
+func (s *IPPJobStore) list(printerName, formatName string) []*IPPJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []*IPPJob
+	for _, job := range s.jobs {
+		if job.Printer == printerName && job.Format == formatName {
+			jobs = append(jobs, job)
+		}
+	}
+	slices.SortFunc(jobs, func(a, b *IPPJob) int { return a.ID - b.ID })
+	return jobs
+}
+
+// IPPPrinter is one printer and label format pair, which IPP clients see as
+// a printer of its own at /ipp/print/{printer}/{format}.
+type IPPPrinter struct {
+	Printer Printer
+	Format  LabelFormat
+	URI     string
+}
+
+// startIPPServer serves the IPP printers on config.IPPAddress.
+func startIPPServer(c alice.Chain) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/ipp/print/{printer}/{format}", c.Then(http.HandlerFunc(ippPrint)))
+
+	server := &http.Server{
+		Addr:        config.IPPAddress,
+		Handler:     mux,
+		ReadTimeout: 2 * time.Minute,
+	}
+
+	go func() {
+		log.Info().Str("address", config.IPPAddress).Msg("Starting IPP server")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("IPP server startup failed")
+		}
+	}()
+	return server
+}
+
+func ippPrint(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		if !allowedNetworkAddress(req.RemoteAddr) {
+			hlog.FromRequest(req).Warn().Msg("Refused IPP request from a client not in network_clients")
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.Header.Get("Content-Type") != "application/ipp" {
+			rw.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body := bufio.NewReader(http.MaxBytesReader(rw, req.Body, MaxNetworkJobSize))
+		request, err := readIPPMessage(body)
+		if err != nil {
+			hlog.FromRequest(req).Info().Err(err).Msg("Bad IPP request")
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response := handleIPP(req, request, body)
+		rw.Header().Set("Content-Type", "application/ipp")
+		if _, err := rw.Write(response.encode()); err != nil {
+			hlog.FromRequest(req).Err(err).Msgf("")
+		}
+	}
+}
+
+// handleIPP answers an IPP request to the printer in the request path.
+func handleIPP(req *http.Request, request *IPPMessage, document *bufio.Reader) *IPPMessage {
+	response := &IPPMessage{Version: 0x0200, Code: IPPStatusOK, RequestID: request.RequestID}
+	if request.Version>>8 == 1 {
+		response.Version = 0x0101
+	}
+	operation := IPPGroup{Tag: ippTagOperation}
+	operation.add("attributes-charset", ippTagCharset, "utf-8")
+	operation.add("attributes-natural-language", ippTagLanguage, "en")
+	response.Groups = append(response.Groups, operation)
+
+	fail := func(status uint16, message string) *IPPMessage {
+		response.Code = status
+		response.Groups[0].add("status-message", ippTagText, message)
+		return response
+	}
+
+	if major := request.Version >> 8; major != 1 && major != 2 {
+		return fail(IPPStatusVersionUnsupported, "only IPP 1.1 and 2.0 are supported")
+	}
+
+	format, _, exists := findLabelFormat(req.PathValue("format"))
+	pool := labelPrinters[format.Name]
+	if !exists || pool == nil {
+		return fail(IPPStatusNotFound, fmt.Sprintf("label format '%s' does not exist", req.PathValue("format")))
+	}
+	printer, found := pool.find(req.PathValue("printer"))
+	if !found {
+		return fail(IPPStatusNotFound, fmt.Sprintf("printer '%s' cannot print label format '%s'", req.PathValue("printer"), req.PathValue("format")))
+	}
+	ippPrinter := IPPPrinter{
+		Printer: printer,
+		Format:  format,
+		URI:     "ipp://" + req.Host + req.URL.Path,
+	}
+
+	logger := hlog.FromRequest(req).With().Str("ipp_printer", printer.Name).Str("format", ippPrinter.Format.Name).Logger()
+	logger.Debug().Int("operation", int(request.Code)).Msg("IPP request")
+
+	switch request.Code {
+	case IPPGetPrinterAttributes:
+		group := ippPrinter.attributes()
+		response.Groups = append(response.Groups, group.filter(request.stringsAttribute("requested-attributes")))
+	case IPPValidateJob:
+		if _, err := ippPrintOptions(request); err != nil {
+			return fail(ippStatus(err), ippStatusMessage(err))
+		}
+		if err := checkIPPDocumentFormat(request.stringAttribute("document-format")); err != nil {
+			return fail(ippStatus(err), ippStatusMessage(err))
+		}
+	case IPPPrintJob:
+		job, err := ippPrinter.print(req, logger, request, document)
+		if err != nil {
+			logger.Info().Err(err).Msg("IPP job refused")
+			return fail(ippStatus(err), ippStatusMessage(err))
+		}
+		response.Groups = append(response.Groups, job.attributes(ippPrinter))
+	case IPPGetJobs:
+		which := request.stringAttribute("which-jobs")
+		limit, limited := request.intAttribute("limit")
+		for _, job := range ippJobStore.list(printer.Name, ippPrinter.Format.Name) {
+			if limited && len(response.Groups)-1 >= limit {
+				break
+			}
+			switch which {
+			case "completed":
+				if !job.finished() {
+					continue
+				}
+			case "all":
+			default:
+				if job.finished() {
+					continue
+				}
+			}
+			response.Groups = append(response.Groups, job.attributes(ippPrinter))
+		}
+	case IPPGetJobAttributes, IPPCancelJob:
+		job, err := ippPrinter.job(request)
+		if err != nil {
+			return fail(ippStatus(err), ippStatusMessage(err))
+		}
+		if request.Code == IPPGetJobAttributes {
+			response.Groups = append(response.Groups, job.attributes(ippPrinter))
+			break
+		}
+		if job.finished() {
+			return fail(IPPStatusNotPossible, fmt.Sprintf("job %d has already finished", job.ID))
+		}
+		for _, printJob := range job.Jobs {
+			if queue := printQueue(printJob.Status().Printer); queue != nil {
+				queue.cancel(printJob)
+			}
+		}
+		logger.Info().Int("ipp_job_id", job.ID).Msg("IPP job cancelled")
+	default:
+		return fail(IPPStatusOperationUnsupported, fmt.Sprintf("operation 0x%04x is not supported", request.Code))
+	}
+	return response
+}
+
+// job finds the job named by a request's job-id, which must be one of this
+// printer's.
+func (p IPPPrinter) job(request *IPPMessage) (*IPPJob, error) {
+	id, found := request.intAttribute("job-id")
+	if !found {
+		return nil, &ippError{IPPStatusBadRequest, "job-id is required"}
+	}
+	job, exists := ippJobStore.get(id)
+	if !exists || job.Printer != p.Printer.Name || job.Format != p.Format.Name {
+		return nil, &ippError{IPPStatusNotFound, fmt.Sprintf("job %d does not exist", id)}
+	}
+	return job, nil
+}
+
+// print reads the request's document, draws a label for each page and
+// queues them on the printer.
+func (p IPPPrinter) print(req *http.Request, logger zerolog.Logger, request *IPPMessage, document *bufio.Reader) (*IPPJob, error) {
+	options, err := ippPrintOptions(request)
+	if err != nil {
+		return nil, err
+	}
+	documentFormat := request.stringAttribute("document-format")
+	if err := checkIPPDocumentFormat(documentFormat); err != nil {
+		return nil, err
+	}
+
+	upload, err := saveUpload(request.stringAttribute("document-name"), document)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, &ippError{IPPStatusRequestTooLarge, fmt.Sprintf("documents can be at most %dMB", MaxNetworkJobSize>>20)}
+		}
+		return nil, err
+	}
+	defer upload.remove(logger)
+
+	var labels []*RenderedLabel
+	err = eachIPPPage(upload, documentFormat, func(page image.Image) error {
+		label, err := prepareLabel(page, p.Format.Name, PipelineOptions{Rotate: RotateAuto, Threshold: DefaultThreshold})
+		if err != nil {
+			return err
+		}
+		labels = append(labels, label)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	warnings, err := checkLabels(labels, config.PrintableAreaStrictness, p.Printer.Name, options)
+	if err != nil {
+		return nil, err
+	}
+	printJobs, err := queueLabels(logger, labels, warnings, p.Printer.Name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &IPPJob{
+		Printer:   p.Printer.Name,
+		Format:    p.Format.Name,
+		Name:      request.stringAttribute("job-name"),
+		User:      request.stringAttribute("requesting-user-name"),
+		CreatedAt: time.Now(),
+		Jobs:      printJobs,
+	}
+	ippJobStore.add(job)
+	logger.Info().Int("ipp_job_id", job.ID).Int("Pages", len(labels)).Str("user", job.User).Msg("IPP job queued")
+	return job, nil
+}
+
+// ippPrintOptions reads the job template attributes the printers use.
+func ippPrintOptions(request *IPPMessage) (PrintOptions, error) {
+	var options PrintOptions
+	if copies, found := request.intAttribute("copies"); found {
+		if copies < 1 || copies > MaxCopies {
+			return options, newPrintError(CodeUnsupportedOption, nil, "copies must be from 1 to %d", MaxCopies)
+		}
+		options.Copies = copies
+	}
+	return options, nil
+}
+
+// checkIPPDocumentFormat checks a document format is one the printers
+// accept. Clients that do not say are sniffed.
+func checkIPPDocumentFormat(documentFormat string) error {
+	if documentFormat == "" || documentFormat == "application/octet-stream" || slices.Contains(IPPDocumentFormats, documentFormat) {
+		return nil
+	}
+	return &ippError{IPPStatusDocumentFormatUnsupported, fmt.Sprintf("document-format '%s' is not supported", documentFormat)}
+}
+
+// ippError is an error with the IPP status to answer it with, for errors
+// that only arise in IPP.
+type ippError struct {
+	status  uint16
+	message string
+}
+
+func (e *ippError) Error() string {
+	return e.message
+}
+
+// eachIPPPage passes each page of a PWG raster document, or a PNG or JPEG
+// image, to handle in turn.
+func eachIPPPage(upload *LabelImage, documentFormat string, handle func(image.Image) error) error {
+	file, err := os.Open(upload.File.Name())
+	if err != nil {
+		return newPrintError(CodeInternal, err, "could not get image from file")
+	}
+	defer file.Close()
+
+	sync := make([]byte, 4)
+	n, _ := file.ReadAt(sync, 0)
+	if documentFormat == "image/pwg-raster" || string(sync[:n]) == "RaS2" {
+		return eachPWGPage(file, handle)
+	}
+	if isPDF(file) {
+		return &ippError{IPPStatusDocumentFormatUnsupported, "document-format 'application/pdf' is not supported"}
+	}
+	if err := upload.decode(); err != nil {
+		return err
+	}
+	return handle(upload.Image)
+}
+
+// ippStatus picks the IPP status for an error.
+func ippStatus(err error) uint16 {
+	var ippErr *ippError
+	if errors.As(err, &ippErr) {
+		return ippErr.status
+	}
+
+	var printErr *PrintError
+	if !errors.As(err, &printErr) {
+		return IPPStatusInternalError
+	}
+	switch printErr.Code {
+	case CodeInvalidImage:
+		return IPPStatusDocumentFormatError
+	case CodeUnsupportedOption:
+		return IPPStatusAttributesUnsupported
+	case CodeInvalidRequest:
+		return IPPStatusBadRequest
+	case CodeInternal:
+		return IPPStatusInternalError
+	}
+	return IPPStatusNotPossible
+}
+
+func ippStatusMessage(err error) string {
+	var printErr *PrintError
+	if errors.As(err, &printErr) {
+		return printErr.Detail
+	}
+	return err.Error()
+}
+
+// mediaName is the PWG self-describing media name of a label format.
+func (f LabelFormat) mediaName() string {
+	if f.LengthMM == 0 {
+		return fmt.Sprintf("roll_%s_%dx1000mm", f.Name, f.WidthMM)
+	}
+	return fmt.Sprintf("custom_%s_%dx%dmm", f.Name, f.WidthMM, f.LengthMM)
+}
+
+// attributes are the printer's description and job template attributes.
+func (p IPPPrinter) attributes() IPPGroup {
+	group := IPPGroup{Tag: ippTagPrinter}
+
+	state, reason := ippPrinterIdle, "none"
+	jobs := 0
+	if queue := printQueue(p.Printer.Name); queue != nil {
+		jobs = queue.Depth()
+		if jobs > 0 {
+			state = ippPrinterProcessing
+		}
+		switch queue.Status().HoldReason() {
+		case "":
+		case "printer offline":
+			state, reason = ippPrinterStopped, "offline-report"
+		case "no media loaded":
+			state, reason = ippPrinterStopped, "media-empty-error"
+		default:
+			state, reason = ippPrinterStopped, "other-error"
+		}
+	}
+
+	group.add("printer-uri-supported", ippTagURI, p.URI)
+	group.add("uri-authentication-supported", ippTagKeyword, "none")
+	group.add("uri-security-supported", ippTagKeyword, "none")
+	group.add("printer-name", ippTagName, p.Printer.Name+"-"+p.Format.Name)
+	group.add("printer-info", ippTagText, fmt.Sprintf("%s with %s labels", p.Printer.Name, p.Format.Name))
+	group.add("printer-make-and-model", ippTagText, "Brother "+p.Printer.Model)
+	group.addInt("printer-state", ippTagEnum, state)
+	group.add("printer-state-reasons", ippTagKeyword, reason)
+	group.addBool("printer-is-accepting-jobs", true)
+	group.addInt("queued-job-count", ippTagInteger, jobs)
+	group.addInt("printer-up-time", ippTagInteger, int(time.Since(ippStartTime).Seconds())+1)
+	group.add("ipp-versions-supported", ippTagKeyword, "1.1", "2.0")
+	group.addInt("operations-supported", ippTagEnum, ippOperations...)
+	group.add("charset-configured", ippTagCharset, "utf-8")
+	group.add("charset-supported", ippTagCharset, "utf-8")
+	group.add("natural-language-configured", ippTagLanguage, "en")
+	group.add("generated-natural-language-supported", ippTagLanguage, "en")
+	group.add("document-format-default", ippTagMimeType, "application/octet-stream")
+	group.add("document-format-supported", ippTagMimeType, append([]string{"application/octet-stream"}, IPPDocumentFormats...)...)
+	group.add("compression-supported", ippTagKeyword, "none")
+	group.add("pdl-override-supported", ippTagKeyword, "not-attempted")
+	group.addBool("color-supported", false)
+	group.add("print-color-mode-default", ippTagKeyword, "monochrome")
+	group.add("print-color-mode-supported", ippTagKeyword, "monochrome")
+	group.add("sides-default", ippTagKeyword, "one-sided")
+	group.add("sides-supported", ippTagKeyword, "one-sided")
+	group.addInt("copies-default", ippTagInteger, 1)
+	group.addRange("copies-supported", 1, MaxCopies)
+	group.add("media-default", ippTagKeyword, p.Format.mediaName())
+	group.add("media-supported", ippTagKeyword, p.Format.mediaName())
+	group.add("media-ready", ippTagKeyword, p.Format.mediaName())
+	group.addResolution("printer-resolution-default", 300)
+	group.addResolution("printer-resolution-supported", 300)
+	group.addResolution("pwg-raster-document-resolution-supported", 300)
+	group.add("pwg-raster-document-type-supported", ippTagKeyword, "black_1", "sgray_8", "srgb_8")
+	group.add("pwg-raster-document-sheet-back", ippTagKeyword, "normal")
+	group.add("job-creation-attributes-supported", ippTagKeyword, "copies", "media")
+	return group
+}
+
+// filter keeps the attributes a client asked for, or all of them if it
+// asked for all or none in particular.
+func (g IPPGroup) filter(requested []string) IPPGroup {
+	if len(requested) == 0 || slices.Contains(requested, "all") || slices.Contains(requested, "printer-description") || slices.Contains(requested, "job-template") {
+		return g
+	}
+
+	filtered := IPPGroup{Tag: g.Tag}
+	for _, attribute := range g.Attributes {
+		if slices.Contains(requested, attribute.Name) {
+			filtered.Attributes = append(filtered.Attributes, attribute)
+		}
+	}
+	return filtered
+}
+
+// attributes are the job's description attributes.
+func (j *IPPJob) attributes(printer IPPPrinter) IPPGroup {
+	group := IPPGroup{Tag: ippTagJob}
+	state, reason := j.state()
+
+	group.addInt("job-id", ippTagInteger, j.ID)
+	group.add("job-uri", ippTagURI, printer.URI+"/"+strconv.Itoa(j.ID))
+	group.add("job-printer-uri", ippTagURI, printer.URI)
+	group.addInt("job-state", ippTagEnum, state)
+	group.add("job-state-reasons", ippTagKeyword, reason)
+	if j.Name != "" {
+		group.add("job-name", ippTagName, j.Name)
+	}
+	if j.User != "" {
+		group.add("job-originating-user-name", ippTagName, j.User)
+	}
+	group.addInt("time-at-creation", ippTagInteger, int(j.CreatedAt.Sub(ippStartTime).Seconds())+1)
+	group.addInt("job-impressions", ippTagInteger, len(j.Jobs))
+	return group
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	PrinterReady        = "ready"
+	PrinterHeld         = "held"
+	PrinterUnregistered = "unregistered"
+)
+
+type MediaInfo struct {
+	Known    bool   `json:"known"`
+	Loaded   bool   `json:"loaded"`
+	Type     string `json:"type,omitempty"`
+	WidthMM  int    `json:"width_mm,omitempty"`
+	LengthMM int    `json:"length_mm,omitempty"`
+}
+
+type PrinterInfo struct {
+	Name       string    `json:"name,omitempty"`
+	Model      string    `json:"model"`
+	Port       string    `json:"port"`
+	Serial     string    `json:"serial,omitempty"`
+	Online     bool      `json:"online"`
+	Status     string    `json:"status"`
+	HoldReason string    `json:"hold_reason,omitempty"`
+	QueueDepth int       `json:"queue_depth"`
+	Media      MediaInfo `json:"media"`
+	Formats    []string  `json:"formats"`
+	// LastEvent is the last time the printer was plugged in or unplugged.
+	LastEvent *PrinterEvent `json:"last_event,omitempty"`
+}
+
+// PrintableArea is a rectangle in pixels from the top left of a label image.
+type PrintableArea struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type FormatInfo struct {
+	Name          string        `json:"name"`
+	WidthPx       int           `json:"width_px"`
+	HeightPx      int           `json:"height_px"`
+	WidthMM       int           `json:"width_mm"`
+	LengthMM      int           `json:"length_mm"`
+	Type          string        `json:"type"`
+	PrintableArea PrintableArea `json:"printable_area"`
+	Printers      []string      `json:"printers"`
+}
+
+// printerFormats lists the label formats whose pool includes the printer.
+func printerFormats(name string) []string {
+	formats := []string{}
+	for formatName, pool := range labelPrinters {
+		if _, found := pool.find(name); found {
+			formats = append(formats, formatName)
+		}
+	}
+	slices.Sort(formats)
+	return formats
+}
+
+func (q *PrintQueue) Info() PrinterInfo {
+	q.mu.Lock()
+	status := q.status
+	holdReason := q.holdReason
+	q.mu.Unlock()
+
+	info := PrinterInfo{
+		Name:       q.Printer.Name,
+		Model:      q.Printer.Model,
+		Port:       q.Printer.Port,
+		Serial:     q.Printer.Serial,
+		Online:     status.Online,
+		Status:     PrinterReady,
+		HoldReason: holdReason,
+		QueueDepth: q.Depth(),
+		Media: MediaInfo{
+			Known:    status.MediaKnown,
+			Loaded:   status.MediaLoaded,
+			Type:     status.MediaType,
+			WidthMM:  status.MediaWidthMM,
+			LengthMM: status.MediaLengthMM,
+		},
+		Formats: printerFormats(q.Printer.Name),
+	}
+	if event, exists := hotplugWatcher.LastEvent(q.Printer.Name); exists {
+		info.LastEvent = &event
+	}
+	if holdReason != "" {
+		info.Status = PrinterHeld
+	}
+
+	return info
+}
+
+// listPrinters returns every known printer followed by any attached printer
+// that matches none of them.
+func listPrinters() []PrinterInfo {
+	printers := []PrinterInfo{}
+	for _, queue := range allPrintQueues() {
+		printers = append(printers, queue.Info())
+	}
+
+	var unregistered []PrinterInfo
+	for _, device := range hotplugWatcher.Attached() {
+		if matchPrinter(device) != "" {
+			continue
+		}
+		unregistered = append(unregistered, PrinterInfo{
+			Model:   device.Model,
+			Port:    device.Port(),
+			Serial:  device.Serial,
+			Online:  true,
+			Status:  PrinterUnregistered,
+			Formats: []string{},
+		})
+	}
+	slices.SortFunc(unregistered, func(a, b PrinterInfo) int {
+		return strings.Compare(a.Port, b.Port)
+	})
+
+	return append(printers, unregistered...)
+}
+
+func listFormats() []FormatInfo {
+	formats := []FormatInfo{}
+	for dimensions, format := range labelFormats {
+		info := FormatInfo{
+			Name:     format.Name,
+			WidthPx:  dimensions.X,
+			HeightPx: dimensions.Y,
+			WidthMM:  format.WidthMM,
+			LengthMM: format.LengthMM,
+			Type:     format.Type,
+			PrintableArea: PrintableArea{
+				X:      format.Margins.Left,
+				Y:      format.Margins.Top,
+				Width:  dimensions.X - format.Margins.Left - format.Margins.Right,
+				Height: dimensions.Y - format.Margins.Top - format.Margins.Bottom,
+			},
+			Printers: []string{},
+		}
+
+		if pool, exists := labelPrinters[format.Name]; exists {
+			info.Printers = pool.names()
+		}
+
+		formats = append(formats, info)
+	}
+
+	slices.SortFunc(formats, func(a, b FormatInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return formats
+}
+
+func writeJSON(rw http.ResponseWriter, req *http.Request, v any) {
+	responseBytes, err := json.Marshal(v)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Msgf("")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if _, err := rw.Write(responseBytes); err != nil {
+		hlog.FromRequest(req).Err(err).Msgf("")
+	}
+}
+
+func printers(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, req, listPrinters())
+	}
+}
+
+func formats(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, req, listFormats())
+	}
+}
+
+func fonts(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, req, listFonts())
+	}
+}
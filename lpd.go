@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// LPD commands and the receive job subcommands, from RFC 1179.
+const (
+	lpdPrintWaiting     = 0x01
+	lpdReceiveJob       = 0x02
+	lpdQueueStateShort  = 0x03
+	lpdQueueStateLong   = 0x04
+	lpdRemoveJobs       = 0x05
+	lpdAbortJob         = 0x01
+	lpdReceiveControl   = 0x02
+	lpdReceiveData      = 0x03
+	lpdAcknowledge      = 0x00
+	lpdNegativeResponse = 0x01
+)
+
+const (
+	// MaxLPDControlFileSize limits the size of an LPD control file, which
+	// only holds a few short lines.
+	MaxLPDControlFileSize = 64 << 10
+	// MaxLPDDataFiles limits how many data files one LPD job can send, as
+	// they are all saved before any is printed.
+	MaxLPDDataFiles = MaxUploadFiles
+)
+
+// lpdPrintCommands are the control file commands that print a data file,
+// one for each kind of file the client says it is sending. They are all
+// printed the same way.
+const lpdPrintCommands = "cdfglnoprtv"
+
+// LPDControlFile is what the server uses of a job's control file: who sent
+// it, for the log, and how many times each data file is to be printed.
+type LPDControlFile struct {
+	Host    string
+	User    string
+	JobName string
+	Copies  map[string]int
+}
+
+func parseLPDControlFile(content string) LPDControlFile {
+	control := LPDControlFile{Copies: map[string]int{}}
+	for _, line := range strings.Split(content, "\n") {
+		if line == "" {
+			continue
+		}
+		command, operand := line[0], strings.TrimSpace(line[1:])
+		switch {
+		case command == 'H':
+			control.Host = operand
+		case command == 'P':
+			control.User = operand
+		case command == 'J':
+			control.JobName = operand
+		case strings.IndexByte(lpdPrintCommands, command) >= 0:
+			control.Copies[operand]++
+		}
+	}
+	return control
+}
+
+// lpdDataFile is a data file received for a job, kept until the whole job
+// has been received.
+type lpdDataFile struct {
+	name   string
+	upload *LabelImage
+}
+
+// startLPDServer serves an LPD queue for every printer on config.LPDAddress.
+func startLPDServer(ctx context.Context) error {
+	listener, err := net.Listen("tcp", config.LPDAddress)
+	if err != nil {
+		return fmt.Errorf("lpd: %w", err)
+	}
+
+	logger := log.With().Str("lpd", config.LPDAddress).Logger()
+	logger.Info().Msg("Starting LPD server")
+	acceptNetworkClients(ctx, listener, logger, func(conn net.Conn, logger zerolog.Logger) {
+		handleLPD(ctx, conn, logger)
+	})
+	return nil
+}
+
+// handleLPD answers one LPD command. The queue is "<printer>" to print on
+// the format chosen from each image's size, or "<printer>/<format>".
+func handleLPD(ctx context.Context, conn net.Conn, logger zerolog.Logger) {
+	reader := bufio.NewReader(conn)
+	command, operand, err := readLPDLine(reader)
+	if err != nil {
+		logger.Info().Err(err).Msg("Bad LPD command")
+		return
+	}
+	queue, _, _ := strings.Cut(operand, " ")
+	printerName, formatName, _ := strings.Cut(queue, "/")
+	networkPrinter := NetworkPrinter{Printer: printerName, Format: formatName}
+	logger = logger.With().Str("queue", queue).Logger()
+
+	switch command {
+	case lpdPrintWaiting:
+		// Jobs are queued as soon as they are received, so there is never
+		// anything waiting to be started.
+	case lpdReceiveJob:
+		if err := networkPrinter.check(); err != nil {
+			logger.Info().Err(err).Msg("LPD job refused")
+			conn.Write([]byte{lpdNegativeResponse})
+			return
+		}
+		conn.Write([]byte{lpdAcknowledge})
+		networkPrinter.receiveLPDJob(ctx, conn, reader, logger)
+	case lpdQueueStateShort, lpdQueueStateLong:
+		fmt.Fprintln(conn, lpdQueueState(networkPrinter))
+	case lpdRemoveJobs:
+		logger.Info().Msg("LPD remove jobs is not supported")
+	default:
+		logger.Info().Int("command", int(command)).Msg("Unknown LPD command")
+	}
+}
+
+// receiveLPDJob reads the control and data files of a job until the client
+// closes the connection, then prints each data file as many times as the
+// control file says. LPD has no way to report an error once a file has been
+// received, so errors printing it are only logged.
+func (n NetworkPrinter) receiveLPDJob(ctx context.Context, conn net.Conn, reader *bufio.Reader, logger zerolog.Logger) {
+	var control LPDControlFile
+	var dataFiles []lpdDataFile
+	defer func() {
+		for _, dataFile := range dataFiles {
+			if dataFile.upload != nil {
+				dataFile.upload.remove(logger)
+			}
+		}
+	}()
+
+	for {
+		subcommand, operand, err := readLPDLine(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Info().Err(err).Msg("Bad LPD subcommand")
+			return
+		}
+
+		switch subcommand {
+		case lpdAbortJob:
+			logger.Info().Msg("LPD job aborted by the client")
+			return
+		case lpdReceiveControl, lpdReceiveData:
+		default:
+			logger.Info().Int("subcommand", int(subcommand)).Msg("Unknown LPD subcommand")
+			conn.Write([]byte{lpdNegativeResponse})
+			return
+		}
+
+		sizeField, name, _ := strings.Cut(operand, " ")
+		size, err := strconv.ParseInt(sizeField, 10, 64)
+		maxSize := int64(MaxNetworkJobSize)
+		if subcommand == lpdReceiveControl {
+			maxSize = MaxLPDControlFileSize
+		}
+		if err != nil || size <= 0 || size > maxSize {
+			logger.Info().Str("size", sizeField).Msg("LPD file refused")
+			conn.Write([]byte{lpdNegativeResponse})
+			return
+		}
+		if subcommand == lpdReceiveData && len(dataFiles) == MaxLPDDataFiles {
+			logger.Info().Int("limit", MaxLPDDataFiles).Msg("LPD job has too many data files")
+			conn.Write([]byte{lpdNegativeResponse})
+			return
+		}
+		conn.Write([]byte{lpdAcknowledge})
+
+		content := io.LimitReader(reader, size)
+		if subcommand == lpdReceiveControl {
+			controlBytes, err := io.ReadAll(content)
+			if err != nil {
+				logger.Info().Err(err).Msg("Cannot read LPD control file")
+				return
+			}
+			control = parseLPDControlFile(string(controlBytes))
+		} else {
+			upload, err := receive(name, content)
+			if err != nil {
+				logger.Info().Err(err).Msg("Cannot read LPD data file")
+				return
+			}
+			dataFiles = append(dataFiles, lpdDataFile{name: name, upload: upload})
+		}
+
+		if end, err := reader.ReadByte(); err != nil || end != 0 {
+			logger.Info().Msg("LPD file was cut short")
+			return
+		}
+		conn.Write([]byte{lpdAcknowledge})
+	}
+
+	logger = logger.With().Str("lpd_host", control.Host).Str("lpd_user", control.User).Str("lpd_job", control.JobName).Logger()
+	for i, dataFile := range dataFiles {
+		// print removes the file once it is done with it.
+		dataFiles[i].upload = nil
+
+		var options PrintOptions
+		if copies := control.Copies[dataFile.name]; copies > 1 {
+			options.Copies = min(copies, MaxCopies)
+		}
+		printJobs, err := n.print(ctx, logger, dataFile.upload, options)
+		if err != nil {
+			logger.Info().Err(err).Str("file", dataFile.name).Msg("LPD job refused")
+			continue
+		}
+		logger.Info().Strs("job_ids", jobIDs(printJobs)).Str("file", dataFile.name).Msg("LPD job queued")
+	}
+}
+
+// readLPDLine reads a command or subcommand: its code, then its operands up
+// to a line feed.
+func readLPDLine(reader *bufio.Reader) (byte, string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return 0, "", io.EOF
+		}
+		return 0, "", fmt.Errorf("could not read LPD command: %w", err)
+	}
+	if len(line) < 2 {
+		return 0, "", errors.New("empty LPD command")
+	}
+	return line[0], string(line[1 : len(line)-1]), nil
+}
+
+// lpdQueueState describes a printer's queue for the queue state commands.
+func lpdQueueState(n NetworkPrinter) string {
+	queue := printQueue(n.Printer)
+	if queue == nil {
+		return fmt.Sprintf("%s: no such printer", n.Printer)
+	}
+
+	state := "ready"
+	if reason := queue.Status().HoldReason(); reason != "" {
+		state = "paused, " + reason
+	}
+	return fmt.Sprintf("%s is %s, %d jobs queued", n.Printer, state, queue.Depth())
+}
@@ -3,14 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"image/png"
+	"image"
+	_ "image/jpeg"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -30,15 +32,11 @@ import (
 
 var log zerolog.Logger
 
-type PrintJob struct {
-	Printer    Printer
-	FormatName string
-	FilePath   string
-}
-
 type Printer struct {
-	Port string
-	Name string
+	Name   string
+	Model  string
+	Port   string
+	Serial string
 }
 
 type LabelDimensions struct {
@@ -47,27 +45,71 @@ type LabelDimensions struct {
 }
 
 type LabelFormat struct {
-	Name string
+	Name     string
+	WidthMM  int
+	LengthMM int
+	Type     string
+	// Total is the size of the whole label in dots, including the margins
+	// the printer cannot print on.
+	Total LabelDimensions
+	// OffsetRight is the label's padding, in dots, on the right of each
+	// raster line.
+	OffsetRight int
+	// Margins are the edges of the printable size that may be clipped
+	// because die-cut labels are not always fed to exactly the same place.
+	// Neither brother_ql's label table nor Brother's raster command
+	// reference gives any beyond the printable size, so they are zero
+	// unless measured and set with format_margins.
+	Margins LabelMargins
 }
 
+// https://github.com/pklaus/brother_ql/blob/56cf4394ad750346c6b664821ccd7489ec140dae/brother_ql/labels.py
 var labelFormats = map[LabelDimensions]LabelFormat{
 	{X: 696, Y: 1109}: {
-		Name: "62x100",
+		Name:        "62x100",
+		WidthMM:     62,
+		LengthMM:    100,
+		Type:        MediaTypeDieCut,
+		Total:       LabelDimensions{X: 732, Y: 1200},
+		OffsetRight: 12,
 	},
 	{X: 1164, Y: 1660}: {
-		Name: "102x152",
+		Name:        "102x152",
+		WidthMM:     102,
+		LengthMM:    152,
+		Type:        MediaTypeDieCut,
+		Total:       LabelDimensions{X: 1200, Y: 1822},
+		OffsetRight: 12,
 	},
 }
 
+// findLabelFormat looks up a label format by name.
+func findLabelFormat(name string) (LabelFormat, LabelDimensions, bool) {
+	for dimensions, format := range labelFormats {
+		if format.Name == name {
+			return format, dimensions, true
+		}
+	}
+	return LabelFormat{}, LabelDimensions{}, false
+}
+
 // https://github.com/pklaus/brother_ql/blob/56cf4394ad750346c6b664821ccd7489ec140dae/brother_ql/labels.py#L91
-var labelPrinters = map[LabelFormat]Printer{
-	{Name: "62x100"}: {
-		Name: "QL-500",
-		Port: "usb://0x04f9:0x2015",
+var labelPrinters = map[string]*PrinterPool{
+	"62x100": {
+		Routing: RoutingFailover,
+		Printers: []Printer{{
+			Name:  "QL-500",
+			Model: "QL-500",
+			Port:  "usb://0x04f9:0x2015",
+		}},
 	},
-	{Name: "102x152"}: {
-		Name: "QL-1060N",
-		Port: "usb://0x04f9:0x202a",
+	"102x152": {
+		Routing: RoutingFailover,
+		Printers: []Printer{{
+			Name:  "QL-1060N",
+			Model: "QL-1060N",
+			Port:  "usb://0x04f9:0x202a",
+		}},
 	},
 }
 
@@ -76,6 +118,8 @@ const (
 	UploadDirectory        = "uploads"
 	Region                 = "eu-west-2"
 	TunnelURLParameterName = "/control_alt_repeat/ebay/live/label_printer/host_domain"
+	PrintTimeout           = 20 * time.Second
+	PrintWaitTimeout       = 25 * time.Second
 )
 
 func main() {
@@ -91,25 +135,48 @@ func main() {
 		Logger().
 		Level(zerolog.DebugLevel)
 
+	if err := loadConfig(); err != nil {
+		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
+	}
+
+	if err := applyPrinterPoolConfig(); err != nil {
+		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
+	}
+
+	if err := applyFormatMargins(); err != nil {
+		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
+	}
+
 	if err := createUploadDirectory(); err != nil {
 		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
 	}
 
-	aws_session, err := setupAwsSession()
-	if err != nil {
+	if err := loadFonts(); err != nil {
 		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
 	}
 
-	tunnel, err := localtunnel.Listen(localtunnel.Options{})
-	if err != nil {
+	if err := loadCounters(); err != nil {
 		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
 	}
-	log.Info().Msgf("Tunnel opened at '%s'", tunnel.URL())
 
-	if err = saveTunnelUrlInParameterStore(aws_session, tunnel.URL()); err != nil {
+	aws_session, err := setupAwsSession()
+	if err != nil {
 		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
 	}
 
+	var tunnel *localtunnel.Listener
+	if config.Tunnel {
+		tunnel, err = localtunnel.Listen(localtunnel.Options{})
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
+		}
+		log.Info().Msgf("Tunnel opened at '%s'", tunnel.URL())
+
+		if err = saveTunnelUrlInParameterStore(aws_session, tunnel.URL()); err != nil {
+			log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
+		}
+	}
+
 	c := alice.New().
 		Append(hlog.NewHandler(log)).
 		Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
@@ -126,9 +193,59 @@ func main() {
 		Append(hlog.RefererHandler("referer")).
 		Append(hlog.RequestIDHandler("req_id", "Request-Id"))
 
+	queueCtx, stopQueues := context.WithCancel(context.Background())
+	defer stopQueues()
+
+	for _, pool := range labelPrinters {
+		for _, printer := range pool.Printers {
+			startPrintQueue(queueCtx, printer)
+		}
+	}
+
+	hotplugWatcher.Start(queueCtx)
+	warnMissingPrinters()
+
+	if err := startHotFolders(queueCtx); err != nil {
+		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
+	}
+
+	if config.SQS.QueueURL != "" {
+		newSQSPuller(aws_session, config.SQS).Start(queueCtx)
+	}
+
+	if err := startRawPrinters(queueCtx); err != nil {
+		log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
+	}
+	if config.LPDAddress != "" {
+		if err := startLPDServer(queueCtx); err != nil {
+			log.Fatal().Err(err).Msgf("Cannot start %s", ServiceName)
+		}
+	}
+
 	pingHandler := c.Then(http.HandlerFunc(ping))
 	printHandler := c.Then(http.HandlerFunc(print))
 	printerHandler := c.Then(http.HandlerFunc(printer))
+	jobHandler := c.Then(http.HandlerFunc(job))
+	printersHandler := c.Then(http.HandlerFunc(printers))
+	formatsHandler := c.Then(http.HandlerFunc(formats))
+	previewHandler := c.Then(http.HandlerFunc(preview))
+	testPageHandler := c.Then(http.HandlerFunc(testPage))
+	textLabelHandler := c.Then(http.HandlerFunc(textLabel))
+	barcodeLabelHandler := c.Then(http.HandlerFunc(barcodeLabel))
+	addressLabelHandler := c.Then(http.HandlerFunc(addressLabel))
+	carrierProfilesHandler := c.Then(http.HandlerFunc(carrierProfiles))
+	carrierPrintHandler := c.Then(http.HandlerFunc(carrierPrint))
+	templatesHandler := c.Then(http.HandlerFunc(templates))
+	labelTemplateHandler := c.Then(http.HandlerFunc(labelTemplate))
+	templatePrintHandler := c.Then(http.HandlerFunc(templatePrint))
+	templateBatchHandler := c.Then(http.HandlerFunc(templateBatch))
+	batchHandler := c.Then(http.HandlerFunc(batch))
+	batchCancelHandler := c.Then(http.HandlerFunc(batchCancel))
+	batchResumeHandler := c.Then(http.HandlerFunc(batchResume))
+	templateSerialsHandler := c.Then(http.HandlerFunc(templateSerials))
+	counterListHandler := c.Then(http.HandlerFunc(counterList))
+	counterHandler := c.Then(http.HandlerFunc(counter))
+	fontsHandler := c.Then(http.HandlerFunc(fonts))
 
 	server := &http.Server{
 		Addr:         "127.0.0.1:8080",
@@ -139,13 +256,45 @@ func main() {
 	http.Handle("/ping", pingHandler)
 	http.Handle("/print", printHandler)
 	http.Handle("/printer", printerHandler)
+	http.Handle("/jobs/{id}", jobHandler)
+	http.Handle("/printers", printersHandler)
+	http.Handle("/formats", formatsHandler)
+	http.Handle("/preview", previewHandler)
+	http.Handle("/printers/{name}/test-page", testPageHandler)
+	http.Handle("/labels/text", textLabelHandler)
+	http.Handle("/labels/barcode", barcodeLabelHandler)
+	http.Handle("/labels/address", addressLabelHandler)
+	http.Handle("/carrier-profiles", carrierProfilesHandler)
+	http.Handle("/carrier-profiles/{name}/print", carrierPrintHandler)
+	http.Handle("/templates", templatesHandler)
+	http.Handle("/templates/{name}", labelTemplateHandler)
+	http.Handle("/templates/{name}/print", templatePrintHandler)
+	http.Handle("/templates/{name}/batch", templateBatchHandler)
+	http.Handle("/batches/{id}", batchHandler)
+	http.Handle("/batches/{id}/cancel", batchCancelHandler)
+	http.Handle("/batches/{id}/resume", batchResumeHandler)
+	http.Handle("/templates/{name}/serials", templateSerialsHandler)
+	http.Handle("/counters", counterListHandler)
+	http.Handle("/counters/{name}", counterHandler)
+	http.Handle("/fonts", fontsHandler)
+
+	var ippServer *http.Server
+	if config.IPPAddress != "" {
+		ippServer = startIPPServer(c)
+	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT)
 
 	go func() {
 		log.Info().Msg("Starting HTTP server")
-		if err := server.Serve(tunnel); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tunnel != nil {
+			err = server.Serve(tunnel)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("Server startup failed")
 		}
 	}()
@@ -159,6 +308,11 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatal().Err(err).Msgf("error when shutting down the main server %s", ServiceName)
 	}
+	if ippServer != nil {
+		if err := ippServer.Shutdown(ctx); err != nil {
+			log.Fatal().Err(err).Msgf("error when shutting down the IPP server %s", ServiceName)
+		}
+	}
 
 	log.Info().Msgf("%s service has shutdown", "my-service")
 }
@@ -198,24 +352,40 @@ func createUploadDirectory() error {
 	return nil
 }
 
-func (j PrintJob) print(logger zerolog.Logger) error {
-	cmd := exec.Command("brother_ql",
+func (j *PrintJob) print(logger zerolog.Logger) error {
+	rasterPath := j.FilePath
+	if !j.Raster {
+		var err error
+		rasterPath, err = j.writeRaster()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(rasterPath)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PrintTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "brother_ql",
 		"--backend", "pyusb",
-		"--model", j.Printer.Name,
+		"--model", j.Printer.Model,
 		"--printer", j.Printer.Port,
-		"print",
-		"-l", j.FormatName,
-		j.FilePath)
+		"send",
+		rasterPath)
 
 	output, err := cmd.CombinedOutput()
 
 	logger.Debug().Msg(string(output))
 
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		logger.Err(err).Msg("")
+		return classifyPrintFailure(err, output)
 	}
 
-	return err
+	return nil
 }
 
 func printerActive(logger zerolog.Logger, port string) (bool, error) {
@@ -240,54 +410,264 @@ func printerActive(logger zerolog.Logger, port string) (bool, error) {
 func print(rw http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodPost:
-		var labelImage LabelImage
+		hlog.FromRequest(req).Debug().Msgf("Reading the print request")
+		printRequest, err := readPrintRequest(req)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
 
-		hlog.FromRequest(req).Debug().Msgf("Getting the label file from form")
-		if err := labelImage.retrieveImageFromForm(rw, req); err != nil {
-			hlog.FromRequest(req).Error().Err(err).Msg("")
+		defer removeUploads(hlog.FromRequest(req).With().Logger(), printRequest.Uploads)
+
+		if len(printRequest.Uploads) > 1 || printRequest.Archived {
+			printUploads(rw, req, printRequest)
 			return
 		}
+		labelImage := printRequest.Uploads[0]
 
-		if err := labelImage.getPNGDimensions(rw); err != nil {
-			hlog.FromRequest(req).Error().Err(err).Msg("")
+		labels, err := printRequest.labels(req.Context(), labelImage)
+		if err != nil {
+			writeProblem(rw, req, err)
 			return
 		}
 
 		hlog.FromRequest(req).Info().
 			Int("X", labelImage.Dimensions.X).
 			Int("Y", labelImage.Dimensions.Y).
+			Int("Pages", len(labels)).
+			Int("Copies", printRequest.PrintOptions.Copies).
 			Msg("Dimensions")
 
-		format, exists := labelFormats[labelImage.Dimensions]
-		if !exists {
-			err := fmt.Errorf("dimensions %v is not valid, must match map %v", labelImage.Dimensions, labelFormats)
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+		submitLabelsTo(rw, req, labels, printRequest.Strictness, printRequest.Printer, printRequest.PrintOptions)
+	}
+}
+
+// respondWithLabel returns a preview of a label the server drew if the
+// request's preview value is set, or otherwise prints it.
+func respondWithLabel(rw http.ResponseWriter, req *http.Request, label *RenderedLabel) {
+	respondWithLabels(rw, req, []*RenderedLabel{label})
+}
+
+// respondWithLabels is respondWithLabel for requests that draw several
+// labels. Only the first is previewed.
+func respondWithLabels(rw http.ResponseWriter, req *http.Request, labels []*RenderedLabel) {
+	if preview, _ := strconv.ParseBool(req.FormValue("preview")); preview {
+		options, err := parsePrintOptions(req)
+		if err != nil {
+			writeProblem(rw, req, err)
 			return
 		}
+		writePreview(rw, req, labels[0], options)
+		return
+	}
 
-		printJob := &PrintJob{
-			Printer:    labelPrinters[format],
-			FormatName: format.Name,
-			FilePath:   labelImage.File.Name(),
+	submitLabels(rw, req, labels)
+}
+
+// submitLabel checks a rendered label against the printable area, queues it
+// on its format's printer pool, or the printer named in the request's printer
+// value, with the request's print options, and responds with the job's
+// status.
+func submitLabel(rw http.ResponseWriter, req *http.Request, label *RenderedLabel) {
+	submitLabels(rw, req, []*RenderedLabel{label})
+}
+
+// submitLabels queues a job for each label, in order, like submitLabel.
+// Every label is checked before any is queued, so a bad label stops the
+// whole request. More than one label is answered with a list of job
+// statuses.
+func submitLabels(rw http.ResponseWriter, req *http.Request, labels []*RenderedLabel) {
+	strictness, err := parseStrictness(req)
+	if err != nil {
+		writeProblem(rw, req, err)
+		return
+	}
+	options, err := parsePrintOptions(req)
+	if err != nil {
+		writeProblem(rw, req, err)
+		return
+	}
+
+	submitLabelsTo(rw, req, labels, strictness, req.FormValue("printer"), options)
+}
+
+// submitLabelsTo is submitLabels with the strictness, printer and print
+// options already read from the request.
+func submitLabelsTo(rw http.ResponseWriter, req *http.Request, labels []*RenderedLabel, strictness string, printerName string, options PrintOptions) {
+	warnings, err := checkLabels(labels, strictness, printerName, options)
+	if err != nil {
+		writeProblem(rw, req, err)
+		return
+	}
+
+	printJobs, err := queueLabels(hlog.FromRequest(req).With().Logger(), labels, warnings, printerName, options)
+	if err != nil {
+		writeProblem(rw, req, err)
+		return
+	}
+
+	if len(printJobs) == 1 {
+		awaitJob(rw, req, printJobs[0])
+		return
+	}
+	awaitJobs(rw, req, printJobs)
+}
+
+// checkLabels checks each label against the printable area, that the
+// printers it could be sent to can print it with the options and, if a
+// printer is named, that the printer prints the label's format. It returns
+// the printable area warnings of each label.
+func checkLabels(labels []*RenderedLabel, strictness string, printerName string, options PrintOptions) ([][]string, error) {
+	warnings := make([][]string, len(labels))
+	for i, label := range labels {
+		var err error
+		warnings[i], err = label.checkPrintableArea(strictness)
+		if err != nil {
+			return nil, err
+		}
+		pool := labelPrinters[label.Format.Name]
+		if printerName != "" {
+			if _, err := pool.member(printerName, label.Format.Name); err != nil {
+				return nil, err
+			}
 		}
+		if err := pool.checkPrintOptions(options, printerName); err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
 
-		hlog.FromRequest(req).Info().
+// queueLabels saves each checked label and queues it on its format's printer
+// pool, or the named printer, in order.
+func queueLabels(logger zerolog.Logger, labels []*RenderedLabel, warnings [][]string, printerName string, options PrintOptions) ([]*PrintJob, error) {
+	printJobs := make([]*PrintJob, len(labels))
+	for i, label := range labels {
+		printJob := newPrintJob(logger, label.Format.Name)
+		printJob.Options = options
+		printJob.Warnings = warnings[i]
+		printJob.SourceURL = label.SourceURL
+		if err := label.save(printJob.FilePath); err != nil {
+			return nil, err
+		}
+
+		pool := labelPrinters[label.Format.Name]
+		if printerName != "" {
+			if err := pool.SubmitTo(printJob, printerName); err != nil {
+				printJob.finish(JobFailed, err)
+				return nil, err
+			}
+		} else {
+			pool.Submit(printJob)
+		}
+
+		logger.Info().
+			Str("JobID", printJob.ID).
 			Str("PrinterName", printJob.Printer.Name).
 			Str("PrinterPort", printJob.Printer.Port).
 			Str("FormatName", printJob.FormatName).
 			Str("FilePath", printJob.FilePath).
 			Msg("Printing job")
 
-		if err := printJob.print(hlog.FromRequest(req).With().Logger()); err != nil {
-			hlog.FromRequest(req).Error().Err(err).Msg("")
-			http.Error(rw, "something went wrong printing the label", http.StatusInternalServerError)
+		printJobs[i] = printJob
+	}
+	return printJobs, nil
+}
+
+// awaitJob waits for a submitted job to finish, be held or take longer than
+// PrintWaitTimeout, then responds with its status.
+func awaitJob(rw http.ResponseWriter, req *http.Request, printJob *PrintJob) {
+	select {
+	case <-printJob.done:
+	case <-printJob.held:
+	case <-time.After(PrintWaitTimeout):
+	case <-req.Context().Done():
+	}
+
+	writeJobStatus(rw, req, printJob)
+}
+
+// awaitJobs waits like awaitJob for every job, sharing one timeout, then
+// responds with their statuses in order: 200 once all have printed, or 202
+// while any are still queued or held. Failed jobs report their error in
+// their status.
+func awaitJobs(rw http.ResponseWriter, req *http.Request, printJobs []*PrintJob) {
+	waitForJobs(req, printJobs)
+
+	statuses := make([]JobStatus, len(printJobs))
+	allCompleted := true
+	for i, printJob := range printJobs {
+		statuses[i] = printJob.Status()
+		if statuses[i].State != JobCompleted {
+			allCompleted = false
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !allCompleted {
+		rw.WriteHeader(http.StatusAccepted)
+	}
+	writeJSON(rw, req, statuses)
+}
+
+// waitForJobs waits until every job has finished or been held, for at most
+// PrintWaitTimeout in all.
+func waitForJobs(req *http.Request, printJobs []*PrintJob) {
+	timeout := time.After(PrintWaitTimeout)
+
+	for _, printJob := range printJobs {
+		select {
+		case <-printJob.done:
+		case <-printJob.held:
+		case <-timeout:
+			return
+		case <-req.Context().Done():
 			return
 		}
+	}
+}
 
-		err := os.Remove(labelImage.File.Name())
-		if err != nil {
-			hlog.FromRequest(req).Error().Err(err).Msg("could not delete the image after processing")
+// writeJobStatus responds with the job's status: 200 once it has printed,
+// a problem if it failed, or 202 with a Location to poll while it is still
+// queued or held.
+func writeJobStatus(rw http.ResponseWriter, req *http.Request, printJob *PrintJob) {
+	status := printJob.Status()
+
+	switch status.State {
+	case JobFailed, JobExpired:
+		writeProblem(rw, req, printJob.Err())
+		return
+	}
+
+	responseBytes, err := json.Marshal(status)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Msgf("")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if status.State != JobCompleted {
+		rw.Header().Set("Location", "/jobs/"+status.ID)
+		rw.WriteHeader(http.StatusAccepted)
+	}
+
+	if _, err := rw.Write(responseBytes); err != nil {
+		hlog.FromRequest(req).Err(err).Msgf("")
+	}
+}
+
+func job(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		printJob, exists := jobStore.get(req.PathValue("id"))
+		if !exists {
+			hlog.FromRequest(req).Info().Msgf("Job '%s' not found", req.PathValue("id"))
+			rw.WriteHeader(http.StatusNotFound)
+			return
 		}
+
+		writeJobStatus(rw, req, printJob)
 	}
 }
 
@@ -317,21 +697,16 @@ func printer(rw http.ResponseWriter, req *http.Request) {
 
 		var printer Printer
 
-		for _, format := range labelFormats {
-			if format.Name != requestedLabel {
-				continue
-			}
-
-			printer = labelPrinters[format]
-			break
+		if format, _, exists := findLabelFormat(requestedLabel); exists {
+			printer = labelPrinters[format.Name].preferred()
 		}
 
 		hlog.FromRequest(req).Debug().
-			Str("Model", printer.Name).
+			Str("Model", printer.Model).
 			Str("Label", printer.Port).
 			Msgf("Printer")
 
-		response.Model = printer.Name
+		response.Model = printer.Model
 
 		if response.Model == "" {
 			hlog.FromRequest(req).Info().Msgf("Model for label '%s' not found", requestedLabel)
@@ -380,69 +755,131 @@ func ping(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (l *LabelImage) retrieveImageFromForm(rw http.ResponseWriter, req *http.Request) error {
-	hlog.FromRequest(req).Debug().Msgf("Checking size < 10MB")
-	if err := req.ParseMultipartForm(10 << 20); err != nil {
-		err = fmt.Errorf("upload should be fewer than 10MB: %w", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return err
-	}
-
-	hlog.FromRequest(req).Debug().Msgf("Retrieving image from form")
-	file, header, err := req.FormFile("image")
+// retrieveImageFromForm saves the single file sent in the form's image
+// value, for requests that print one file.
+func (l *LabelImage) retrieveImageFromForm(req *http.Request) error {
+	uploads, archived, err := retrieveImagesFromForm(req)
 	if err != nil {
-		err = fmt.Errorf("form file not found at key 'image': %w", err)
-		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return err
 	}
-	defer file.Close()
+	if len(uploads) > 1 || archived {
+		removeUploads(hlog.FromRequest(req).With().Logger(), uploads)
+		return newPrintError(CodeInvalidRequest, nil, "send a single file at key 'image'")
+	}
 
-	filePath := filepath.Join(UploadDirectory, header.Filename)
-	out, err := os.Create(filePath)
+	*l = *uploads[0]
+	return nil
+}
+
+// MaxImagePixels limits the size of an image that is decoded, to four times
+// the dots of the largest label format. Images are checked before they are
+// decoded, as a small PNG or JPEG can claim a size that would take
+// gigabytes of memory.
+const MaxImagePixels = 4 * 1200 * 1822
+
+var errImageTooLarge = fmt.Errorf("image is larger than %d pixels", MaxImagePixels)
+
+// decodeImage decodes a PNG or JPEG if it is no larger than MaxImagePixels.
+func decodeImage(reader io.ReadSeeker) (image.Image, error) {
+	imageConfig, _, err := image.DecodeConfig(reader)
 	if err != nil {
-		err = fmt.Errorf("unable to create file for copying the form image: %w", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return err
+		return nil, err
 	}
-	defer out.Close()
+	if int64(imageConfig.Width)*int64(imageConfig.Height) > MaxImagePixels {
+		return nil, fmt.Errorf("%w, it is %dx%d", errImageTooLarge, imageConfig.Width, imageConfig.Height)
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(reader)
+	return img, err
+}
 
-	hlog.FromRequest(req).Debug().Msgf("copying file: %s", out.Name())
-	_, err = io.Copy(out, file)
+type LabelImage struct {
+	// Name is the file name the image was uploaded with.
+	Name       string
+	File       *os.File
+	Image      image.Image
+	Dimensions LabelDimensions
+}
+
+// eachPage reads the uploaded label, which is either a PNG or JPEG, or a PDF
+// with a label on each page, and calls handle with each page in turn. pages
+// picks which pages of a PDF to print, as described by parsePageRanges. PDF
+// pages are rendered one at a time at the size fit gives, or the printer's
+// resolution if it is nil, so only one is held in memory at once.
+func (l *LabelImage) eachPage(ctx context.Context, pages string, fit pageFit, handle func(image.Image) error) error {
+	file, err := os.Open(l.File.Name())
 	if err != nil {
-		err = fmt.Errorf("unable to copy form content to file: %w", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return err
+		return newPrintError(CodeInternal, err, "could not get image from file")
 	}
+	pdf := isPDF(file)
+	file.Close()
 
-	l.File = out
+	if !pdf {
+		if err := l.decode(); err != nil {
+			return err
+		}
+		return handle(l.Image)
+	}
 
-	return nil
+	return eachPDFPage(ctx, l.File.Name(), pages, fit, func(page image.Image) error {
+		if l.Dimensions == (LabelDimensions{}) {
+			l.Dimensions = LabelDimensions{X: page.Bounds().Dx(), Y: page.Bounds().Dy()}
+		}
+		return handle(page)
+	})
 }
 
-type LabelImage struct {
-	File       *os.File
-	Dimensions LabelDimensions
+// labels draws each page of the upload as a label on the named format, or
+// the format matching its size if none is named. PDF pages are rendered no
+// larger than they are drawn on the format.
+func (l *LabelImage) labels(ctx context.Context, pages string, formatName string, options PipelineOptions) ([]*RenderedLabel, error) {
+	var fit pageFit
+	if _, dimensions, exists := findLabelFormat(formatName); exists {
+		fit = func(size LabelDimensions) LabelDimensions {
+			return options.drawnSize(size, dimensions)
+		}
+	}
+
+	var labels []*RenderedLabel
+	err := l.eachPage(ctx, pages, fit, func(page image.Image) error {
+		label, err := prepareLabel(page, formatName, options)
+		if err != nil {
+			return err
+		}
+		labels = append(labels, label)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return labels, nil
 }
 
-func (l *LabelImage) getPNGDimensions(rw http.ResponseWriter) error {
+// decode reads an uploaded image, which may be a PNG or a JPEG.
+func (l *LabelImage) decode() error {
 	file, err := os.Open(l.File.Name())
 	if err != nil {
-		err = fmt.Errorf("could not get image from file: %w", err)
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return err
+		return newPrintError(CodeInternal, err, "could not get image from file")
 	}
 	defer file.Close()
 
-	img, err := png.Decode(file)
+	img, err := decodeImage(file)
+	if errors.Is(err, errImageTooLarge) {
+		return newPrintError(CodeInvalidImage, err, "images can be at most %d pixels", MaxImagePixels)
+	}
 	if err != nil {
-		err = fmt.Errorf("could not decode file to PNG: %w", err)
-		http.Error(rw, err.Error(), http.StatusBadRequest)
-		return err
+		return newPrintError(CodeInvalidImage, err, "could not decode file as a PNG, JPEG or PDF")
 	}
 
-	bounds := img.Bounds()
-	l.Dimensions.X = bounds.Dx()
-	l.Dimensions.Y = bounds.Dy()
-
+	l.Image = img
+	l.Dimensions = LabelDimensions{X: img.Bounds().Dx(), Y: img.Bounds().Dy()}
 	return nil
 }
+
+func (l *LabelImage) remove(logger zerolog.Logger) {
+	if err := os.Remove(l.File.Name()); err != nil {
+		logger.Error().Err(err).Msg("could not delete the image after processing")
+	}
+}
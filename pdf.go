@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PDFTimeout limits how long poppler may take to read or render a PDF.
+	PDFTimeout = 60 * time.Second
+	// MaxPDFPages limits how many pages of a PDF one request prints.
+	MaxPDFPages = 50
+)
+
+var (
+	pdfPagesPattern    = regexp.MustCompile(`(?m)^Pages:\s+(\d+)`)
+	pdfPageSizePattern = regexp.MustCompile(`(?m)^Page\s+(?:\d+\s+)?size:\s+([\d.]+) x ([\d.]+) pts`)
+	pdfPageRotPattern  = regexp.MustCompile(`(?m)^Page\s+(?:\d+\s+)?rot:\s+(\d+)`)
+)
+
+// pageFit gives the size, in dots, to render a PDF page at from its size at
+// the printer's resolution.
+type pageFit func(size LabelDimensions) LabelDimensions
+
+// isPDF reports whether the file starts with the PDF header.
+func isPDF(file io.ReaderAt) bool {
+	header := make([]byte, 5)
+	n, _ := file.ReadAt(header, 0)
+	return string(header[:n]) == "%PDF-"
+}
+
+// parsePageRanges reads page numbers and ranges such as "1,3-4" into a
+// list of pages, numbered from 1, in the order given. An empty value is
+// every page.
+func parsePageRanges(value string, count int) ([]int, error) {
+	if strings.TrimSpace(value) == "" {
+		value = fmt.Sprintf("1-%d", count)
+	}
+
+	var pages []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+
+		start, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, newPrintError(CodeInvalidRequest, err, "pages must be page numbers or ranges such as 1,3-4, not '%s'", value)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(strings.TrimSpace(last))
+			if err != nil {
+				return nil, newPrintError(CodeInvalidRequest, err, "pages must be page numbers or ranges such as 1,3-4, not '%s'", value)
+			}
+		}
+
+		if start < 1 || end > count || start > end {
+			return nil, newPrintError(CodeInvalidRequest, nil, "pages '%s' are not in the PDF, which has %d pages", part, count)
+		}
+		for page := start; page <= end; page++ {
+			pages = append(pages, page)
+		}
+	}
+
+	if len(pages) > MaxPDFPages {
+		return nil, newPrintError(CodeInvalidRequest, nil, "at most %d pages can be printed at once", MaxPDFPages)
+	}
+	return pages, nil
+}
+
+// firstPage narrows a pages value to the first page it names, or the first
+// page of the PDF if it is empty.
+func firstPage(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	first, _, _ = strings.Cut(first, "-")
+	if first = strings.TrimSpace(first); first == "" {
+		return "1"
+	}
+	return first
+}
+
+// runPoppler runs one of the poppler command line tools, turning failures
+// into problems a client can act on.
+func runPoppler(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, PDFTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err == nil {
+		return output, nil
+	}
+
+	detail := strings.TrimSpace(stderr.String())
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return nil, newPrintError(CodeInternal, err, "PDF support needs poppler-utils installed on the server")
+	case ctx.Err() != nil:
+		return nil, newPrintError(CodeUnsupportedPDF, ctx.Err(), "the PDF took longer than %s to render", PDFTimeout)
+	case strings.Contains(detail, "Incorrect password"):
+		return nil, newPrintError(CodeUnsupportedPDF, err, "the PDF is password protected")
+	case detail == "":
+		detail = err.Error()
+	}
+	return nil, newPrintError(CodeUnsupportedPDF, err, "could not read the PDF: %s", detail)
+}
+
+// pdfPageCount reads the number of pages in a PDF with pdfinfo.
+func pdfPageCount(ctx context.Context, path string) (int, error) {
+	output, err := runPoppler(ctx, "pdfinfo", path)
+	if err != nil {
+		return 0, err
+	}
+
+	match := pdfPagesPattern.FindSubmatch(output)
+	if match == nil {
+		return 0, newPrintError(CodeUnsupportedPDF, nil, "could not find the number of pages in the PDF")
+	}
+	count, _ := strconv.Atoi(string(match[1]))
+	if count == 0 {
+		return 0, newPrintError(CodeUnsupportedPDF, nil, "the PDF has no pages")
+	}
+	return count, nil
+}
+
+// pdfPageSize reads the size of a page of a PDF with pdfinfo, in dots at the
+// printer's resolution, turned as pdftoppm turns it.
+func pdfPageSize(ctx context.Context, path string, page int) (LabelDimensions, error) {
+	output, err := runPoppler(ctx, "pdfinfo", "-f", strconv.Itoa(page), "-l", strconv.Itoa(page), path)
+	if err != nil {
+		return LabelDimensions{}, err
+	}
+
+	match := pdfPageSizePattern.FindSubmatch(output)
+	if match == nil {
+		return LabelDimensions{}, newPrintError(CodeUnsupportedPDF, nil, "could not find the size of page %d of the PDF", page)
+	}
+	width, _ := strconv.ParseFloat(string(match[1]), 64)
+	height, _ := strconv.ParseFloat(string(match[2]), 64)
+	size := LabelDimensions{
+		X: int(math.Ceil(width / 72 * PrinterDPI)),
+		Y: int(math.Ceil(height / 72 * PrinterDPI)),
+	}
+	if rotation := pdfPageRotPattern.FindSubmatch(output); rotation != nil {
+		if degrees, _ := strconv.Atoi(string(rotation[1])); degrees%180 == 90 {
+			size.X, size.Y = size.Y, size.X
+		}
+	}
+	return size, nil
+}
+
+// renderPDFPage renders one page of a PDF with pdftoppm at the printer's
+// resolution, so vector text and barcodes come out as sharp as the printer
+// can print them and embedded images are drawn at their place on the page.
+// If fit is set the page is rendered at the size it gives instead, so a page
+// is never drawn larger than it will be printed.
+func renderPDFPage(ctx context.Context, path string, page int, fit pageFit) (image.Image, error) {
+	size, err := pdfPageSize(ctx, path, page)
+	if err != nil {
+		return nil, err
+	}
+	if fit != nil {
+		size = fit(size)
+	}
+	if size.X <= 0 || size.Y <= 0 || int64(size.X)*int64(size.Y) > MaxImagePixels {
+		return nil, newPrintError(CodeUnsupportedPDF, nil, "page %d of the PDF would be %dx%d dots, it can be at most %d", page, size.X, size.Y, MaxImagePixels)
+	}
+
+	directory, err := os.MkdirTemp(UploadDirectory, "pdf-")
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not create a directory to render the PDF in")
+	}
+	defer os.RemoveAll(directory)
+
+	prefix := filepath.Join(directory, "page")
+	args := []string{"-r", strconv.Itoa(PrinterDPI)}
+	if fit != nil {
+		args = append(args, "-scale-to-x", strconv.Itoa(size.X), "-scale-to-y", strconv.Itoa(size.Y))
+	}
+	args = append(args,
+		"-f", strconv.Itoa(page),
+		"-l", strconv.Itoa(page),
+		"-singlefile",
+		"-png",
+		path, prefix)
+	if _, err := runPoppler(ctx, "pdftoppm", args...); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(prefix + ".png")
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not open the rendered PDF page")
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not decode the rendered PDF page")
+	}
+	return img, nil
+}
+
+// eachPDFPage renders the pages of a PDF selected by the pages value one at a
+// time, calling handle with each before the next is rendered.
+func eachPDFPage(ctx context.Context, path string, pagesValue string, fit pageFit, handle func(image.Image) error) error {
+	count, err := pdfPageCount(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	pages, err := parsePageRanges(pagesValue, count)
+	if err != nil {
+		return err
+	}
+
+	for _, page := range pages {
+		img, err := renderPDFPage(ctx, path, page, fit)
+		if err != nil {
+			return err
+		}
+		if err := handle(img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	RotateAuto = "auto"
+	// DefaultThreshold matches brother_ql's default: pixels darker than
+	// (100 - threshold)% grey print black.
+	DefaultThreshold = 70
+)
+
+// PipelineOptions control how an image is turned into the dots sent to the
+// printer. They are read from the request's form values or query.
+type PipelineOptions struct {
+	Rotate    string
+	Dither    bool
+	Threshold int
+}
+
+func parsePipelineOptions(req *http.Request) (PipelineOptions, error) {
+	options := PipelineOptions{
+		Rotate:    RotateAuto,
+		Threshold: DefaultThreshold,
+	}
+
+	if rotate := req.FormValue("rotate"); rotate != "" {
+		options.Rotate = rotate
+	}
+
+	if dither := req.FormValue("dither"); dither != "" {
+		value, err := strconv.ParseBool(dither)
+		if err != nil {
+			return options, newPrintError(CodeInvalidRequest, err, "dither must be true or false")
+		}
+		options.Dither = value
+	}
+
+	if threshold := req.FormValue("threshold"); threshold != "" {
+		value, err := strconv.Atoi(threshold)
+		if err != nil {
+			return options, newPrintError(CodeInvalidRequest, err, "threshold must be a percentage from 0 to 100")
+		}
+		options.Threshold = value
+	}
+
+	return options, options.validate()
+}
+
+func (o PipelineOptions) validate() error {
+	switch o.Rotate {
+	case RotateAuto, "0", "90", "180", "270":
+	default:
+		return newPrintError(CodeInvalidRequest, nil, "rotate must be auto, 0, 90, 180 or 270, not '%s'", o.Rotate)
+	}
+	if o.Threshold < 0 || o.Threshold > 100 {
+		return newPrintError(CodeInvalidRequest, nil, "threshold must be a percentage from 0 to 100")
+	}
+	return nil
+}
+
+// Rendered labels are paletted images using these two colours only.
+const (
+	dotWhite uint8 = iota
+	dotBlack
+)
+
+var labelPalette = color.Palette{
+	color.RGBA{R: 255, G: 255, B: 255, A: 255},
+	color.RGBA{A: 255},
+}
+
+// RenderedLabel is an image converted to exactly the dots the printer will
+// print on one label.
+type RenderedLabel struct {
+	Format     LabelFormat
+	Dimensions LabelDimensions
+	Image      *image.Paletted
+	// SourceURL is where the image was fetched from, if it was.
+	SourceURL string
+}
+
+// resolveLabelFormat picks the named label format, or if none is named the
+// one whose printable size matches the image.
+func resolveLabelFormat(formatName string, img image.Image) (LabelFormat, LabelDimensions, error) {
+	if formatName != "" {
+		format, dimensions, exists := findLabelFormat(formatName)
+		if !exists {
+			return format, dimensions, newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", formatName)
+		}
+		return format, dimensions, nil
+	}
+
+	dimensions := LabelDimensions{X: img.Bounds().Dx(), Y: img.Bounds().Dy()}
+	format, exists := labelFormats[dimensions]
+	if !exists {
+		return format, dimensions, newPrintError(CodeInvalidImage, nil, "dimensions %v is not valid, must match map %v or name a format", dimensions, labelFormats)
+	}
+	return format, dimensions, nil
+}
+
+// prepareLabel runs an uploaded image through the same pipeline for both
+// printing and previewing.
+func prepareLabel(img image.Image, formatName string, options PipelineOptions) (*RenderedLabel, error) {
+	format, dimensions, err := resolveLabelFormat(formatName, img)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderLabel(img, format, dimensions, options)
+}
+
+// renderLabel flattens, rotates and scales an image to fit the label's
+// printable area, then reduces it to black and white dots.
+func renderLabel(src image.Image, format LabelFormat, dimensions LabelDimensions, options PipelineOptions) (*RenderedLabel, error) {
+	img := flattenImage(src)
+
+	switch rotation := options.Rotate; {
+	case rotation == RotateAuto:
+		landscapeImage := img.Bounds().Dx() > img.Bounds().Dy()
+		landscapeLabel := dimensions.X > dimensions.Y
+		if landscapeImage != landscapeLabel {
+			img = rotateImage(img, 90)
+		}
+	case rotation != "" && rotation != "0":
+		degrees, _ := strconv.Atoi(rotation)
+		img = rotateImage(img, degrees)
+	}
+
+	if img.Bounds().Dx() != dimensions.X || img.Bounds().Dy() != dimensions.Y {
+		img = fitImage(img, dimensions)
+	}
+
+	return &RenderedLabel{
+		Format:     format,
+		Dimensions: dimensions,
+		Image:      quantizeImage(img, options),
+	}, nil
+}
+
+// drawnSize is the size renderLabel draws an image of the given size at on a
+// label, once it is turned as the options say.
+func (o PipelineOptions) drawnSize(size, dimensions LabelDimensions) LabelDimensions {
+	turned := false
+	switch o.Rotate {
+	case RotateAuto:
+		turned = (size.X > size.Y) != (dimensions.X > dimensions.Y)
+	case "90", "270":
+		turned = true
+	}
+	if turned {
+		dimensions.X, dimensions.Y = dimensions.Y, dimensions.X
+	}
+
+	scale := math.Min(float64(dimensions.X)/float64(size.X), float64(dimensions.Y)/float64(size.Y))
+	return LabelDimensions{
+		X: max(1, int(math.Round(float64(size.X)*scale))),
+		Y: max(1, int(math.Round(float64(size.Y)*scale))),
+	}
+}
+
+// flattenImage draws the image over white so transparent areas print as
+// blank label.
+func flattenImage(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, img.Bounds(), src, bounds.Min, draw.Over)
+	return img
+}
+
+// rotateImage turns the image clockwise by a multiple of 90 degrees.
+func rotateImage(src *image.RGBA, degrees int) *image.RGBA {
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+
+	var dst *image.RGBA
+	if degrees == 180 {
+		dst = image.NewRGBA(image.Rect(0, 0, width, height))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := src.RGBAAt(x, y)
+			switch degrees {
+			case 90:
+				dst.SetRGBA(height-1-y, x, c)
+			case 180:
+				dst.SetRGBA(width-1-x, height-1-y, c)
+			case 270:
+				dst.SetRGBA(y, width-1-x, c)
+			}
+		}
+	}
+	return dst
+}
+
+// fitImage scales the image to fit inside the dimensions, keeping its
+// aspect ratio, and centres it on a white label.
+func fitImage(src *image.RGBA, dimensions LabelDimensions) *image.RGBA {
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	scale := math.Min(float64(dimensions.X)/float64(srcWidth), float64(dimensions.Y)/float64(srcHeight))
+
+	width := max(1, int(math.Round(float64(srcWidth)*scale)))
+	height := max(1, int(math.Round(float64(srcHeight)*scale)))
+	offsetX := (dimensions.X - width) / 2
+	offsetY := (dimensions.Y - height) / 2
+
+	dst := image.NewRGBA(image.Rect(0, 0, dimensions.X, dimensions.Y))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for y := 0; y < height; y++ {
+		sy := (float64(y)+0.5)/scale - 0.5
+		for x := 0; x < width; x++ {
+			sx := (float64(x)+0.5)/scale - 0.5
+			dst.SetRGBA(offsetX+x, offsetY+y, bilinear(src, sx, sy))
+		}
+	}
+	return dst
+}
+
+func bilinear(src *image.RGBA, x, y float64) color.RGBA {
+	maxX, maxY := src.Bounds().Dx()-1, src.Bounds().Dy()-1
+	x = math.Max(0, math.Min(x, float64(maxX)))
+	y = math.Max(0, math.Min(y, float64(maxY)))
+
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, maxX), min(y0+1, maxY)
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	c00, c10 := src.RGBAAt(x0, y0), src.RGBAAt(x1, y0)
+	c01, c11 := src.RGBAAt(x0, y1), src.RGBAAt(x1, y1)
+
+	mix := func(a, b, c, d uint8) uint8 {
+		top := float64(a)*(1-fx) + float64(b)*fx
+		bottom := float64(c)*(1-fx) + float64(d)*fx
+		return uint8(math.Round(top*(1-fy) + bottom*fy))
+	}
+
+	return color.RGBA{
+		R: mix(c00.R, c10.R, c01.R, c11.R),
+		G: mix(c00.G, c10.G, c01.G, c11.G),
+		B: mix(c00.B, c10.B, c01.B, c11.B),
+		A: 255,
+	}
+}
+
+// quantizeImage reduces the image to label dots, either by thresholding
+// like brother_ql or by Floyd-Steinberg dithering.
+func quantizeImage(src *image.RGBA, options PipelineOptions) *image.Paletted {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dst := image.NewPaletted(bounds, labelPalette)
+
+	luminance := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := src.RGBAAt(x, y)
+			luminance[y*width+x] = 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+		}
+	}
+
+	cutoff := float64(100-options.Threshold) / 100 * 255
+	if options.Dither {
+		cutoff = 128
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			old := luminance[y*width+x]
+			value := 255.0
+			if old < cutoff {
+				value = 0
+				dst.SetColorIndex(x, y, dotBlack)
+			}
+
+			if !options.Dither {
+				continue
+			}
+
+			spread := func(dx, dy int, weight float64) {
+				nx, ny := x+dx, y+dy
+				if nx < 0 || nx >= width || ny >= height {
+					return
+				}
+				luminance[ny*width+nx] += (old - value) * weight
+			}
+			spread(1, 0, 7.0/16)
+			spread(-1, 1, 3.0/16)
+			spread(0, 1, 5.0/16)
+			spread(1, 1, 1.0/16)
+		}
+	}
+
+	return dst
+}
+
+// save writes the label as a PNG. The print queue encodes it as raster data
+// for the printer's model when the job is printed, and brother_ql only sends
+// that data to the printer.
+func (l *RenderedLabel) save(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return newPrintError(CodeInternal, err, "unable to create file for the rendered label")
+	}
+	defer out.Close()
+
+	if err := png.Encode(out, l.Image); err != nil {
+		return newPrintError(CodeInternal, err, "unable to write the rendered label")
+	}
+	return nil
+}
+
+// loadRenderedLabel reads back a label of the named format saved with save.
+func loadRenderedLabel(path string, formatName string) (*RenderedLabel, error) {
+	format, _, exists := findLabelFormat(formatName)
+	if !exists {
+		return nil, newPrintError(CodeInternal, nil, "label format '%s' does not exist", formatName)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "unable to open the rendered label")
+	}
+	defer in.Close()
+
+	img, err := png.Decode(in)
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "unable to read the rendered label")
+	}
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		return nil, newPrintError(CodeInternal, nil, "the rendered label is not a paletted image")
+	}
+
+	return &RenderedLabel{
+		Format:     format,
+		Dimensions: LabelDimensions{X: paletted.Bounds().Dx(), Y: paletted.Bounds().Dy()},
+		Image:      paletted,
+	}, nil
+}
+
+// parseRightAngle reads the request's rotate value for labels drawn by the
+// server, which are turned by a whole number of quarter turns.
+func parseRightAngle(req *http.Request) (int, error) {
+	switch rotate := req.FormValue("rotate"); rotate {
+	case "", "0":
+		return 0, nil
+	case "90", "180", "270":
+		return strconv.Atoi(rotate)
+	default:
+		return 0, newPrintError(CodeInvalidRequest, nil, "rotate must be 0, 90, 180 or 270, not '%s'", rotate)
+	}
+}
+
+// renderPrintableArea renders a label whose content is drawn by the server.
+// The draw function is given the size of the printable area, swapped if the
+// content is turned a quarter, and the image it returns is turned clockwise
+// by rotate degrees and placed in the printable area.
+func renderPrintableArea(format LabelFormat, dimensions LabelDimensions, rotate int, drawContent func(width, height int) (*image.RGBA, error)) (*RenderedLabel, error) {
+	margins := format.Margins
+	printable := image.Rect(margins.Left, margins.Top, dimensions.X-margins.Right, dimensions.Y-margins.Bottom)
+
+	width, height := printable.Dx(), printable.Dy()
+	if rotate == 90 || rotate == 270 {
+		width, height = height, width
+	}
+
+	content, err := drawContent(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if rotate != 0 {
+		content = rotateImage(content, rotate)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, dimensions.X, dimensions.Y))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, printable, content, image.Point{}, draw.Src)
+
+	return renderLabel(img, format, dimensions, PipelineOptions{
+		Rotate:    "0",
+		Threshold: DefaultThreshold,
+	})
+}
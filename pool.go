@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+const (
+	// RoutingRoundRobin takes turns between the healthy printers.
+	RoutingRoundRobin = "round-robin"
+	// RoutingLeastQueued picks the healthy printer with the fewest jobs.
+	RoutingLeastQueued = "least-queued"
+	// RoutingFailover uses the first printer unless it is unhealthy, then
+	// the next one in order.
+	RoutingFailover = "failover"
+)
+
+var routingStrategies = map[string]bool{
+	RoutingRoundRobin:  true,
+	RoutingLeastQueued: true,
+	RoutingFailover:    true,
+}
+
+// PrinterPool is the set of printers that can print one label format and
+// how jobs are spread between them.
+type PrinterPool struct {
+	Routing  string
+	Printers []Printer
+
+	mu   sync.Mutex
+	next int
+}
+
+// choose picks a printer for a new job. Printers whose queue is paused are
+// skipped, as is the printer named by exclude. If no printer is healthy the
+// routing strategy still picks one so the job is held there until it
+// recovers.
+func (p *PrinterPool) choose(exclude string) (Printer, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var candidates []Printer
+	for _, printer := range p.Printers {
+		if printer.Name != exclude {
+			candidates = append(candidates, printer)
+		}
+	}
+	if len(candidates) == 0 {
+		return Printer{}, false
+	}
+
+	var healthy []Printer
+	for _, printer := range candidates {
+		if printQueue(printer.Name).Healthy() {
+			healthy = append(healthy, printer)
+		}
+	}
+	if len(healthy) == 0 {
+		if exclude != "" {
+			return Printer{}, false
+		}
+		healthy = candidates
+	}
+
+	switch p.Routing {
+	case RoutingRoundRobin:
+		printer := healthy[p.next%len(healthy)]
+		p.next++
+		return printer, true
+	case RoutingLeastQueued:
+		chosen := healthy[0]
+		for _, printer := range healthy[1:] {
+			if printQueue(printer.Name).Depth() < printQueue(chosen.Name).Depth() {
+				chosen = printer
+			}
+		}
+		return chosen, true
+	default:
+		return healthy[0], true
+	}
+}
+
+// preferred is the printer a new job would most likely go to, without
+// advancing the round-robin position.
+func (p *PrinterPool) preferred() Printer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, printer := range p.Printers {
+		if printQueue(printer.Name).Healthy() {
+			return printer
+		}
+	}
+	return p.Printers[0]
+}
+
+func (p *PrinterPool) Submit(job *PrintJob) {
+	printer, _ := p.choose("")
+	job.assign(p, printer)
+	printQueue(printer.Name).Submit(job)
+}
+
+func (p *PrinterPool) find(name string) (Printer, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, printer := range p.Printers {
+		if printer.Name == name {
+			return printer, true
+		}
+	}
+	return Printer{}, false
+}
+
+func (p *PrinterPool) names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.Printers))
+	for _, printer := range p.Printers {
+		names = append(names, printer.Name)
+	}
+	return names
+}
+
+func (p *PrinterPool) models() map[string]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	models := map[string]bool{}
+	for _, printer := range p.Printers {
+		models[printer.Model] = true
+	}
+	return models
+}
+
+func (p *PrinterPool) add(printer Printer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Printers = append(p.Printers, printer)
+}
+
+// remove takes a printer out of the pool, keeping at least one printer so
+// the format can still be routed.
+func (p *PrinterPool) remove(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.Printers) == 1 {
+		return
+	}
+	p.Printers = slices.DeleteFunc(p.Printers, func(printer Printer) bool {
+		return printer.Name == name
+	})
+}
+
+// SubmitTo sends a job to the named printer in the pool. Jobs sent to a
+// specific printer are not failed over to other printers.
+func (p *PrinterPool) SubmitTo(job *PrintJob, name string) error {
+	printer, err := p.member(name, job.FormatName)
+	if err != nil {
+		return err
+	}
+
+	job.assign(nil, printer)
+	printQueue(printer.Name).Submit(job)
+	return nil
+}
+
+// member returns the named printer if it is in the pool for formatName.
+func (p *PrinterPool) member(name, formatName string) (Printer, error) {
+	if printQueue(name) == nil {
+		return Printer{}, newPrintError(CodeUnknownPrinter, nil, "no printer is named '%s'", name)
+	}
+
+	if printer, found := p.find(name); found {
+		return printer, nil
+	}
+
+	return Printer{}, newPrintError(CodeInvalidRequest, nil, "printer '%s' cannot print label format '%s'", name, formatName)
+}
+
+// failover moves a job from an unhealthy printer to a healthy one in the
+// same pool, queued again rather than held with the old printer's reason.
+// It returns false if there is nowhere better to send it.
+func (p *PrinterPool) failover(job *PrintJob, from string) bool {
+	printer, found := p.choose(from)
+	if !found {
+		return false
+	}
+
+	job.logger.Info().
+		Str("from", from).
+		Str("to", printer.Name).
+		Msg("Failing job over to another printer")
+
+	job.assign(p, printer)
+	job.setState(JobQueued)
+	printQueue(printer.Name).Submit(job)
+	return true
+}
+
+// PrinterConfig describes one printer. A printer bound to a serial number
+// only matches that physical device, so several printers of the same model
+// can be told apart; the port is then derived from the model if not given.
+type PrinterConfig struct {
+	Name   string `json:"name"`
+	Model  string `json:"model"`
+	Port   string `json:"port"`
+	Serial string `json:"serial"`
+}
+
+func (c PrinterConfig) printer() (Printer, error) {
+	if c.Name == "" || c.Model == "" {
+		return Printer{}, fmt.Errorf("printers need a name and model")
+	}
+
+	port := c.Port
+	if port == "" {
+		modelPort, err := modelPort(c.Model, c.Serial)
+		if err != nil {
+			return Printer{}, fmt.Errorf("printer '%s' has no port: %w", c.Name, err)
+		}
+		port = modelPort
+	}
+
+	vendor, product, serial, err := parseUSBPort(port)
+	if err != nil {
+		return Printer{}, fmt.Errorf("printer '%s': %w", c.Name, err)
+	}
+	if serial != "" && c.Serial != "" && serial != c.Serial {
+		return Printer{}, fmt.Errorf("printer '%s' has serial '%s' but its port has '%s'", c.Name, c.Serial, serial)
+	}
+	if serial == "" {
+		serial = c.Serial
+		port = usbPort(vendor, product, serial)
+	}
+
+	return Printer{
+		Name:   c.Name,
+		Model:  c.Model,
+		Port:   port,
+		Serial: serial,
+	}, nil
+}
+
+type PrinterPoolConfig struct {
+	Routing  string          `json:"routing"`
+	Printers []PrinterConfig `json:"printers"`
+}
+
+// applyPrinterPoolConfig replaces the built-in pool of each label format
+// named in the config.
+func applyPrinterPoolConfig() error {
+	for formatName, poolConfig := range config.PrinterPools {
+		if _, exists := labelPrinters[formatName]; !exists {
+			return fmt.Errorf("printer pool for unknown label format '%s'", formatName)
+		}
+
+		routing := poolConfig.Routing
+		if routing == "" {
+			routing = RoutingFailover
+		}
+		if !routingStrategies[routing] {
+			return fmt.Errorf("label format '%s' has unknown routing '%s'", formatName, routing)
+		}
+
+		if len(poolConfig.Printers) == 0 {
+			return fmt.Errorf("label format '%s' has no printers", formatName)
+		}
+
+		pool := &PrinterPool{Routing: routing}
+		for _, printerConfig := range poolConfig.Printers {
+			printer, err := printerConfig.printer()
+			if err != nil {
+				return fmt.Errorf("label format '%s': %w", formatName, err)
+			}
+			pool.Printers = append(pool.Printers, printer)
+		}
+
+		labelPrinters[formatName] = pool
+	}
+
+	printers := map[string]Printer{}
+	for _, pool := range labelPrinters {
+		for _, printer := range pool.Printers {
+			if existing, exists := printers[printer.Name]; exists && existing != printer {
+				return fmt.Errorf("printer '%s' is configured more than once with different settings", printer.Name)
+			}
+			printers[printer.Name] = printer
+		}
+	}
+
+	return nil
+}
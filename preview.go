@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+const PreviewPadding = 24
+
+var (
+	previewBackground = color.RGBA{R: 0xdd, G: 0xdd, B: 0xdd, A: 0xff}
+	previewMargin     = color.RGBA{R: 0xf4, G: 0xf4, B: 0xf4, A: 0xff}
+	previewHatch      = color.RGBA{R: 0xe0, G: 0xe0, B: 0xe0, A: 0xff}
+	previewOutline    = color.RGBA{R: 0x55, G: 0x55, B: 0x55, A: 0xff}
+	previewPrintable  = color.RGBA{R: 0x00, G: 0x78, B: 0xd7, A: 0xff}
+	previewClipped    = color.RGBA{R: 0xff, G: 0x8c, B: 0x00, A: 0xff}
+)
+
+// placement is where the rendered label sits on the whole label, in dots
+// from the label's top left corner.
+func (l *RenderedLabel) placement() (image.Rectangle, LabelDimensions) {
+	total := l.Format.Total
+	if total.X < l.Dimensions.X || total.Y < l.Dimensions.Y {
+		total = l.Dimensions
+	}
+
+	offset := image.Pt((total.X-l.Dimensions.X)/2, (total.Y-l.Dimensions.Y)/2)
+	return image.Rect(0, 0, l.Dimensions.X, l.Dimensions.Y).Add(offset), total
+}
+
+// preview draws the rendered dots on an outline of the whole label, with
+// the margins the printer cannot reach hatched, the printable area outlined
+// and any dots outside it that may be clipped highlighted.
+func (l *RenderedLabel) preview() *image.RGBA {
+	placement, total := l.placement()
+
+	canvas := image.NewRGBA(image.Rect(0, 0, total.X+2*PreviewPadding, total.Y+2*PreviewPadding))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{previewBackground}, image.Point{}, draw.Src)
+
+	labelArea := image.Rect(0, 0, total.X, total.Y).Add(image.Pt(PreviewPadding, PreviewPadding))
+	placement = placement.Add(labelArea.Min)
+	printable := l.printableArea().Add(placement.Min)
+
+	for y := labelArea.Min.Y; y < labelArea.Max.Y; y++ {
+		for x := labelArea.Min.X; x < labelArea.Max.X; x++ {
+			if (x+y)%12 < 2 {
+				canvas.SetRGBA(x, y, previewHatch)
+			} else {
+				canvas.SetRGBA(x, y, previewMargin)
+			}
+		}
+	}
+
+	draw.Draw(canvas, placement, l.Image, image.Point{}, draw.Src)
+
+	for y := 0; y < l.Dimensions.Y; y++ {
+		for x := 0; x < l.Dimensions.X; x++ {
+			point := image.Pt(x, y).Add(placement.Min)
+			if !point.In(printable) && l.Image.ColorIndexAt(x, y) != dotWhite {
+				canvas.SetRGBA(point.X, point.Y, previewClipped)
+			}
+		}
+	}
+
+	drawOutline(canvas, labelArea.Inset(-2), 2, previewOutline)
+	drawOutline(canvas, printable.Inset(-1), 1, previewPrintable)
+
+	return canvas
+}
+
+func drawOutline(img *image.RGBA, r image.Rectangle, width int, c color.RGBA) {
+	fill := &image.Uniform{c}
+	draw.Draw(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+width), fill, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(r.Min.X, r.Max.Y-width, r.Max.X, r.Max.Y), fill, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(r.Min.X, r.Min.Y, r.Min.X+width, r.Max.Y), fill, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(r.Max.X-width, r.Min.Y, r.Max.X, r.Max.Y), fill, image.Point{}, draw.Src)
+}
+
+type PreviewResponse struct {
+	Format       string   `json:"format"`
+	Width        int      `json:"width"`
+	Height       int      `json:"height"`
+	PrinterModel string   `json:"printer_model"`
+	Preview      string   `json:"preview_png"`
+	Raster       string   `json:"raster,omitempty"`
+	Warnings     []string `json:"warnings,omitempty"`
+}
+
+// writePreview responds with the label preview as a PNG, or with the raster
+// bytes or both as JSON if the request's output value asks for them. The
+// raster is what the pool's preferred printer would be sent with the print
+// options.
+func writePreview(rw http.ResponseWriter, req *http.Request, label *RenderedLabel, options PrintOptions) {
+	pool := labelPrinters[label.Format.Name]
+	model, _ := findPrinterModel(pool.preferred().Model)
+	rasterOptions, err := options.forModel(model)
+	if err != nil {
+		writeProblem(rw, req, err)
+		return
+	}
+
+	output := req.FormValue("output")
+	switch output {
+	case "", "png", "raster", "json":
+	default:
+		writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "output must be png, raster or json, not '%s'", output))
+		return
+	}
+
+	if output == "raster" {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := rw.Write(encodeRaster(label, model, rasterOptions)); err != nil {
+			hlog.FromRequest(req).Err(err).Msgf("")
+		}
+		return
+	}
+
+	var previewPNG bytes.Buffer
+	if err := png.Encode(&previewPNG, label.preview()); err != nil {
+		writeProblem(rw, req, newPrintError(CodeInternal, err, "could not encode the preview"))
+		return
+	}
+
+	if output == "json" {
+		warnings, _ := label.checkPrintableArea(StrictnessWarn)
+		writeJSON(rw, req, PreviewResponse{
+			Format:       label.Format.Name,
+			Width:        label.Dimensions.X,
+			Height:       label.Dimensions.Y,
+			PrinterModel: model.Name,
+			Preview:      base64.StdEncoding.EncodeToString(previewPNG.Bytes()),
+			Raster:       base64.StdEncoding.EncodeToString(encodeRaster(label, model, rasterOptions)),
+			Warnings:     warnings,
+		})
+		return
+	}
+
+	rw.Header().Set("Content-Type", "image/png")
+	if _, err := rw.Write(previewPNG.Bytes()); err != nil {
+		hlog.FromRequest(req).Err(err).Msgf("")
+	}
+}
+
+func preview(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		printRequest, err := readPrintRequest(req)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		defer removeUploads(hlog.FromRequest(req).With().Logger(), printRequest.Uploads)
+
+		// Only the first page of the first file is previewed, so only that
+		// page is rendered.
+		printRequest.Pages = firstPage(printRequest.Pages)
+		labels, err := printRequest.labels(req.Context(), printRequest.Uploads[0])
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		writePreview(rw, req, labels[0], printRequest.PrintOptions)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+)
+
+const (
+	// StrictnessOff prints labels without checking the printable area.
+	StrictnessOff = "off"
+	// StrictnessWarn prints labels but reports content outside the
+	// printable area in the job's warnings.
+	StrictnessWarn = "warn"
+	// StrictnessReject refuses to print labels with content outside the
+	// printable area.
+	StrictnessReject = "reject"
+)
+
+var strictnessLevels = map[string]bool{
+	StrictnessOff:    true,
+	StrictnessWarn:   true,
+	StrictnessReject: true,
+}
+
+// LabelMargins are distances in dots from the edges of a label's image.
+type LabelMargins struct {
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+	Left   int `json:"left"`
+}
+
+// applyFormatMargins sets the margins of each label format named in the
+// config.
+func applyFormatMargins() error {
+	for formatName, margins := range config.FormatMargins {
+		format, dimensions, exists := findLabelFormat(formatName)
+		if !exists {
+			return fmt.Errorf("margins for unknown label format '%s'", formatName)
+		}
+		if margins.Top < 0 || margins.Right < 0 || margins.Bottom < 0 || margins.Left < 0 ||
+			margins.Left+margins.Right >= dimensions.X || margins.Top+margins.Bottom >= dimensions.Y {
+			return fmt.Errorf("label format '%s' margins must not be negative or cover the whole %dx%d label", formatName, dimensions.X, dimensions.Y)
+		}
+		format.Margins = margins
+		labelFormats[dimensions] = format
+	}
+	return nil
+}
+
+// printableArea is the part of the rendered image that reliably reaches the
+// label. Die-cut labels do not sit in exactly the same place every time, so
+// content in the format's margins can be clipped.
+func (l *RenderedLabel) printableArea() image.Rectangle {
+	margins := l.Format.Margins
+	return image.Rect(margins.Left, margins.Top, l.Dimensions.X-margins.Right, l.Dimensions.Y-margins.Bottom)
+}
+
+// outsidePrintableArea returns the bounds of the dots that fall outside the
+// printable area and how many there are.
+func (l *RenderedLabel) outsidePrintableArea() (image.Rectangle, int) {
+	printable := l.printableArea()
+
+	var bounds image.Rectangle
+	count := 0
+	for y := 0; y < l.Dimensions.Y; y++ {
+		for x := 0; x < l.Dimensions.X; x++ {
+			if image.Pt(x, y).In(printable) || l.Image.ColorIndexAt(x, y) == dotWhite {
+				continue
+			}
+
+			dot := image.Rect(x, y, x+1, y+1)
+			if count == 0 {
+				bounds = dot
+			} else {
+				bounds = bounds.Union(dot)
+			}
+			count++
+		}
+	}
+
+	return bounds, count
+}
+
+// checkPrintableArea applies the strictness level to a rendered label. It
+// returns warnings to report with the job, or an error if the label must
+// not be printed.
+func (l *RenderedLabel) checkPrintableArea(strictness string) ([]string, error) {
+	if strictness == StrictnessOff {
+		return nil, nil
+	}
+
+	bounds, count := l.outsidePrintableArea()
+	if count == 0 {
+		return nil, nil
+	}
+
+	message := fmt.Sprintf("%d dots between %v and %v are outside the printable area %v of label format '%s' and may be clipped",
+		count, bounds.Min, bounds.Max, l.printableArea(), l.Format.Name)
+
+	if strictness == StrictnessReject {
+		return nil, newPrintError(CodeOutsidePrintableArea, nil, "%s", message)
+	}
+	return []string{message}, nil
+}
+
+// parseStrictness reads the request's strictness value, falling back to the
+// configured default.
+func parseStrictness(req *http.Request) (string, error) {
+	strictness := req.FormValue("strictness")
+	if strictness == "" {
+		return config.PrintableAreaStrictness, nil
+	}
+	if !strictnessLevels[strictness] {
+		return "", newPrintError(CodeInvalidRequest, nil, "strictness must be off, warn or reject, not '%s'", strictness)
+	}
+	return strictness, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	// PriorityQuality prints at the printer's best quality.
+	PriorityQuality = "quality"
+	// PrioritySpeed prints faster at lower quality.
+	PrioritySpeed = "speed"
+
+	// MaxCutEvery is the most labels the printer can be told to print
+	// between cuts.
+	MaxCutEvery = 255
+)
+
+// PrintOptions control how the printer prints a job's label, as opposed to
+// how the label is drawn. Options left unset use the printer model's
+// defaults: one copy, cutting after every label and at the end if the model
+// has a cutter, best quality and compression if the model supports it.
+type PrintOptions struct {
+	Copies int `json:"copies,omitempty"`
+	// AutoCut cuts the labels apart as they are printed.
+	AutoCut *bool `json:"auto_cut,omitempty"`
+	// CutEvery is how many labels are printed between cuts.
+	CutEvery int `json:"cut_every,omitempty"`
+	// CutAtEnd cuts after the last label of the job.
+	CutAtEnd *bool  `json:"cut_at_end,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	// Compress sends the raster data compressed, which can be switched off
+	// to make it easier to read when debugging.
+	Compress *bool `json:"compress,omitempty"`
+}
+
+// rasterOptions are print options with every value resolved for one printer
+// model.
+type rasterOptions struct {
+	Copies   int
+	AutoCut  bool
+	CutEvery int
+	CutAtEnd bool
+	Quality  bool
+	Compress bool
+}
+
+// parsePrintOptions reads print options from the request's form values.
+func parsePrintOptions(req *http.Request) (PrintOptions, error) {
+	var options PrintOptions
+	var err error
+
+	if options.Copies, err = formInt(req, "copies"); err != nil {
+		return options, err
+	}
+	if options.CutEvery, err = formInt(req, "cut_every"); err != nil {
+		return options, err
+	}
+	if options.AutoCut, err = formBool(req, "auto_cut"); err != nil {
+		return options, err
+	}
+	if options.CutAtEnd, err = formBool(req, "cut_at_end"); err != nil {
+		return options, err
+	}
+	if options.Compress, err = formBool(req, "compress"); err != nil {
+		return options, err
+	}
+
+	options.Priority = req.FormValue("priority")
+	return options, options.validate()
+}
+
+// formInt reads a whole number form value, which is 0 if it is not set.
+func formInt(req *http.Request, name string) (int, error) {
+	value := req.FormValue(name)
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, newPrintError(CodeInvalidRequest, err, "%s must be a number", name)
+	}
+	return number, nil
+}
+
+// formBool reads a true or false form value, which is nil if it is not set.
+func formBool(req *http.Request, name string) (*bool, error) {
+	value := req.FormValue(name)
+	if value == "" {
+		return nil, nil
+	}
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, newPrintError(CodeInvalidRequest, err, "%s must be true or false", name)
+	}
+	return &flag, nil
+}
+
+// validate checks the options make sense whatever printer prints them.
+func (o PrintOptions) validate() error {
+	if o.Copies < 0 || o.Copies > MaxCopies {
+		return newPrintError(CodeInvalidRequest, nil, "copies must be a number from 1 to %d", MaxCopies)
+	}
+	if o.CutEvery < 0 || o.CutEvery > MaxCutEvery {
+		return newPrintError(CodeInvalidRequest, nil, "cut_every must be a number from 1 to %d", MaxCutEvery)
+	}
+	if o.CutEvery > 1 && o.AutoCut != nil && !*o.AutoCut {
+		return newPrintError(CodeInvalidRequest, nil, "cut_every needs auto_cut")
+	}
+	switch o.Priority {
+	case "", PriorityQuality, PrioritySpeed:
+	default:
+		return newPrintError(CodeInvalidRequest, nil, "priority must be quality or speed, not '%s'", o.Priority)
+	}
+	return nil
+}
+
+// forModel resolves the options for a printer model, refusing those the
+// model cannot do.
+func (o PrintOptions) forModel(model PrinterModel) (rasterOptions, error) {
+	resolved := rasterOptions{
+		Copies:   max(o.Copies, 1),
+		AutoCut:  model.Cutting,
+		CutEvery: max(o.CutEvery, 1),
+		CutAtEnd: model.Cutting && model.ExpandedMode,
+		Quality:  o.Priority != PrioritySpeed,
+		Compress: model.Compression,
+	}
+
+	if o.AutoCut != nil {
+		if *o.AutoCut && !model.Cutting {
+			return resolved, newPrintError(CodeUnsupportedOption, nil, "the %s has no cutter", model.Name)
+		}
+		resolved.AutoCut = *o.AutoCut
+	}
+	if resolved.CutEvery > 1 && !model.Cutting {
+		return resolved, newPrintError(CodeUnsupportedOption, nil, "the %s has no cutter", model.Name)
+	}
+	if o.CutAtEnd != nil {
+		if *o.CutAtEnd && !(model.Cutting && model.ExpandedMode) {
+			return resolved, newPrintError(CodeUnsupportedOption, nil, "the %s cannot cut at the end of a job", model.Name)
+		}
+		resolved.CutAtEnd = *o.CutAtEnd
+	}
+	if o.Compress != nil {
+		if *o.Compress && !model.Compression {
+			return resolved, newPrintError(CodeUnsupportedOption, nil, "the %s does not take compressed raster data", model.Name)
+		}
+		resolved.Compress = *o.Compress
+	}
+	return resolved, nil
+}
+
+// checkPrintOptions checks every printer a job could be sent to can print
+// with the options: the named printer, or otherwise every printer in the
+// pool, as jobs can fail over between them.
+func (p *PrinterPool) checkPrintOptions(options PrintOptions, printerName string) error {
+	models := p.models()
+	if printerName != "" {
+		printer, found := p.find(printerName)
+		if !found {
+			return nil
+		}
+		models = map[string]bool{printer.Model: true}
+	}
+
+	for name := range models {
+		model, exists := findPrinterModel(name)
+		if !exists {
+			continue
+		}
+		if _, err := options.forModel(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxImageSize limits the size of a label sent as a raw or base64 body,
+	// or fetched from an image_url.
+	MaxImageSize = 10 << 20
+	// MaxCopies limits how many copies of each label one request prints.
+	MaxCopies = 100
+)
+
+// bodyImageTypes are the content types a label can be sent as the whole
+// request body in.
+var bodyImageTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"application/pdf": true,
+}
+
+// PrintRequest is a request to /print however it was sent: a multipart
+// form, a JSON body or an image as the raw body. Each is read into one of
+// these so printing does not depend on which was used.
+type PrintRequest struct {
+	// Uploads are the files to print, in order.
+	Uploads []*LabelImage
+	// Archived is set if any of the uploads were unpacked from a ZIP archive.
+	Archived bool
+	// SourceURL is the image_url the upload was fetched from, if it was.
+	SourceURL string
+
+	Format       string
+	Pages        string
+	Partial      bool
+	Printer      string
+	Strictness   string
+	Options      PipelineOptions
+	PrintOptions PrintOptions
+}
+
+// PrintRequestBody is the JSON form of a print request. The label is either
+// base64 encoded in Image, optionally as a data URL, or fetched from
+// ImageURL. Values left out are read from the query as for a raw body.
+type PrintRequestBody struct {
+	Image      string `json:"image"`
+	ImageURL   string `json:"image_url"`
+	Format     string `json:"format"`
+	Copies     int    `json:"copies"`
+	Pages      string `json:"pages"`
+	Printer    string `json:"printer"`
+	Strictness string `json:"strictness"`
+	Rotate     string `json:"rotate"`
+	Dither     *bool  `json:"dither"`
+	Threshold  *int   `json:"threshold"`
+	AutoCut    *bool  `json:"auto_cut"`
+	CutEvery   int    `json:"cut_every"`
+	CutAtEnd   *bool  `json:"cut_at_end"`
+	Priority   string `json:"priority"`
+	Compress   *bool  `json:"compress"`
+}
+
+// readPrintRequest reads a print request in whichever form its content type
+// says it was sent.
+func readPrintRequest(req *http.Request) (*PrintRequest, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	var printRequest *PrintRequest
+	var err error
+	switch {
+	case mediaType == "multipart/form-data":
+		printRequest, err = readFormPrintRequest(req)
+	case mediaType == "application/json":
+		printRequest, err = readJSONPrintRequest(req)
+	case bodyImageTypes[mediaType]:
+		printRequest, err = readBodyPrintRequest(req)
+	default:
+		err = newPrintError(CodeInvalidRequest, nil, "send the label as multipart/form-data, application/json, image/png, image/jpeg or application/pdf, not '%s'", mediaType)
+	}
+	return printRequest, err
+}
+
+// readPrintOptions reads the options of a print request from its form
+// values, which are the query for a JSON or raw body.
+func readPrintOptions(req *http.Request) (*PrintRequest, error) {
+	printRequest := &PrintRequest{
+		Format:     req.FormValue("format"),
+		Pages:      req.FormValue("pages"),
+		Printer:    req.FormValue("printer"),
+		Strictness: req.FormValue("strictness"),
+	}
+	if printRequest.Strictness == "" {
+		printRequest.Strictness = config.PrintableAreaStrictness
+	}
+
+	if partial := req.FormValue("partial"); partial != "" {
+		value, err := strconv.ParseBool(partial)
+		if err != nil {
+			return nil, newPrintError(CodeInvalidRequest, err, "partial must be true or false")
+		}
+		printRequest.Partial = value
+	}
+
+	options, err := parsePipelineOptions(req)
+	if err != nil {
+		return nil, err
+	}
+	printRequest.Options = options
+
+	printOptions, err := parsePrintOptions(req)
+	if err != nil {
+		return nil, err
+	}
+	printRequest.PrintOptions = printOptions
+	return printRequest, nil
+}
+
+func (r *PrintRequest) validate() error {
+	if !strictnessLevels[r.Strictness] {
+		return newPrintError(CodeInvalidRequest, nil, "strictness must be off, warn or reject, not '%s'", r.Strictness)
+	}
+	if err := r.PrintOptions.validate(); err != nil {
+		return err
+	}
+	return r.Options.validate()
+}
+
+// readFormPrintRequest reads a multipart form with the labels in its image
+// values.
+func readFormPrintRequest(req *http.Request) (*PrintRequest, error) {
+	uploads, archived, err := retrieveImagesFromForm(req)
+	if err != nil {
+		return nil, err
+	}
+
+	printRequest, err := readPrintOptions(req)
+	if err == nil {
+		err = printRequest.validate()
+	}
+	if err != nil {
+		removeUploads(log, uploads)
+		return nil, err
+	}
+	printRequest.Uploads = uploads
+	printRequest.Archived = archived
+	return printRequest, nil
+}
+
+// readBodyPrintRequest reads a label sent as the whole request body, with
+// its options in the query.
+func readBodyPrintRequest(req *http.Request) (*PrintRequest, error) {
+	printRequest, err := readPrintOptions(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := printRequest.validate(); err != nil {
+		return nil, err
+	}
+
+	upload, err := saveUpload("body", http.MaxBytesReader(nil, req.Body, MaxImageSize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, newPrintError(CodeInvalidRequest, err, "upload should be fewer than %dMB", MaxImageSize>>20)
+		}
+		return nil, err
+	}
+	printRequest.Uploads = []*LabelImage{upload}
+	return printRequest, nil
+}
+
+// readJSONPrintRequest reads a JSON body with the label base64 encoded in it
+// or the URL to fetch it from.
+func readJSONPrintRequest(req *http.Request) (*PrintRequest, error) {
+	printRequest, err := readPrintOptions(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var body PrintRequestBody
+	if err := decodeJSONBody(req, &body); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, newPrintError(CodeInvalidRequest, err, "image should be fewer than %dMB", MaxImageSize>>20)
+		}
+		return nil, err
+	}
+	printRequest.overlay(body)
+	if err := printRequest.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := printRequest.setImage(req.Context(), body); err != nil {
+		return nil, err
+	}
+	return printRequest, nil
+}
+
+// setImage makes the label of a JSON body, base64 encoded in image or
+// fetched from image_url, the request's upload.
+func (r *PrintRequest) setImage(ctx context.Context, body PrintRequestBody) error {
+	var upload *LabelImage
+	var err error
+	switch {
+	case body.Image != "" && body.ImageURL != "":
+		return newPrintError(CodeInvalidRequest, nil, "send either image or image_url, not both")
+	case body.Image != "":
+		upload, err = decodeBase64Image(body.Image)
+	case body.ImageURL != "":
+		upload, err = fetchImageURL(ctx, body.ImageURL)
+		r.SourceURL = body.ImageURL
+	default:
+		return newPrintError(CodeInvalidRequest, nil, "image or image_url is required")
+	}
+	if err != nil {
+		return err
+	}
+	r.Uploads = []*LabelImage{upload}
+	return nil
+}
+
+// overlay replaces the options read from the query with those set in the
+// JSON body.
+func (r *PrintRequest) overlay(body PrintRequestBody) {
+	if body.Format != "" {
+		r.Format = body.Format
+	}
+	if body.Pages != "" {
+		r.Pages = body.Pages
+	}
+	if body.Printer != "" {
+		r.Printer = body.Printer
+	}
+	if body.Strictness != "" {
+		r.Strictness = body.Strictness
+	}
+	if body.Rotate != "" {
+		r.Options.Rotate = body.Rotate
+	}
+	if body.Dither != nil {
+		r.Options.Dither = *body.Dither
+	}
+	if body.Threshold != nil {
+		r.Options.Threshold = *body.Threshold
+	}
+	r.PrintOptions.overlay(body)
+}
+
+// overlay replaces the print options read from the query with those set in
+// the JSON body.
+func (o *PrintOptions) overlay(body PrintRequestBody) {
+	if body.Copies != 0 {
+		o.Copies = body.Copies
+	}
+	if body.AutoCut != nil {
+		o.AutoCut = body.AutoCut
+	}
+	if body.CutEvery != 0 {
+		o.CutEvery = body.CutEvery
+	}
+	if body.CutAtEnd != nil {
+		o.CutAtEnd = body.CutAtEnd
+	}
+	if body.Priority != "" {
+		o.Priority = body.Priority
+	}
+	if body.Compress != nil {
+		o.Compress = body.Compress
+	}
+}
+
+// decodeBase64Image saves a base64 encoded label, which may be a data URL
+// such as "data:image/png;base64,...".
+func decodeBase64Image(encoded string) (*LabelImage, error) {
+	if strings.HasPrefix(encoded, "data:") {
+		_, data, found := strings.Cut(encoded, ",")
+		if !found {
+			return nil, newPrintError(CodeInvalidRequest, nil, "image is a data URL with no data")
+		}
+		encoded = data
+	}
+
+	imageBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, newPrintError(CodeInvalidRequest, err, "image must be base64 encoded")
+	}
+	return saveUpload("image", bytes.NewReader(imageBytes))
+}
+
+// labels draws the labels of one of the request's uploads, one for each
+// selected page of a PDF.
+func (r *PrintRequest) labels(ctx context.Context, upload *LabelImage) ([]*RenderedLabel, error) {
+	labels, err := upload.labels(ctx, r.Pages, r.Format, r.Options)
+	if err != nil {
+		return nil, err
+	}
+	for _, label := range labels {
+		label.SourceURL = r.SourceURL
+	}
+	return labels, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+const (
+	// PWGHeaderSize is the size of the header in front of each page of a PWG
+	// raster document.
+	PWGHeaderSize = 1796
+	// MaxPWGPages limits how many pages of a PWG raster document are read.
+	MaxPWGPages = 50
+)
+
+// PWG raster colour spaces the decoder reads.
+const (
+	pwgColorSpaceBlack = 3
+	pwgColorSpaceSGray = 18
+	pwgColorSpaceSRGB  = 19
+	pwgColorSpaceRGB   = 1
+)
+
+// PWGPageHeader holds the parts of a PWG raster page header needed to read
+// the page, from PWG 5102.4.
+type PWGPageHeader struct {
+	Resolution   [2]uint32
+	Width        uint32
+	Height       uint32
+	BitsPerColor uint32
+	BitsPerPixel uint32
+	BytesPerLine uint32
+	ColorOrder   uint32
+	ColorSpace   uint32
+}
+
+func parsePWGPageHeader(header []byte) PWGPageHeader {
+	field := func(offset int) uint32 {
+		return binary.BigEndian.Uint32(header[offset:])
+	}
+	return PWGPageHeader{
+		Resolution:   [2]uint32{field(276), field(280)},
+		Width:        field(372),
+		Height:       field(376),
+		BitsPerColor: field(384),
+		BitsPerPixel: field(388),
+		BytesPerLine: field(392),
+		ColorOrder:   field(396),
+		ColorSpace:   field(400),
+	}
+}
+
+func (h PWGPageHeader) validate() error {
+	if h.Width == 0 || h.Height == 0 {
+		return fmt.Errorf("page of %dx%d is not supported", h.Width, h.Height)
+	}
+	if uint64(h.Width)*uint64(h.Height) > MaxImagePixels {
+		return fmt.Errorf("page of %dx%d is larger than %d pixels", h.Width, h.Height, MaxImagePixels)
+	}
+	if h.ColorOrder != 0 {
+		return fmt.Errorf("colour order %d is not supported", h.ColorOrder)
+	}
+
+	switch {
+	case h.ColorSpace == pwgColorSpaceBlack && h.BitsPerPixel == 1,
+		h.ColorSpace == pwgColorSpaceSGray && h.BitsPerPixel == 8,
+		(h.ColorSpace == pwgColorSpaceSRGB || h.ColorSpace == pwgColorSpaceRGB) && h.BitsPerPixel == 24:
+	default:
+		return fmt.Errorf("colour space %d at %d bits per pixel is not supported", h.ColorSpace, h.BitsPerPixel)
+	}
+
+	if h.BytesPerLine != (h.Width*h.BitsPerPixel+7)/8 {
+		return fmt.Errorf("%d bytes per line does not match a width of %d", h.BytesPerLine, h.Width)
+	}
+	return nil
+}
+
+// eachPWGPage reads each page of a PWG raster document as a greyscale image
+// and passes it to handle before reading the next, so only one page is held
+// in memory at a time.
+func eachPWGPage(r io.Reader, handle func(image.Image) error) error {
+	reader := bufio.NewReader(r)
+
+	sync := make([]byte, 4)
+	if _, err := io.ReadFull(reader, sync); err != nil || string(sync) != "RaS2" {
+		return newPrintError(CodeInvalidImage, err, "document is not PWG raster")
+	}
+
+	pages := 0
+	header := make([]byte, PWGHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return newPrintError(CodeInvalidImage, err, "PWG raster page %d has a short header", pages+1)
+		}
+		if pages == MaxPWGPages {
+			return newPrintError(CodeInvalidImage, nil, "PWG raster documents can have at most %d pages", MaxPWGPages)
+		}
+		pages++
+
+		pageHeader := parsePWGPageHeader(header)
+		if err := pageHeader.validate(); err != nil {
+			return newPrintError(CodeInvalidImage, err, "PWG raster page %d: %v", pages, err)
+		}
+		page, err := decodePWGPage(reader, pageHeader)
+		if err != nil {
+			return newPrintError(CodeInvalidImage, err, "PWG raster page %d could not be read", pages)
+		}
+		if err := handle(page); err != nil {
+			return err
+		}
+	}
+
+	if pages == 0 {
+		return newPrintError(CodeInvalidImage, nil, "PWG raster document has no pages")
+	}
+	return nil
+}
+
+// decodePWGPage reads a page's compressed lines. Each line starts with how
+// many times it repeats, less one, then runs of pixels: a count below 128
+// repeats the next pixel count+1 times, a count above 128 is followed by
+// 257-count pixels, and 128 fills the rest of the line with white.
+func decodePWGPage(r *bufio.Reader, header PWGPageHeader) (*image.Gray, error) {
+	page := image.NewGray(image.Rect(0, 0, int(header.Width), int(header.Height)))
+	pixelBytes := max(int(header.BitsPerPixel)/8, 1)
+	line := make([]byte, header.BytesPerLine)
+
+	white := byte(0xff)
+	if header.ColorSpace == pwgColorSpaceBlack {
+		white = 0x00
+	}
+
+	for y := 0; y < int(header.Height); {
+		repeat, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		for x := 0; x < len(line); {
+			count, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case count == 128:
+				for ; x < len(line); x++ {
+					line[x] = white
+				}
+			case count < 128:
+				pixel := make([]byte, pixelBytes)
+				if _, err := io.ReadFull(r, pixel); err != nil {
+					return nil, err
+				}
+				for range int(count) + 1 {
+					if x+pixelBytes > len(line) {
+						return nil, fmt.Errorf("line %d is too long", y)
+					}
+					x += copy(line[x:], pixel)
+				}
+			default:
+				length := (257 - int(count)) * pixelBytes
+				if x+length > len(line) {
+					return nil, fmt.Errorf("line %d is too long", y)
+				}
+				if _, err := io.ReadFull(r, line[x:x+length]); err != nil {
+					return nil, err
+				}
+				x += length
+			}
+		}
+
+		for range int(repeat) + 1 {
+			if y == int(header.Height) {
+				break
+			}
+			writePWGLine(page, y, line, header)
+			y++
+		}
+	}
+	return page, nil
+}
+
+// writePWGLine converts one decoded line to grey.
+func writePWGLine(page *image.Gray, y int, line []byte, header PWGPageHeader) {
+	row := page.Pix[y*page.Stride : y*page.Stride+int(header.Width)]
+	switch header.ColorSpace {
+	case pwgColorSpaceBlack:
+		for x := range row {
+			row[x] = 0xff
+			if line[x/8]&(0x80>>(x%8)) != 0 {
+				row[x] = 0x00
+			}
+		}
+	case pwgColorSpaceSGray:
+		copy(row, line)
+	default:
+		for x := range row {
+			r, g, b := int(line[x*3]), int(line[x*3+1]), int(line[x*3+2])
+			row[x] = byte((299*r + 587*g + 114*b) / 1000)
+		}
+	}
+}
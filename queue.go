@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+const JobRetention = time.Hour
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobHeld      JobState = "held"
+	JobPrinting  JobState = "printing"
+	JobCompleted JobState = "completed"
+	JobFailed    JobState = "failed"
+	JobExpired   JobState = "expired"
+	JobCancelled JobState = "cancelled"
+)
+
+type PrintJob struct {
+	ID         string
+	Printer    Printer
+	FormatName string
+	FilePath   string
+	Options    PrintOptions
+	Warnings   []string
+	// SourceURL is where the label was fetched from, if it was.
+	SourceURL string
+	// Raster is set when FilePath is a Brother raster stream sent by a raw
+	// or LPD client, which goes to the printer as it is.
+	Raster bool
+
+	logger zerolog.Logger
+	pool   *PrinterPool
+
+	mu          sync.Mutex
+	state       JobState
+	holdReason  string
+	heldAt      time.Time
+	submittedAt time.Time
+	finishedAt  time.Time
+	err         error
+
+	// held is closed the first time the job is held and done once it has
+	// finished, so callers can stop waiting on a job that will take a while.
+	held chan struct{}
+	done chan struct{}
+}
+
+// newPrintJob creates a job for a label format. The rendered label must be
+// saved to the job's FilePath before it is submitted.
+func newPrintJob(logger zerolog.Logger, formatName string) *PrintJob {
+	id := xid.New().String()
+	return &PrintJob{
+		ID:          id,
+		FormatName:  formatName,
+		FilePath:    filepath.Join(UploadDirectory, id+".png"),
+		logger:      logger.With().Str("job_id", id).Logger(),
+		state:       JobQueued,
+		submittedAt: time.Now(),
+		held:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+type JobStatus struct {
+	ID          string       `json:"id"`
+	State       JobState     `json:"state"`
+	HoldReason  string       `json:"hold_reason,omitempty"`
+	Printer     string       `json:"printer"`
+	Model       string       `json:"model"`
+	Format      string       `json:"format"`
+	SubmittedAt time.Time    `json:"submitted_at"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+	ErrorCode   string       `json:"error_code,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Options     PrintOptions `json:"print_options"`
+	Warnings    []string     `json:"warnings,omitempty"`
+	SourceURL   string       `json:"source_url,omitempty"`
+}
+
+func (j *PrintJob) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := JobStatus{
+		ID:          j.ID,
+		State:       j.state,
+		HoldReason:  j.holdReason,
+		Printer:     j.Printer.Name,
+		Model:       j.Printer.Model,
+		Format:      j.FormatName,
+		SubmittedAt: j.submittedAt,
+		Options:     j.Options,
+		Warnings:    j.Warnings,
+		SourceURL:   j.SourceURL,
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+
+	var printErr *PrintError
+	if errors.As(j.err, &printErr) {
+		status.ErrorCode = printErr.Code
+		status.Error = printErr.Detail
+	}
+
+	return status
+}
+
+func (j *PrintJob) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// assign records the printer a job has been routed to. The job result
+// reports this printer, so after a failover it is the one that printed.
+func (j *PrintJob) assign(pool *PrinterPool, printer Printer) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.pool = pool
+	j.Printer = printer
+}
+
+// assignedPool returns the pool the job was routed through, or nil if it was
+// sent to a printer by name.
+func (j *PrintJob) assignedPool() *PrinterPool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.pool
+}
+
+func (j *PrintJob) setState(state JobState) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.state = state
+	if state != JobHeld {
+		j.holdReason = ""
+		j.heldAt = time.Time{}
+	}
+}
+
+func (j *PrintJob) hold(reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.state != JobHeld {
+		j.heldAt = time.Now()
+		j.logger.Info().Str("reason", reason).Msg("Job held")
+	}
+	j.state = JobHeld
+	j.holdReason = reason
+
+	select {
+	case <-j.held:
+	default:
+		close(j.held)
+	}
+}
+
+func (j *PrintJob) heldLongerThan(ttl time.Duration) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == JobHeld && time.Since(j.heldAt) > ttl
+}
+
+func (j *PrintJob) finish(state JobState, err error) {
+	j.mu.Lock()
+	j.state = state
+	j.holdReason = ""
+	j.err = err
+	j.finishedAt = time.Now()
+	j.mu.Unlock()
+
+	if err := os.Remove(j.FilePath); err != nil {
+		j.logger.Error().Err(err).Msg("could not delete the image after processing")
+	}
+
+	j.logger.Info().Str("state", string(state)).Msg("Job finished")
+	close(j.done)
+}
+
+func (j *PrintJob) finishedBefore(t time.Time) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero() && j.finishedAt.Before(t)
+}
+
+// JobStore keeps every job, finished or not, for JobRetention so clients
+// can look up jobs that were held rather than printed straight away.
+type JobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*PrintJob
+}
+
+var jobStore = &JobStore{jobs: map[string]*PrintJob{}}
+
+func (s *JobStore) add(job *PrintJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+}
+
+func (s *JobStore) get(id string) (*PrintJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, exists := s.jobs[id]
+	return job, exists
+}
+
+func (s *JobStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-JobRetention)
+	for id, job := range s.jobs {
+		if job.finishedBefore(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// PrintQueue sends jobs to one printer, one at a time and in order. While
+// the printer is offline or out of media the queue pauses and holds its jobs
+// until polling finds the condition has cleared.
+type PrintQueue struct {
+	Printer Printer
+
+	mu         sync.Mutex
+	pending    []*PrintJob
+	printing   *PrintJob
+	holdReason string
+	status     PrinterStatus
+
+	// device is held while the printer is written to, so a status query is
+	// never sent in the middle of a job.
+	device sync.Mutex
+
+	wake chan struct{}
+}
+
+// printQueues holds the queue of every known printer by name. Printers can
+// be registered while the server runs, so access goes through the functions
+// below.
+var (
+	printQueuesMu sync.RWMutex
+	printQueues   = map[string]*PrintQueue{}
+)
+
+func printQueue(name string) *PrintQueue {
+	printQueuesMu.RLock()
+	defer printQueuesMu.RUnlock()
+	return printQueues[name]
+}
+
+// startPrintQueue returns the printer's queue, creating and starting it if
+// the printer has not been seen before.
+func startPrintQueue(ctx context.Context, printer Printer) *PrintQueue {
+	printQueuesMu.Lock()
+	defer printQueuesMu.Unlock()
+
+	if queue, exists := printQueues[printer.Name]; exists {
+		return queue
+	}
+
+	queue := newPrintQueue(printer)
+	printQueues[printer.Name] = queue
+	queue.Start(ctx)
+	return queue
+}
+
+func allPrintQueues() []*PrintQueue {
+	printQueuesMu.RLock()
+	defer printQueuesMu.RUnlock()
+
+	queues := make([]*PrintQueue, 0, len(printQueues))
+	for _, queue := range printQueues {
+		queues = append(queues, queue)
+	}
+	slices.SortFunc(queues, func(a, b *PrintQueue) int {
+		return strings.Compare(a.Printer.Name, b.Printer.Name)
+	})
+	return queues
+}
+
+func newPrintQueue(printer Printer) *PrintQueue {
+	return &PrintQueue{
+		Printer: printer,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (q *PrintQueue) Start(ctx context.Context) {
+	go q.work(ctx)
+	go q.poll(ctx)
+}
+
+func (q *PrintQueue) Submit(job *PrintJob) {
+	jobStore.add(job)
+
+	q.mu.Lock()
+	q.pending = append(q.pending, job)
+	holdReason := q.holdReason
+	q.mu.Unlock()
+
+	if holdReason != "" {
+		job.hold(holdReason)
+	}
+
+	q.signal()
+}
+
+func (q *PrintQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *PrintQueue) next() *PrintJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.holdReason != "" || len(q.pending) == 0 {
+		return nil
+	}
+
+	job := q.pending[0]
+	q.pending = q.pending[1:]
+	q.printing = job
+	return job
+}
+
+// cancel takes a job off the queue if it has not been sent to the printer
+// yet. It returns false if the job is printing or not on this queue.
+func (q *PrintQueue) cancel(job *PrintJob) bool {
+	q.mu.Lock()
+	index := slices.Index(q.pending, job)
+	if index >= 0 {
+		q.pending = slices.Delete(q.pending, index, index+1)
+	}
+	q.mu.Unlock()
+
+	if index < 0 {
+		return false
+	}
+	job.finish(JobCancelled, nil)
+	return true
+}
+
+func (q *PrintQueue) Healthy() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.holdReason == ""
+}
+
+// Depth is the number of jobs waiting for or being sent to the printer.
+func (q *PrintQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	depth := len(q.pending)
+	if q.printing != nil {
+		depth++
+	}
+	return depth
+}
+
+func (q *PrintQueue) work(ctx context.Context) {
+	for {
+		job := q.next()
+		if job == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		job.setState(JobPrinting)
+		q.device.Lock()
+		err := job.print(job.logger)
+		q.device.Unlock()
+
+		if reason := holdReasonForError(err); reason != "" {
+			q.mu.Lock()
+			q.pending = append([]*PrintJob{job}, q.pending...)
+			q.printing = nil
+			q.mu.Unlock()
+			q.pause(reason)
+			continue
+		}
+
+		q.mu.Lock()
+		q.printing = nil
+		q.mu.Unlock()
+
+		if err != nil {
+			job.finish(JobFailed, err)
+			continue
+		}
+		job.finish(JobCompleted, nil)
+	}
+}
+
+// holdReasonForError returns a hold reason for print failures that should
+// be retried once the printer recovers rather than reported to the client.
+func holdReasonForError(err error) string {
+	var printErr *PrintError
+	if !errors.As(err, &printErr) {
+		return ""
+	}
+
+	switch printErr.Code {
+	case CodeDeviceNotFound:
+		return "printer offline"
+	case CodeNoMedia:
+		return "no media loaded"
+	case CodeCutterJam:
+		return "cutter jam"
+	case CodeCoverOpen:
+		return "cover open"
+	}
+	return ""
+}
+
+// pause stops the queue sending jobs to its printer. Pending jobs move to
+// another healthy printer in their pool if there is one, otherwise they are
+// held here.
+func (q *PrintQueue) pause(reason string) {
+	q.mu.Lock()
+	if q.holdReason == "" {
+		log.Warn().Str("printer", q.Printer.Name).Str("reason", reason).Msg("Pausing print queue")
+	}
+	q.holdReason = reason
+	pending := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	var held []*PrintJob
+	for _, job := range pending {
+		if pool := job.assignedPool(); pool != nil && pool.failover(job, q.Printer.Name) {
+			continue
+		}
+		held = append(held, job)
+	}
+
+	q.mu.Lock()
+	q.pending = append(held, q.pending...)
+	for _, job := range q.pending {
+		job.hold(q.holdReason)
+	}
+	q.mu.Unlock()
+}
+
+func (q *PrintQueue) resume() {
+	q.mu.Lock()
+	if q.holdReason == "" {
+		q.mu.Unlock()
+		return
+	}
+
+	log.Info().Str("printer", q.Printer.Name).Msg("Resuming print queue")
+	q.holdReason = ""
+	for _, job := range q.pending {
+		job.setState(JobQueued)
+	}
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+func (q *PrintQueue) expireHeldJobs(ttl time.Duration) {
+	q.mu.Lock()
+	var expired []*PrintJob
+	pending := q.pending[:0]
+	for _, job := range q.pending {
+		if job.heldLongerThan(ttl) {
+			expired = append(expired, job)
+			continue
+		}
+		pending = append(pending, job)
+	}
+	q.pending = pending
+	q.mu.Unlock()
+
+	for _, job := range expired {
+		job.finish(JobExpired, newPrintError(CodeJobExpired, nil, "job was held for longer than %s", ttl))
+	}
+}
+
+func (q *PrintQueue) Status() PrinterStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.status
+}
+
+func (q *PrintQueue) poll(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.StatusPollInterval))
+	defer ticker.Stop()
+
+	for {
+		q.checkStatus()
+		q.expireHeldJobs(time.Duration(config.HeldJobTTL))
+		jobStore.prune()
+		batchStore.prune()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkStatus asks the printer for its status and pauses or resumes the
+// queue to match. Querying the printer resets it, so while a job is being
+// sent the printer is not asked and the last status is kept.
+func (q *PrintQueue) checkStatus() {
+	q.mu.Lock()
+	printing := q.printing != nil
+	q.mu.Unlock()
+	if printing {
+		return
+	}
+
+	q.device.Lock()
+	status, err := readPrinterStatus(q.Printer.Port)
+	q.device.Unlock()
+	if err != nil {
+		log.Debug().Err(err).Str("printer", q.Printer.Name).Msg("Could not read printer status")
+	}
+
+	q.mu.Lock()
+	q.status = status
+	q.mu.Unlock()
+
+	if reason := status.HoldReason(); reason != "" {
+		q.pause(reason)
+		return
+	}
+	q.resume()
+}
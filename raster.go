@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Brother QL raster commands, as produced by brother_ql/raster.py.
+var (
+	rasterInitialize    = []byte{0x1b, 0x40}
+	rasterSwitchMode    = []byte{0x1b, 0x69, 0x61, 0x01}
+	rasterStatusRequest = []byte{0x1b, 0x69, 0x53}
+	rasterMediaQuality  = []byte{0x1b, 0x69, 0x7a}
+	rasterAutoCut       = []byte{0x1b, 0x69, 0x4d}
+	rasterCutEvery      = []byte{0x1b, 0x69, 0x41}
+	rasterExpandedMode  = []byte{0x1b, 0x69, 0x4b}
+	rasterMargins       = []byte{0x1b, 0x69, 0x64}
+	rasterCompression   = []byte{0x4d}
+)
+
+const (
+	rasterPrint         = 0x0c
+	rasterPrintWithFeed = 0x1a
+
+	mediaFlagKind    = 0x02
+	mediaFlagWidth   = 0x04
+	mediaFlagLength  = 0x08
+	mediaFlagQuality = 0x40
+	mediaFlagRecover = 0x80
+
+	expandedCutAtEnd = 0x08
+
+	compressionNone     = 0x00
+	compressionPackBits = 0x02
+
+	autoCutOn = 0x40
+
+	mediaKindContinuous = 0x0a
+	mediaKindDieCut     = 0x0b
+
+	// ContinuousMarginDots is the feed margin brother_ql uses for endless
+	// labels; die-cut labels need none.
+	ContinuousMarginDots = 35
+)
+
+// encodeRaster builds the raster stream a printer of the given model
+// receives to print the label with the options, one page per copy. It is the
+// same data brother_ql sends, so it can be inspected or replayed with
+// `brother_ql send`.
+func encodeRaster(label *RenderedLabel, model PrinterModel, options rasterOptions) []byte {
+	var raster bytes.Buffer
+
+	raster.Write(make([]byte, model.InvalidateBytes))
+	raster.Write(rasterInitialize)
+	if model.ModeSetting {
+		raster.Write(rasterSwitchMode)
+	}
+
+	mediaKind := byte(mediaKindDieCut)
+	mediaLength := byte(label.Format.LengthMM)
+	margins := 0
+	if label.Format.Type == MediaTypeContinuous {
+		mediaKind = mediaKindContinuous
+		mediaLength = 0
+		margins = ContinuousMarginDots
+	}
+
+	mediaFlags := byte(mediaFlagRecover | mediaFlagKind | mediaFlagWidth | mediaFlagLength)
+	if options.Quality {
+		mediaFlags |= mediaFlagQuality
+	}
+
+	for page := 0; page < options.Copies; page++ {
+		raster.Write(rasterStatusRequest)
+		raster.Write(rasterMediaQuality)
+		raster.WriteByte(mediaFlags)
+		raster.WriteByte(mediaKind)
+		raster.WriteByte(byte(label.Format.WidthMM))
+		raster.WriteByte(mediaLength)
+		binary.Write(&raster, binary.LittleEndian, uint32(label.Dimensions.Y))
+		if page == 0 {
+			raster.WriteByte(0x00)
+		} else {
+			raster.WriteByte(0x01)
+		}
+		raster.WriteByte(0x00)
+
+		if model.Cutting {
+			autoCut := byte(0)
+			if options.AutoCut {
+				autoCut = autoCutOn
+			}
+			raster.Write(rasterAutoCut)
+			raster.WriteByte(autoCut)
+			if options.AutoCut {
+				raster.Write(rasterCutEvery)
+				raster.WriteByte(byte(options.CutEvery))
+			}
+		}
+
+		if model.ExpandedMode {
+			expanded := byte(0)
+			if options.CutAtEnd {
+				expanded |= expandedCutAtEnd
+			}
+			raster.Write(rasterExpandedMode)
+			raster.WriteByte(expanded)
+		}
+
+		raster.Write(rasterMargins)
+		binary.Write(&raster, binary.LittleEndian, uint16(margins))
+
+		if model.Compression {
+			raster.Write(rasterCompression)
+			if options.Compress {
+				raster.WriteByte(compressionPackBits)
+			} else {
+				raster.WriteByte(compressionNone)
+			}
+		}
+
+		for y := 0; y < label.Dimensions.Y; y++ {
+			writeRasterLine(&raster, []byte{'g', 0x00}, rasterLine(label, model, y), options.Compress)
+		}
+
+		if page == options.Copies-1 {
+			raster.WriteByte(rasterPrintWithFeed)
+		} else {
+			raster.WriteByte(rasterPrint)
+		}
+	}
+	return raster.Bytes()
+}
+
+// writeRasterLine writes one raster line command, its length and its data,
+// packed with PackBits if compress is set.
+func writeRasterLine(raster *bytes.Buffer, command []byte, line []byte, compress bool) {
+	if compress {
+		line = packBits(line)
+	}
+	raster.Write(command)
+	raster.WriteByte(byte(len(line)))
+	raster.Write(line)
+}
+
+// packBits compresses data with the TIFF PackBits scheme the printers take:
+// runs of two or more equal bytes become a count and the byte, and
+// everything else is copied with a count in front. It follows the packbits
+// package brother_ql uses step for step, splitting runs and literals at 127
+// bytes as it does, so the stream is the same as brother_ql's.
+func packBits(data []byte) []byte {
+	const maxLength = 127
+	if len(data) == 0 {
+		return nil
+	}
+
+	var packed, literal []byte
+	inRun, run := false, 0
+	finishLiteral := func() {
+		if len(literal) > 0 {
+			packed = append(packed, byte(len(literal)-1))
+			packed = append(packed, literal...)
+			literal = literal[:0]
+		}
+	}
+	finishRun := func(value byte) {
+		packed = append(packed, byte(1-run), value)
+	}
+
+	pos := 0
+	for ; pos < len(data)-1; pos++ {
+		switch {
+		case data[pos] == data[pos+1] && !inRun:
+			finishLiteral()
+			inRun, run = true, 1
+		case data[pos] == data[pos+1]:
+			if run == maxLength {
+				finishRun(data[pos])
+				run = 0
+			}
+			run++
+		case inRun:
+			run++
+			finishRun(data[pos])
+			inRun, run = false, 0
+		default:
+			if len(literal) == maxLength {
+				finishLiteral()
+			}
+			literal = append(literal, data[pos])
+		}
+	}
+
+	if inRun {
+		run++
+		finishRun(data[pos])
+	} else {
+		literal = append(literal, data[pos])
+		finishLiteral()
+	}
+	return packed
+}
+
+// rasterLine packs one row of the label into print head bits. Like
+// brother_ql, the row is padded on the right by the label and model offsets
+// and then mirrored, so the label's first pixel lands at the sum of its
+// width and the offsets, counting back from there.
+func rasterLine(label *RenderedLabel, model PrinterModel, y int) []byte {
+	line := make([]byte, model.BytesPerRow)
+	headDots := model.BytesPerRow * 8
+
+	for x := 0; x < label.Dimensions.X; x++ {
+		if label.Image.ColorIndexAt(x, y) != dotBlack {
+			continue
+		}
+		position := label.Dimensions.X + label.Format.OffsetRight + model.OffsetRight - 1 - x
+		if position < 0 || position >= headDots {
+			continue
+		}
+		line[position/8] |= 0x80 >> (position % 8)
+	}
+	return line
+}
+
+// writeRaster encodes the job's saved label for the model of the printer it
+// was routed to, with the job's print options, and saves it beside the label
+// for brother_ql to send. It returns the raster file's path.
+func (j *PrintJob) writeRaster() (string, error) {
+	model, exists := findPrinterModel(j.Printer.Model)
+	if !exists {
+		return "", newPrintError(CodeInternal, nil, "printer model '%s' is not supported", j.Printer.Model)
+	}
+	options, err := j.Options.forModel(model)
+	if err != nil {
+		return "", err
+	}
+	label, err := loadRenderedLabel(j.FilePath, j.FormatName)
+	if err != nil {
+		return "", err
+	}
+
+	rasterPath := strings.TrimSuffix(j.FilePath, filepath.Ext(j.FilePath)) + ".bin"
+	if err := os.WriteFile(rasterPath, encodeRaster(label, model, options), 0644); err != nil {
+		return "", newPrintError(CodeInternal, err, "unable to write the raster data")
+	}
+	return rasterPath, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPattern is the label drawn for the raster fixtures: a border, a block
+// in the top left corner to show which way the label is mirrored, a diagonal
+// and a band of checks. It must match testdata/raster/generate.py.
+func testPattern(x, y, w, h int) bool {
+	return x < 4 || y < 4 || x >= w-4 || y >= h-4 || (x < 120 && y < 60) || x == y ||
+		((x/16+y/16)%2 == 0 && y >= h/2 && y < h/2+64)
+}
+
+func patternLabel(t *testing.T, formatName string) *RenderedLabel {
+	format, dimensions, exists := findLabelFormat(formatName)
+	if !exists {
+		t.Fatalf("label format '%s' does not exist", formatName)
+	}
+	img := image.NewPaletted(image.Rect(0, 0, dimensions.X, dimensions.Y), labelPalette)
+	for y := 0; y < dimensions.Y; y++ {
+		for x := 0; x < dimensions.X; x++ {
+			if testPattern(x, y, dimensions.X, dimensions.Y) {
+				img.SetColorIndex(x, y, dotBlack)
+			}
+		}
+	}
+	return &RenderedLabel{Format: format, Dimensions: dimensions, Image: img}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	file, err := os.Open(filepath.Join("testdata", "raster", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestEncodeRasterMatchesBrotherQL compares the raster stream with the one
+// brother_ql's convert builds for the same label with its default options.
+func TestEncodeRasterMatchesBrotherQL(t *testing.T) {
+	for _, test := range []struct {
+		format  string
+		model   string
+		fixture string
+	}{
+		{format: "62x100", model: "QL-500", fixture: "62x100-QL-500.bin.gz"},
+		{format: "102x152", model: "QL-1060N", fixture: "102x152-QL-1060N.bin.gz"},
+	} {
+		t.Run(test.format+"/"+test.model, func(t *testing.T) {
+			model, exists := findPrinterModel(test.model)
+			if !exists {
+				t.Fatalf("printer model '%s' is not supported", test.model)
+			}
+			options, err := PrintOptions{}.forModel(model)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := encodeRaster(patternLabel(t, test.format), model, options)
+			want := readFixture(t, test.fixture)
+			if !bytes.Equal(got, want) {
+				at := 0
+				for at < len(got) && at < len(want) && got[at] == want[at] {
+					at++
+				}
+				t.Fatalf("raster differs from brother_ql's at byte %d of %d (got %d bytes)", at, len(want), len(got))
+			}
+		})
+	}
+}
+
+// TestPackBits checks packBits against the packbits package brother_ql
+// compresses with, including where it splits long runs and literals.
+func TestPackBits(t *testing.T) {
+	sequence := func(n int) []byte {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		return data
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"one byte", []byte{0x01}, "0001"},
+		{"row of zeros", make([]byte, 90), "a700"},
+		{"run of 127", make([]byte, 127), "8200"},
+		{"run of 128", make([]byte, 128), "8100"},
+		{"run of 129", make([]byte, 129), "8200ff00"},
+		{"wide row of zeros", make([]byte, 162), "8200de00"},
+		{"run of 255", make([]byte, 255), "82008100"},
+		{"literal of 130", sequence(130), "7e" + hex.EncodeToString(sequence(127)) + "027f8081"},
+		{"literal then run", append(sequence(128), 0x05, 0x05), "7e" + hex.EncodeToString(sequence(127)) + "007fff05"},
+		{"short run inside literals", []byte{0x01, 0x02, 0x02, 0x03}, "0001ff020003"},
+		{"runs around a literal", []byte{0xff, 0xff, 0xff, 0x00, 0x01, 0x01}, "feff0000ff01"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := hex.EncodeToString(packBits(test.data)); got != test.want {
+				t.Errorf("packBits = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// MaxNetworkJobSize limits the size of a document sent to a raw, LPD or
+	// IPP printer.
+	MaxNetworkJobSize = 20 << 20
+	// NetworkJobTimeout is how long a raw or LPD client has to send its job
+	// before the connection is dropped.
+	NetworkJobTimeout = 5 * time.Minute
+	// rasterSniffSize is how much of a document is read to tell what it is,
+	// enough for a Brother raster stream's invalidate bytes and the commands
+	// that follow them.
+	rasterSniffSize = 4096
+)
+
+// RawPrinterConfig is a socket that takes jobs the way port 9100 of a
+// network printer does, for software that can only print to one.
+type RawPrinterConfig struct {
+	// Address is where to listen, such as ":9100".
+	Address string `json:"address"`
+	Printer string `json:"printer"`
+	// Format is the label format images are printed on. If it is not set
+	// the format is chosen from each image's size, as for /print.
+	Format string `json:"format"`
+}
+
+func (c RawPrinterConfig) validate() error {
+	if c.Address == "" {
+		return errors.New("address is required")
+	}
+	if c.Printer == "" {
+		return errors.New("printer is required")
+	}
+	return nil
+}
+
+// networkClients are the parsed config.NetworkClients.
+var networkClients []netip.Prefix
+
+// parseNetworkClients reads addresses, such as "10.1.2.3", and prefixes,
+// such as "10.1.0.0/16".
+func parseNetworkClients(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not an address or prefix", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allowedNetworkClient reports whether a raw, LPD or IPP client may print.
+// With no network_clients configured only this host may.
+func allowedNetworkClient(remote net.Addr) bool {
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	return allowedClientAddr(tcpAddr.AddrPort().Addr())
+}
+
+// allowedNetworkAddress is allowedNetworkClient for an HTTP request's
+// remote address.
+func allowedNetworkAddress(remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	return allowedClientAddr(addrPort.Addr())
+}
+
+func allowedClientAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if len(networkClients) == 0 {
+		return addr.IsLoopback()
+	}
+	for _, prefix := range networkClients {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptNetworkClients calls handle in a goroutine for each connection from
+// an allowed client until ctx is done, closing the connection afterwards.
+func acceptNetworkClients(ctx context.Context, listener net.Listener, logger zerolog.Logger, handle func(net.Conn, zerolog.Logger)) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Err(err).Msg("Cannot accept connection")
+				}
+				return
+			}
+
+			clientLogger := logger.With().Str("ip", conn.RemoteAddr().String()).Logger()
+			if !allowedNetworkClient(conn.RemoteAddr()) {
+				clientLogger.Warn().Msg("Refused connection from a client not in network_clients")
+				conn.Close()
+				continue
+			}
+
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(NetworkJobTimeout))
+				handle(conn, clientLogger)
+			}()
+		}
+	}()
+}
+
+// NetworkPrinter is a printer, and optionally a label format, that raw and
+// LPD clients print to.
+type NetworkPrinter struct {
+	Printer string
+	Format  string
+}
+
+// check checks the printer exists and can print the format.
+func (n NetworkPrinter) check() error {
+	if printQueue(n.Printer) == nil {
+		return newPrintError(CodeUnknownPrinter, nil, "no printer is named '%s'", n.Printer)
+	}
+	if n.Format == "" {
+		return nil
+	}
+	pool, exists := labelPrinters[n.Format]
+	if !exists {
+		return newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", n.Format)
+	}
+	_, err := pool.member(n.Printer, n.Format)
+	return err
+}
+
+// receive saves a document sent by a client, refusing it if it is larger
+// than MaxNetworkJobSize.
+func receive(name string, document io.Reader) (*LabelImage, error) {
+	upload, err := saveUpload(name, io.LimitReader(document, MaxNetworkJobSize+1))
+	if err != nil {
+		return nil, err
+	}
+	info, err := upload.File.Stat()
+	if err == nil && info.Size() > MaxNetworkJobSize {
+		os.Remove(upload.File.Name())
+		return nil, newPrintError(CodeInvalidRequest, nil, "jobs can be at most %dMB", MaxNetworkJobSize>>20)
+	}
+	return upload, nil
+}
+
+// print queues a received document. A Brother raster stream is sent to the
+// printer as it is. PWG raster, PNG, JPEG and PDF documents are drawn on the
+// label format like /print with its default options, and every page is
+// checked before any is queued.
+func (n NetworkPrinter) print(ctx context.Context, logger zerolog.Logger, upload *LabelImage, options PrintOptions) ([]*PrintJob, error) {
+	file, err := os.Open(upload.File.Name())
+	if err != nil {
+		upload.remove(logger)
+		return nil, newPrintError(CodeInternal, err, "could not get image from file")
+	}
+	defer file.Close()
+
+	header := make([]byte, rasterSniffSize)
+	read, _ := file.ReadAt(header, 0)
+	header = header[:read]
+	if isBrotherRaster(header) {
+		printJob, err := n.queueRaster(logger, upload, header)
+		if err != nil {
+			return nil, err
+		}
+		return []*PrintJob{printJob}, nil
+	}
+	defer upload.remove(logger)
+
+	pipelineOptions := PipelineOptions{Rotate: RotateAuto, Threshold: DefaultThreshold}
+	var labels []*RenderedLabel
+	if bytes.HasPrefix(header, []byte("RaS2")) {
+		err := eachPWGPage(file, func(page image.Image) error {
+			label, err := prepareLabel(page, n.Format, pipelineOptions)
+			if err != nil {
+				return err
+			}
+			labels = append(labels, label)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		labels, err = upload.labels(ctx, "", n.Format, pipelineOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	warnings, err := checkLabels(labels, config.PrintableAreaStrictness, n.Printer, options)
+	if err != nil {
+		return nil, err
+	}
+	return queueLabels(logger, labels, warnings, n.Printer, options)
+}
+
+// isBrotherRaster reports whether a document is a raster stream for a
+// Brother QL printer, which starts with zeros to clear the printer's buffer
+// and then the initialize command.
+func isBrotherRaster(header []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(header, "\x00"), rasterInitialize)
+}
+
+// queueRaster queues a Brother raster stream on the printer. The job is
+// filed under the printer's format, or if none is set, the one matching the
+// media named in the stream's media and quality command.
+func (n NetworkPrinter) queueRaster(logger zerolog.Logger, upload *LabelImage, header []byte) (*PrintJob, error) {
+	formatName, err := n.rasterFormat(header)
+	if err != nil {
+		upload.remove(logger)
+		return nil, err
+	}
+
+	printJob := newPrintJob(logger, formatName)
+	printJob.Raster = true
+	printJob.FilePath = filepath.Join(UploadDirectory, printJob.ID+".bin")
+	if err := os.Rename(upload.File.Name(), printJob.FilePath); err != nil {
+		upload.remove(logger)
+		return nil, newPrintError(CodeInternal, err, "unable to save the raster data")
+	}
+
+	if err := labelPrinters[formatName].SubmitTo(printJob, n.Printer); err != nil {
+		printJob.finish(JobFailed, err)
+		return nil, err
+	}
+
+	logger.Info().
+		Str("JobID", printJob.ID).
+		Str("PrinterName", printJob.Printer.Name).
+		Str("FormatName", printJob.FormatName).
+		Msg("Printing raster job")
+	return printJob, nil
+}
+
+func (n NetworkPrinter) rasterFormat(header []byte) (string, error) {
+	if n.Format != "" {
+		return n.Format, nil
+	}
+
+	index := bytes.Index(header, rasterMediaQuality)
+	if index < 0 || len(header) < index+len(rasterMediaQuality)+4 {
+		return "", newPrintError(CodeInvalidRequest, nil, "raster does not say what media it is for, so printer '%s' needs a format", n.Printer)
+	}
+	media := header[index+len(rasterMediaQuality):]
+	widthMM, lengthMM := int(media[2]), int(media[3])
+
+	for _, formatName := range printerFormats(n.Printer) {
+		format, _, _ := findLabelFormat(formatName)
+		if format.WidthMM == widthMM && format.LengthMM == lengthMM {
+			return formatName, nil
+		}
+	}
+	return "", newPrintError(CodeInvalidRequest, nil, "printer '%s' is not set up for the %dx%dmm media the raster is for", n.Printer, widthMM, lengthMM)
+}
+
+// startRawPrinters listens on the address of every configured raw printer.
+func startRawPrinters(ctx context.Context) error {
+	for _, rawConfig := range config.RawPrinters {
+		networkPrinter := NetworkPrinter{Printer: rawConfig.Printer, Format: rawConfig.Format}
+		if err := networkPrinter.check(); err != nil {
+			return fmt.Errorf("raw printer '%s': %w", rawConfig.Address, err)
+		}
+
+		listener, err := net.Listen("tcp", rawConfig.Address)
+		if err != nil {
+			return fmt.Errorf("raw printer '%s': %w", rawConfig.Address, err)
+		}
+
+		logger := log.With().Str("raw_printer", rawConfig.Address).Str("printer", rawConfig.Printer).Logger()
+		logger.Info().Msg("Listening for raw print jobs")
+		acceptNetworkClients(ctx, listener, logger, func(conn net.Conn, logger zerolog.Logger) {
+			networkPrinter.receiveRaw(ctx, conn, logger)
+		})
+	}
+	return nil
+}
+
+// receiveRaw prints everything a client sends before closing its side of
+// the connection as one document. Raw printing has no way to report an
+// error, so errors are only logged.
+func (n NetworkPrinter) receiveRaw(ctx context.Context, conn net.Conn, logger zerolog.Logger) {
+	upload, err := receive("raw", conn)
+	if err != nil {
+		logger.Info().Err(err).Msg("Raw print job refused")
+		return
+	}
+
+	printJobs, err := n.print(ctx, logger, upload, PrintOptions{})
+	if err != nil {
+		logger.Info().Err(err).Msg("Raw print job refused")
+		return
+	}
+	logger.Info().Strs("job_ids", jobIDs(printJobs)).Msg("Raw print job queued")
+}
+
+func jobIDs(printJobs []*PrintJob) []string {
+	ids := make([]string, len(printJobs))
+	for i, printJob := range printJobs {
+		ids[i] = printJob.ID
+	}
+	return ids
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// SQSMaxWaitTime is the longest SQS lets a receive wait for messages.
+	SQSMaxWaitTime = 20 * time.Second
+	// SQSMaxMessages is the most messages SQS returns from one receive.
+	SQSMaxMessages = 10
+	// SQSRetryDelay is how long to wait before polling again after the
+	// queue could not be reached.
+	SQSRetryDelay = 10 * time.Second
+)
+
+// Results posted to the reply queue.
+const (
+	SQSResultCompleted = "completed"
+	SQSResultFailed    = "failed"
+)
+
+// SQSConfig sets up pull mode, where print jobs are read from an SQS queue
+// instead of arriving through the tunnel.
+type SQSConfig struct {
+	// QueueURL is the queue print job messages are read from. Pull mode is
+	// off if it is not set.
+	QueueURL string `json:"queue_url"`
+	// ReplyQueueURL is where the result of each message is posted, if set.
+	ReplyQueueURL string `json:"reply_queue_url"`
+	// DeadLetterQueueURL is where messages that can never print, such as
+	// ones that cannot be parsed or whose label is invalid, are moved. If it
+	// is not set they are deleted.
+	DeadLetterQueueURL string `json:"dead_letter_queue_url"`
+	// Endpoint replaces the AWS endpoint for both SQS and S3, to use a local
+	// stand-in such as ElasticMQ or LocalStack.
+	Endpoint string `json:"endpoint"`
+	// WaitTime is how long each receive waits for a message, up to 20s.
+	WaitTime Duration `json:"wait_time"`
+	// VisibilityTimeout is how long a received message is hidden from other
+	// receivers. It is extended while the message's jobs wait to print, and
+	// a message that fails is received again once it runs out.
+	VisibilityTimeout Duration `json:"visibility_timeout"`
+	// MaxMessages is how many messages are printed at once, up to 10.
+	MaxMessages int `json:"max_messages"`
+}
+
+func (c SQSConfig) validate() error {
+	if c.WaitTime < 0 || time.Duration(c.WaitTime) > SQSMaxWaitTime {
+		return fmt.Errorf("wait_time must be at most %s", SQSMaxWaitTime)
+	}
+	if time.Duration(c.VisibilityTimeout) < time.Second {
+		return errors.New("visibility_timeout must be at least 1s")
+	}
+	if c.MaxMessages < 1 || c.MaxMessages > SQSMaxMessages {
+		return fmt.Errorf("max_messages must be from 1 to %d", SQSMaxMessages)
+	}
+	return nil
+}
+
+// S3Object names an object in S3 holding a message's label.
+type S3Object struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+func (o S3Object) String() string {
+	return "s3://" + o.Bucket + "/" + o.Key
+}
+
+// SQSPrintMessage is the body of a print job message: a JSON print request
+// as for /print, with the label inline in image, at image_url or in S3. ID is
+// the sender's own reference for the job, returned in the result.
+type SQSPrintMessage struct {
+	ID string    `json:"id"`
+	S3 *S3Object `json:"s3"`
+	PrintRequestBody
+}
+
+// SQSPrintResult is posted to the reply queue for each message handled. A
+// message that failed because a printer was unavailable is received again,
+// so it can have several failed results with Retry set before the one that
+// completes.
+type SQSPrintResult struct {
+	ID           string      `json:"id,omitempty"`
+	MessageID    string      `json:"message_id"`
+	State        string      `json:"state"`
+	Retry        bool        `json:"retry,omitempty"`
+	ReceiveCount int         `json:"receive_count"`
+	Jobs         []JobStatus `json:"jobs,omitempty"`
+	ErrorCode    string      `json:"error_code,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// SQSPuller long-polls a queue for print job messages and prints them. A
+// message is deleted once every label in it has printed. One that failed
+// because a printer or the label's source was unavailable is left on the
+// queue and received again after its visibility timeout, so how often it is
+// retried is up to the queue's redrive policy. One that would fail the same
+// way every time is moved to the dead letter queue, or deleted.
+type SQSPuller struct {
+	SQSConfig
+
+	sqs    *sqs.SQS
+	s3     *s3.S3
+	logger zerolog.Logger
+}
+
+func newSQSPuller(awsSession *session.Session, sqsConfig SQSConfig) *SQSPuller {
+	awsConfig := aws.NewConfig()
+	if sqsConfig.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(sqsConfig.Endpoint).WithS3ForcePathStyle(true)
+	}
+
+	return &SQSPuller{
+		SQSConfig: sqsConfig,
+		sqs:       sqs.New(awsSession, awsConfig),
+		s3:        s3.New(awsSession, awsConfig),
+		logger:    log.With().Str("queue_url", sqsConfig.QueueURL).Logger(),
+	}
+}
+
+func (p *SQSPuller) Start(ctx context.Context) {
+	p.logger.Info().Msg("Pulling print jobs from SQS")
+
+	// Each message being printed holds a slot. As soon as one is free the
+	// queue is polled for as many messages as there are free slots, so a
+	// message waiting on a held job does not stop the others.
+	slots := make(chan struct{}, p.MaxMessages)
+	go func() {
+		for {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			free := 1
+		claim:
+			for free < p.MaxMessages {
+				select {
+				case slots <- struct{}{}:
+					free++
+				default:
+					break claim
+				}
+			}
+
+			messages, err := p.receive(ctx, free)
+			for range free - len(messages) {
+				<-slots
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				p.logger.Err(err).Msg("Cannot receive from SQS")
+				select {
+				case <-time.After(SQSRetryDelay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			for _, message := range messages {
+				go func() {
+					defer func() { <-slots }()
+					p.handle(ctx, message)
+				}()
+			}
+		}
+	}()
+}
+
+// receive waits for up to count messages.
+func (p *SQSPuller) receive(ctx context.Context, count int) ([]*sqs.Message, error) {
+	output, err := p.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(p.QueueURL),
+		MaxNumberOfMessages: aws.Int64(int64(count)),
+		WaitTimeSeconds:     aws.Int64(int64(time.Duration(p.WaitTime) / time.Second)),
+		VisibilityTimeout:   aws.Int64(int64(time.Duration(p.VisibilityTimeout) / time.Second)),
+		AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Messages, nil
+}
+
+// handle prints a message, keeping it hidden from other receivers until its
+// jobs have finished, then deletes it if they all printed, or it can never
+// print, and posts the result.
+func (p *SQSPuller) handle(ctx context.Context, message *sqs.Message) {
+	result := SQSPrintResult{MessageID: aws.StringValue(message.MessageId)}
+	result.ReceiveCount, _ = strconv.Atoi(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	logger := p.logger.With().Str("message_id", result.MessageID).Int("receive_count", result.ReceiveCount).Logger()
+
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	go p.heartbeat(heartbeatCtx, logger, message)
+	printJobs, err := p.print(ctx, logger, message, &result)
+	stopHeartbeat()
+	if ctx.Err() != nil {
+		return
+	}
+
+	result.Jobs = make([]JobStatus, len(printJobs))
+	for i, printJob := range printJobs {
+		result.Jobs[i] = printJob.Status()
+	}
+
+	switch {
+	case err == nil:
+		result.State = SQSResultCompleted
+		logger.Info().Int("Jobs", len(printJobs)).Msg("SQS print job printed")
+		p.delete(ctx, logger, message)
+	case sqsRetryable(err):
+		result.State = SQSResultFailed
+		result.Retry = true
+		result.ErrorCode, result.Error = sqsError(err)
+		logger.Err(err).Msg("SQS print job failed, leaving it to be retried")
+	default:
+		result.State = SQSResultFailed
+		result.ErrorCode, result.Error = sqsError(err)
+		logger.Err(err).Msg("SQS print job can never print, removing it from the queue")
+		if p.deadLetter(ctx, logger, message) {
+			p.delete(ctx, logger, message)
+		}
+	}
+
+	p.reply(ctx, logger, result)
+}
+
+// sqsRetryable reports whether a message that failed with err may print if
+// it is received again: a printer was unavailable, or the label could not
+// be fetched. Anything else, such as an invalid request or image, fails the
+// same way every time.
+func sqsRetryable(err error) bool {
+	var printErr *PrintError
+	if !errors.As(err, &printErr) {
+		return false
+	}
+	switch problemKinds[printErr.Code].Status {
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return true
+	}
+	return false
+}
+
+// sqsError is the error code and reason for a failed message's result.
+func sqsError(err error) (string, string) {
+	var printErr *PrintError
+	if errors.As(err, &printErr) {
+		return printErr.Code, printErr.Detail
+	}
+	return "", err.Error()
+}
+
+func (p *SQSPuller) delete(ctx context.Context, logger zerolog.Logger, message *sqs.Message) {
+	if _, err := p.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(p.QueueURL),
+		ReceiptHandle: message.ReceiptHandle,
+	}); err != nil {
+		logger.Err(err).Msg("Cannot delete SQS message")
+	}
+}
+
+// deadLetter copies a message to the dead letter queue, if there is one. It
+// reports whether the message can be deleted.
+func (p *SQSPuller) deadLetter(ctx context.Context, logger zerolog.Logger, message *sqs.Message) bool {
+	if p.DeadLetterQueueURL == "" {
+		return true
+	}
+
+	if _, err := p.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.DeadLetterQueueURL),
+		MessageBody: message.Body,
+	}); err != nil {
+		logger.Err(err).Msg("Cannot move SQS message to the dead letter queue")
+		return false
+	}
+	return true
+}
+
+// print reads the message's print request, queues its labels and waits for
+// them all to finish.
+func (p *SQSPuller) print(ctx context.Context, logger zerolog.Logger, message *sqs.Message, result *SQSPrintResult) ([]*PrintJob, error) {
+	var body SQSPrintMessage
+	if err := json.Unmarshal([]byte(aws.StringValue(message.Body)), &body); err != nil {
+		return nil, newPrintError(CodeInvalidRequest, err, "could not parse message body: %v", err)
+	}
+	result.ID = body.ID
+
+	printRequest, err := p.printRequest(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	defer removeUploads(logger, printRequest.Uploads)
+
+	labels, err := printRequest.labels(ctx, printRequest.Uploads[0])
+	if err != nil {
+		return nil, err
+	}
+	warnings, err := checkLabels(labels, printRequest.Strictness, printRequest.Printer, printRequest.PrintOptions)
+	if err != nil {
+		return nil, err
+	}
+	printJobs, err := queueLabels(logger.With().Str("sqs_id", body.ID).Logger(), labels, warnings, printRequest.Printer, printRequest.PrintOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, printJob := range printJobs {
+		select {
+		case <-printJob.done:
+		case <-ctx.Done():
+			return printJobs, ctx.Err()
+		}
+		if status := printJob.Status(); status.State != JobCompleted {
+			if err := printJob.Err(); err != nil {
+				return printJobs, err
+			}
+			return printJobs, fmt.Errorf("job %s was %s", status.ID, status.State)
+		}
+	}
+	return printJobs, nil
+}
+
+// printRequest reads a message into a print request, with the options it
+// leaves out set to their defaults, and saves its label.
+func (p *SQSPuller) printRequest(ctx context.Context, body SQSPrintMessage) (*PrintRequest, error) {
+	printRequest := &PrintRequest{
+		Strictness: config.PrintableAreaStrictness,
+		Options: PipelineOptions{
+			Rotate:    RotateAuto,
+			Threshold: DefaultThreshold,
+		},
+	}
+	printRequest.overlay(body.PrintRequestBody)
+	if err := printRequest.validate(); err != nil {
+		return nil, err
+	}
+
+	if body.S3 == nil {
+		return printRequest, printRequest.setImage(ctx, body.PrintRequestBody)
+	}
+	if body.Image != "" || body.ImageURL != "" {
+		return nil, newPrintError(CodeInvalidRequest, nil, "send one of image, image_url or s3")
+	}
+	upload, err := p.fetchS3Object(ctx, *body.S3)
+	if err != nil {
+		return nil, err
+	}
+	printRequest.Uploads = []*LabelImage{upload}
+	printRequest.SourceURL = body.S3.String()
+	return printRequest, nil
+}
+
+// fetchS3Object downloads a label from S3 into the upload directory.
+func (p *SQSPuller) fetchS3Object(ctx context.Context, object S3Object) (*LabelImage, error) {
+	if object.Bucket == "" || object.Key == "" {
+		return nil, newPrintError(CodeInvalidRequest, nil, "s3 needs a bucket and key")
+	}
+
+	output, err := p.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) {
+			return nil, newPrintError(CodeFetchFailed, err, "could not get %s: %s", object, awsErr.Code())
+		}
+		return nil, newPrintError(CodeFetchFailed, err, "could not get %s: %v", object, err)
+	}
+	defer output.Body.Close()
+
+	if aws.Int64Value(output.ContentLength) > MaxImageSize {
+		return nil, newPrintError(CodeFetchFailed, nil, "%s is larger than %dMB", object, MaxImageSize>>20)
+	}
+
+	upload, err := saveUpload(path.Base(object.Key), io.LimitReader(output.Body, MaxImageSize+1))
+	if err != nil {
+		return nil, newPrintError(CodeFetchFailed, err, "could not read %s", object)
+	}
+	if info, err := os.Stat(upload.File.Name()); err == nil && info.Size() > MaxImageSize {
+		upload.remove(log)
+		return nil, newPrintError(CodeFetchFailed, nil, "%s is larger than %dMB", object, MaxImageSize>>20)
+	}
+	return upload, nil
+}
+
+// heartbeat extends the message's visibility timeout at half of each
+// timeout until ctx is done, so a message waiting on a held job is not
+// received and printed again.
+func (p *SQSPuller) heartbeat(ctx context.Context, logger zerolog.Logger, message *sqs.Message) {
+	ticker := time.NewTicker(time.Duration(p.VisibilityTimeout) / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if _, err := p.sqs.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(p.QueueURL),
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(int64(time.Duration(p.VisibilityTimeout) / time.Second)),
+		}); err != nil && ctx.Err() == nil {
+			logger.Err(err).Msg("Cannot extend SQS message visibility")
+		}
+	}
+}
+
+// reply posts a message's result to the reply queue, if there is one.
+func (p *SQSPuller) reply(ctx context.Context, logger zerolog.Logger, result SQSPrintResult) {
+	if p.ReplyQueueURL == "" {
+		return
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		logger.Err(err).Msg("Cannot encode SQS print result")
+		return
+	}
+
+	if _, err := p.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.ReplyQueueURL),
+		MessageBody: aws.String(string(resultBytes)),
+	}); err != nil {
+		logger.Err(err).Msg("Cannot post SQS print result")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const StatusReadTimeout = 2 * time.Second
+
+// Status request and reply layout from the Brother QL raster command
+// reference: the reply is always 32 bytes and starts with 0x80 0x20.
+var (
+	statusRequest = append(append(make([]byte, 200), 0x1b, 0x40), 0x1b, 0x69, 0x53)
+
+	statusErrorInformation1 = []string{
+		"No media when printing",
+		"End of media",
+		"Tape cutter jam",
+		"",
+		"Main unit in use",
+		"Printer turned off",
+		"High-voltage adapter",
+		"Fan doesn't work",
+	}
+	statusErrorInformation2 = []string{
+		"Replace media error",
+		"Expansion buffer full error",
+		"Transmission / Communication error",
+		"Communication buffer full error",
+		"Cover opened while printing",
+		"Cancel key",
+		"Media cannot be fed",
+		"System error",
+	}
+)
+
+const (
+	MediaTypeNone       = ""
+	MediaTypeContinuous = "continuous"
+	MediaTypeDieCut     = "die-cut"
+)
+
+type PrinterStatus struct {
+	Online bool `json:"online"`
+	// MediaKnown is false when the printer is connected but the status
+	// could not be read, usually because brother_ql has detached the kernel
+	// usblp driver. The queue then assumes media is loaded.
+	MediaKnown    bool      `json:"media_known"`
+	MediaLoaded   bool      `json:"media_loaded"`
+	MediaType     string    `json:"media_type,omitempty"`
+	MediaWidthMM  int       `json:"media_width_mm,omitempty"`
+	MediaLengthMM int       `json:"media_length_mm,omitempty"`
+	Errors        []string  `json:"errors,omitempty"`
+	CheckedAt     time.Time `json:"checked_at"`
+}
+
+// HoldReason returns why jobs cannot be sent to the printer right now, or
+// an empty string if the printer is ready.
+func (s PrinterStatus) HoldReason() string {
+	if !s.Online {
+		return "printer offline"
+	}
+	if s.MediaKnown && !s.MediaLoaded {
+		return "no media loaded"
+	}
+	for _, statusError := range s.Errors {
+		switch statusError {
+		case "Tape cutter jam":
+			return "cutter jam"
+		case "Cover opened while printing":
+			return "cover open"
+		}
+	}
+	return ""
+}
+
+// readPrinterStatus checks that the printer is plugged in and, when the
+// kernel usblp driver is bound, asks it for its status.
+func readPrinterStatus(port string) (PrinterStatus, error) {
+	status := PrinterStatus{CheckedAt: time.Now()}
+
+	devicePath, err := findUSBDevice(port)
+	if err != nil || devicePath == "" {
+		return status, err
+	}
+	status.Online = true
+
+	lpPaths, _ := filepath.Glob(devicePath + ":*/usbmisc/lp*")
+	if len(lpPaths) == 0 {
+		return status, nil
+	}
+
+	reply, err := requestStatus(filepath.Join("/dev/usb", filepath.Base(lpPaths[0])))
+	if err != nil {
+		return status, err
+	}
+
+	status.MediaKnown = true
+	parseStatusReply(reply, &status)
+
+	return status, nil
+}
+
+func requestStatus(devicePath string) ([]byte, error) {
+	device, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open printer device: %w", err)
+	}
+	defer device.Close()
+
+	if _, err := device.Write(statusRequest); err != nil {
+		return nil, fmt.Errorf("could not request printer status: %w", err)
+	}
+
+	type result struct {
+		reply []byte
+		err   error
+	}
+	results := make(chan result, 1)
+
+	go func() {
+		reply := make([]byte, 32)
+		read := 0
+		for read < len(reply) {
+			n, err := device.Read(reply[read:])
+			read += n
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+		}
+		results <- result{reply: reply}
+	}()
+
+	select {
+	case r := <-results:
+		if r.err != nil {
+			return nil, fmt.Errorf("could not read printer status: %w", r.err)
+		}
+		return r.reply, nil
+	case <-time.After(StatusReadTimeout):
+		return nil, fmt.Errorf("timed out reading printer status from %s", devicePath)
+	}
+}
+
+func parseStatusReply(reply []byte, status *PrinterStatus) {
+	if len(reply) != 32 || reply[0] != 0x80 || reply[1] != 0x20 {
+		status.MediaKnown = false
+		return
+	}
+
+	for bit, name := range statusErrorInformation1 {
+		if name != "" && reply[8]&(1<<bit) != 0 {
+			status.Errors = append(status.Errors, name)
+		}
+	}
+	for bit, name := range statusErrorInformation2 {
+		if name != "" && reply[9]&(1<<bit) != 0 {
+			status.Errors = append(status.Errors, name)
+		}
+	}
+
+	status.MediaWidthMM = int(reply[10])
+	status.MediaLengthMM = int(reply[17])
+
+	switch reply[11] {
+	case 0x0a:
+		status.MediaType = MediaTypeContinuous
+	case 0x0b:
+		status.MediaType = MediaTypeDieCut
+	default:
+		status.MediaType = MediaTypeNone
+	}
+
+	status.MediaLoaded = status.MediaWidthMM > 0 && reply[8]&0b11 == 0
+}
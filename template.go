@@ -0,0 +1,781 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	ElementText      = "text"
+	ElementImage     = "image"
+	ElementBarcode   = "barcode"
+	ElementLine      = "line"
+	ElementRectangle = "rectangle"
+
+	// DefaultLineThicknessMM is the thickness of lines and rectangle
+	// outlines unless the element sets one.
+	DefaultLineThicknessMM = 0.5
+	// DefaultElementGapMM is the space between elements laid out top to
+	// bottom unless the template sets one.
+	DefaultElementGapMM = 2
+)
+
+var (
+	templateNamePattern     = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+	// templatesMu serialises saving templates so two saves of the same
+	// template cannot take the same version.
+	templatesMu sync.Mutex
+)
+
+// LabelTemplate is a label layout stored on the server by name and version.
+// Positions and sizes are in millimetres from the top left corner of the
+// printable area, after the template is rotated.
+type LabelTemplate struct {
+	Name      string            `json:"name"`
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	Format    string            `json:"format"`
+	Rotate    int               `json:"rotate,omitempty"`
+	Gap       *float64          `json:"gap,omitempty"`
+	Elements  []TemplateElement `json:"elements"`
+}
+
+// TemplateElement is one thing drawn on a template's label. Elements with
+// both x and y are drawn at that position. The rest flow from the top of
+// the label down, full width, in the order they are listed.
+type TemplateElement struct {
+	Type   string   `json:"type"`
+	X      *float64 `json:"x,omitempty"`
+	Y      *float64 `json:"y,omitempty"`
+	Width  float64  `json:"width,omitempty"`
+	Height float64  `json:"height,omitempty"`
+
+	// Text elements. Text may contain {{variables}}.
+	Text        string  `json:"text,omitempty"`
+	Font        string  `json:"font,omitempty"`
+	Size        float64 `json:"size,omitempty"`
+	MinSize     float64 `json:"min_size,omitempty"`
+	Align       string  `json:"align,omitempty"`
+	VAlign      string  `json:"valign,omitempty"`
+	LineSpacing float64 `json:"line_spacing,omitempty"`
+
+	// Barcode elements. Data may contain {{variables}}.
+	Data          string `json:"data,omitempty"`
+	Symbology     string `json:"symbology,omitempty"`
+	Module        int    `json:"module,omitempty"`
+	HumanReadable *bool  `json:"human_readable,omitempty"`
+
+	// Image elements hold a base64 encoded PNG or JPEG.
+	Image string `json:"image,omitempty"`
+
+	// Line and rectangle elements.
+	Thickness float64 `json:"thickness,omitempty"`
+	Fill      bool    `json:"fill,omitempty"`
+}
+
+func (e *TemplateElement) positioned() bool {
+	return e.X != nil && e.Y != nil
+}
+
+// validate checks a template before it is stored, so mistakes are reported
+// when it is saved rather than when it is first printed.
+func (t *LabelTemplate) validate() error {
+	if _, _, exists := findLabelFormat(t.Format); !exists {
+		return newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", t.Format)
+	}
+
+	switch t.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return newPrintError(CodeInvalidRequest, nil, "rotate must be 0, 90, 180 or 270, not %d", t.Rotate)
+	}
+
+	if len(t.Elements) == 0 {
+		return newPrintError(CodeInvalidRequest, nil, "template has no elements")
+	}
+
+	for i, element := range t.Elements {
+		if err := element.validate(); err != nil {
+			return newPrintError(CodeInvalidRequest, err, "element %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (e *TemplateElement) validate() error {
+	if (e.X == nil) != (e.Y == nil) {
+		return errors.New("x and y must be set together")
+	}
+	if e.positioned() && (e.Width <= 0 || e.Height <= 0) {
+		return errors.New("elements with a position need a width and height")
+	}
+	if e.Width < 0 || e.Height < 0 || e.Thickness < 0 {
+		return errors.New("sizes must not be negative")
+	}
+
+	switch e.Type {
+	case ElementText:
+		if strings.TrimSpace(e.Text) == "" {
+			return errors.New("text elements need text")
+		}
+		if !(e.Size >= 0 && e.Size <= MaxFontSize) || !(e.MinSize >= 0 && e.MinSize <= MaxFontSize) {
+			return fmt.Errorf("size and min_size must be positive numbers of points up to %d", MaxFontSize)
+		}
+		if e.Font != "" {
+			if _, err := findFont(e.Font); err != nil {
+				return err
+			}
+		}
+		switch e.Align {
+		case "", AlignLeft, AlignCenter, AlignRight:
+		default:
+			return fmt.Errorf("align must be left, center or right, not '%s'", e.Align)
+		}
+		switch e.VAlign {
+		case "", VAlignTop, VAlignMiddle, VAlignBottom:
+		default:
+			return fmt.Errorf("valign must be top, middle or bottom, not '%s'", e.VAlign)
+		}
+	case ElementBarcode:
+		if e.Data == "" {
+			return errors.New("barcode elements need data")
+		}
+		if _, exists := symbologies[e.Symbology]; e.Symbology != "" && !exists {
+			return fmt.Errorf("symbology must be one of %s, not '%s'", strings.Join(symbologyNames(), ", "), e.Symbology)
+		}
+	case ElementImage:
+		if _, err := e.decodeImage(); err != nil {
+			return err
+		}
+	case ElementLine, ElementRectangle:
+	default:
+		return fmt.Errorf("type must be text, image, barcode, line or rectangle, not '%s'", e.Type)
+	}
+	return nil
+}
+
+func (e *TemplateElement) decodeImage() (image.Image, error) {
+	imageBytes, err := base64.StdEncoding.DecodeString(e.Image)
+	if err != nil {
+		return nil, fmt.Errorf("image is not valid base64: %w", err)
+	}
+	img, err := decodeImage(bytes.NewReader(imageBytes))
+	if errors.Is(err, errImageTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("image is not a PNG or JPEG: %w", err)
+	}
+	return img, nil
+}
+
+// substituteVariables replaces each {{variable}} with its value from data.
+func substituteVariables(text string, data map[string]string) (string, error) {
+	var missing []string
+	result := templateVariablePattern.ReplaceAllStringFunc(text, func(match string) string {
+		name := templateVariablePattern.FindStringSubmatch(match)[1]
+		value, exists := data[name]
+		if !exists {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", newPrintError(CodeInvalidRequest, nil, "no value for template variables %s", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+func mmToDots(mm float64) int {
+	return int(mm*DotsPerMM + 0.5)
+}
+
+// textOptions are the text element's options with its variables filled in.
+func (e *TemplateElement) textOptions(data map[string]string) (TextOptions, error) {
+	text, err := substituteVariables(e.Text, data)
+	if err != nil {
+		return TextOptions{}, err
+	}
+
+	options := TextOptions{
+		Text:        text,
+		Align:       AlignCenter,
+		VAlign:      VAlignMiddle,
+		Font:        DefaultFontName,
+		MaxSize:     DefaultMaxFontSize,
+		MinSize:     DefaultMinFontSize,
+		LineSpacing: 1,
+	}
+	if e.Align != "" {
+		options.Align = e.Align
+	}
+	if e.VAlign != "" {
+		options.VAlign = e.VAlign
+	}
+	if e.Font != "" {
+		options.Font = e.Font
+	}
+	if e.Size > 0 {
+		options.MaxSize = min(e.Size, MaxFontSize)
+		options.MinSize = min(options.MinSize, options.MaxSize)
+	}
+	if e.MinSize > 0 && e.MinSize <= options.MaxSize {
+		options.MinSize = e.MinSize
+	}
+	if e.LineSpacing > 0 {
+		options.LineSpacing = e.LineSpacing
+	}
+	return options, nil
+}
+
+// barcodeOptions are the barcode element's options with its variables
+// filled in.
+func (e *TemplateElement) barcodeOptions(data map[string]string) (*BarcodeOptions, error) {
+	barcodeData, err := substituteVariables(e.Data, data)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &BarcodeOptions{
+		Symbology:     e.Symbology,
+		Data:          barcodeData,
+		Module:        e.Module,
+		HeightMM:      DefaultBarHeightMM,
+		HumanReadable: e.HumanReadable == nil || *e.HumanReadable,
+	}
+	if options.Symbology == "" {
+		options.Symbology = SymbologyCode128
+	}
+	if e.Height > 0 {
+		options.HeightMM = e.Height
+	}
+	return options, nil
+}
+
+// flowHeight is the height in dots an element without a position takes in
+// the flow, or -1 if it shares the space left over with the other elements
+// that have no natural height.
+func (e *TemplateElement) flowHeight(data map[string]string, width, height int) (int, error) {
+	if e.Height > 0 {
+		return mmToDots(e.Height), nil
+	}
+
+	switch e.Type {
+	case ElementLine:
+		return e.thickness(), nil
+	case ElementBarcode:
+		options, err := e.barcodeOptions(data)
+		if err != nil {
+			return 0, err
+		}
+		if symbologies[options.Symbology].TwoDimensional {
+			return -1, nil
+		}
+		layout, err := layoutBarcode(options, width, height)
+		if err != nil {
+			return 0, err
+		}
+		return layout.Size.Y, nil
+	case ElementImage:
+		img, err := e.decodeImage()
+		if err != nil {
+			return 0, newPrintError(CodeInvalidImage, err, "%v", err)
+		}
+		bounds := img.Bounds()
+		return min(height, bounds.Dy()*width/bounds.Dx()), nil
+	}
+	return -1, nil
+}
+
+func (e *TemplateElement) thickness() int {
+	if e.Thickness > 0 {
+		return max(1, mmToDots(e.Thickness))
+	}
+	return mmToDots(DefaultLineThicknessMM)
+}
+
+// layout places each element in a box of the given size, in dots.
+func (t *LabelTemplate) layout(data map[string]string, width, height int) ([]image.Rectangle, error) {
+	boxes := make([]image.Rectangle, len(t.Elements))
+	bounds := image.Rect(0, 0, width, height)
+
+	gap := mmToDots(DefaultElementGapMM)
+	if t.Gap != nil {
+		gap = mmToDots(*t.Gap)
+	}
+
+	var flow []int
+	heights := make([]int, len(t.Elements))
+	fixedHeight, flexible := 0, 0
+	for i := range t.Elements {
+		element := &t.Elements[i]
+		if element.positioned() {
+			x, y := mmToDots(*element.X), mmToDots(*element.Y)
+			boxes[i] = image.Rect(x, y, x+mmToDots(element.Width), y+mmToDots(element.Height))
+			if !boxes[i].In(bounds) {
+				return nil, newPrintError(CodeOutsidePrintableArea, nil, "element %d is outside the printable area of label format '%s'", i, t.Format)
+			}
+			continue
+		}
+
+		flowHeight, err := element.flowHeight(data, width, height)
+		if err != nil {
+			return nil, err
+		}
+		heights[i] = flowHeight
+		if flowHeight < 0 {
+			flexible++
+		} else {
+			fixedHeight += flowHeight
+		}
+		flow = append(flow, i)
+	}
+
+	if len(flow) == 0 {
+		return boxes, nil
+	}
+
+	spare := height - fixedHeight - gap*(len(flow)-1)
+	if spare < 0 || (flexible > 0 && spare/flexible < 1) {
+		return nil, newPrintError(CodeOutsidePrintableArea, nil, "the elements of template '%s' are too tall for the printable area of label format '%s'", t.Name, t.Format)
+	}
+
+	top := 0
+	for _, i := range flow {
+		elementHeight := heights[i]
+		if elementHeight < 0 {
+			elementHeight = spare / flexible
+		}
+		boxes[i] = image.Rect(0, top, width, top+elementHeight)
+		top += elementHeight + gap
+	}
+	return boxes, nil
+}
+
+// variables lists the names of the template's variables in the order they
+// first appear.
+func (t *LabelTemplate) variables() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, element := range t.Elements {
+		for _, field := range []string{element.Text, element.Data} {
+			for _, match := range templateVariablePattern.FindAllStringSubmatch(field, -1) {
+				if !seen[match[1]] {
+					seen[match[1]] = true
+					names = append(names, match[1])
+				}
+			}
+		}
+	}
+	return names
+}
+
+// checkData reports every variable the data has no value for at once,
+// rather than one at a time as elements are drawn.
+func (t *LabelTemplate) checkData(data map[string]string) error {
+	var missing []string
+	for _, name := range t.variables() {
+		if _, exists := data[name]; !exists {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return newPrintError(CodeInvalidRequest, nil, "no value for template variables %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// render draws the template with its variables filled in from data.
+func (t *LabelTemplate) render(format LabelFormat, dimensions LabelDimensions, data map[string]string) (*RenderedLabel, error) {
+	if err := t.checkData(data); err != nil {
+		return nil, err
+	}
+
+	return renderPrintableArea(format, dimensions, t.Rotate, func(width, height int) (*image.RGBA, error) {
+		boxes, err := t.layout(data, width, height)
+		if err != nil {
+			return nil, err
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+		for i := range t.Elements {
+			if err := t.Elements[i].draw(img, boxes[i], data); err != nil {
+				return nil, err
+			}
+		}
+		return img, nil
+	})
+}
+
+// draw draws the element in its box.
+func (e *TemplateElement) draw(img *image.RGBA, box image.Rectangle, data map[string]string) error {
+	black := &image.Uniform{color.Black}
+
+	switch e.Type {
+	case ElementText:
+		options, err := e.textOptions(data)
+		if err != nil {
+			return err
+		}
+		primary, err := findFont(options.Font)
+		if err != nil {
+			return err
+		}
+		layout, err := fitText(primary, options, box.Dx(), box.Dy())
+		if err != nil {
+			return err
+		}
+		draw.Draw(img, box, layout.render(options, box.Dx(), box.Dy()), image.Point{}, draw.Over)
+
+	case ElementBarcode:
+		options, err := e.barcodeOptions(data)
+		if err != nil {
+			return err
+		}
+		layout, err := layoutBarcode(options, box.Dx(), box.Dy())
+		if err != nil {
+			return err
+		}
+		layout.draw(img, box.Min.Add(image.Pt((box.Dx()-layout.Size.X)/2, (box.Dy()-layout.Size.Y)/2)))
+
+	case ElementImage:
+		src, err := e.decodeImage()
+		if err != nil {
+			return newPrintError(CodeInvalidImage, err, "%v", err)
+		}
+		fitted := fitImage(flattenImage(src), LabelDimensions{X: box.Dx(), Y: box.Dy()})
+		draw.Draw(img, box, fitted, image.Point{}, draw.Src)
+
+	case ElementLine:
+		thickness := e.thickness()
+		var line image.Rectangle
+		if box.Dx() >= box.Dy() {
+			middle := box.Min.Y + (box.Dy()-thickness)/2
+			line = image.Rect(box.Min.X, middle, box.Max.X, middle+thickness)
+		} else {
+			middle := box.Min.X + (box.Dx()-thickness)/2
+			line = image.Rect(middle, box.Min.Y, middle+thickness, box.Max.Y)
+		}
+		draw.Draw(img, line, black, image.Point{}, draw.Src)
+
+	case ElementRectangle:
+		if e.Fill {
+			draw.Draw(img, box, black, image.Point{}, draw.Src)
+		} else {
+			drawOutline(img, box, e.thickness(), color.RGBA{A: 0xff})
+		}
+	}
+	return nil
+}
+
+func templateDirectory(name string) string {
+	return filepath.Join(config.TemplateDirectory, name)
+}
+
+// templateVersions lists the stored versions of a template, oldest first.
+func templateVersions(name string) ([]int, error) {
+	entries, err := os.ReadDir(templateDirectory(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not read versions of template '%s'", name)
+	}
+
+	var versions []int
+	for _, entry := range entries {
+		version, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// loadTemplate reads a version of a template, or its latest version if
+// version is 0.
+func loadTemplate(name string, version int) (*LabelTemplate, error) {
+	if !templateNamePattern.MatchString(name) {
+		return nil, newPrintError(CodeUnknownTemplate, nil, "no template is named '%s'", name)
+	}
+
+	if version == 0 {
+		versions, err := templateVersions(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return nil, newPrintError(CodeUnknownTemplate, nil, "no template is named '%s'", name)
+		}
+		version = versions[len(versions)-1]
+	}
+
+	templateBytes, err := os.ReadFile(filepath.Join(templateDirectory(name), fmt.Sprintf("%d.json", version)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, newPrintError(CodeUnknownTemplate, nil, "template '%s' has no version %d", name, version)
+	}
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not read template '%s'", name)
+	}
+
+	var template LabelTemplate
+	if err := json.Unmarshal(templateBytes, &template); err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not parse template '%s' version %d", name, version)
+	}
+	return &template, nil
+}
+
+// saveTemplate stores the template as the next version of its name. The
+// file is written under a temporary name and renamed so a template is never
+// read half written.
+func saveTemplate(template *LabelTemplate) error {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+
+	versions, err := templateVersions(template.Name)
+	if err != nil {
+		return err
+	}
+	template.Version = 1
+	if len(versions) > 0 {
+		template.Version = versions[len(versions)-1] + 1
+	}
+	template.CreatedAt = time.Now().UTC()
+
+	directory := templateDirectory(template.Name)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return newPrintError(CodeInternal, err, "could not create template directory")
+	}
+
+	templateBytes, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return newPrintError(CodeInternal, err, "could not encode template")
+	}
+
+	path := filepath.Join(directory, fmt.Sprintf("%d.json", template.Version))
+	if err := os.WriteFile(path+".tmp", templateBytes, 0644); err != nil {
+		return newPrintError(CodeInternal, err, "could not write template")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return newPrintError(CodeInternal, err, "could not write template")
+	}
+	return nil
+}
+
+// TemplateSummary lists a stored template's versions.
+type TemplateSummary struct {
+	Name          string `json:"name"`
+	LatestVersion int    `json:"latest_version"`
+	Versions      []int  `json:"versions"`
+}
+
+func listTemplates() ([]TemplateSummary, error) {
+	entries, err := os.ReadDir(config.TemplateDirectory)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []TemplateSummary{}, nil
+	}
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not read template directory")
+	}
+
+	summaries := []TemplateSummary{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !templateNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		versions, err := templateVersions(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		summaries = append(summaries, TemplateSummary{
+			Name:          entry.Name(),
+			LatestVersion: versions[len(versions)-1],
+			Versions:      versions,
+		})
+	}
+	return summaries, nil
+}
+
+// TemplatePrintRequest is the body of a request to print a template.
+type TemplatePrintRequest struct {
+	// Version is the template version to print, or 0 for the latest.
+	Version int `json:"version"`
+	// Format overrides the template's label format.
+	Format string         `json:"format"`
+	Data   map[string]any `json:"data"`
+}
+
+// templateData turns the data payload's values into the strings that are
+// substituted for variables. Numbers are decoded as json.Number so they are
+// substituted as they were written, not as 1.2345678e+07.
+func templateData(payload map[string]any) map[string]string {
+	data := make(map[string]string, len(payload))
+	for name, value := range payload {
+		switch value := value.(type) {
+		case string:
+			data[name] = value
+		case json.Number:
+			data[name] = value.String()
+		case float64:
+			data[name] = strconv.FormatFloat(value, 'f', -1, 64)
+		case nil:
+			data[name] = ""
+		default:
+			data[name] = fmt.Sprint(value)
+		}
+	}
+	return data
+}
+
+// MaxJSONBodySize limits the size of a JSON request body. Base64 takes four
+// bytes for every three, so it fits an image of MaxImageSize and the rest of
+// the body.
+const MaxJSONBodySize = MaxImageSize/3*4 + 64<<10
+
+func decodeJSONBody(req *http.Request, v any) error {
+	req.Body = http.MaxBytesReader(nil, req.Body, MaxJSONBodySize)
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return newPrintError(CodeInvalidRequest, err, "request body should be fewer than %dMB", MaxJSONBodySize>>20)
+		}
+		return newPrintError(CodeInvalidRequest, err, "could not parse request body: %v", err)
+	}
+	return nil
+}
+
+func templates(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		summaries, err := listTemplates()
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		writeJSON(rw, req, summaries)
+	}
+}
+
+func labelTemplate(rw http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+
+	switch req.Method {
+	case http.MethodGet:
+		version := 0
+		if versionValue := req.FormValue("version"); versionValue != "" {
+			var err error
+			version, err = strconv.Atoi(versionValue)
+			if err != nil || version < 1 {
+				writeProblem(rw, req, newPrintError(CodeInvalidRequest, err, "version must be a whole number from 1"))
+				return
+			}
+		}
+
+		template, err := loadTemplate(name, version)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		writeJSON(rw, req, template)
+
+	case http.MethodPost, http.MethodPut:
+		if !templateNamePattern.MatchString(name) {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "template names may only contain letters, digits, '-' and '_'"))
+			return
+		}
+
+		var template LabelTemplate
+		if err := decodeJSONBody(req, &template); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		template.Name = name
+
+		if err := template.validate(); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		if err := saveTemplate(&template); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		hlog.FromRequest(req).Info().
+			Str("Template", template.Name).
+			Int("Version", template.Version).
+			Msg("Saved template")
+
+		rw.Header().Set("Location", fmt.Sprintf("/templates/%s?version=%d", template.Name, template.Version))
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		writeJSON(rw, req, template)
+	}
+}
+
+func templatePrint(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		var printRequest TemplatePrintRequest
+		if req.ContentLength != 0 {
+			if err := decodeJSONBody(req, &printRequest); err != nil {
+				writeProblem(rw, req, err)
+				return
+			}
+		}
+
+		template, err := loadTemplate(req.PathValue("name"), printRequest.Version)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		formatName := template.Format
+		if printRequest.Format != "" {
+			formatName = printRequest.Format
+		}
+		format, dimensions, exists := findLabelFormat(formatName)
+		if !exists {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", formatName))
+			return
+		}
+
+		label, err := template.render(format, dimensions, templateData(printRequest.Data))
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		respondWithLabel(rw, req, label)
+	}
+}
@@ -0,0 +1,39 @@
+#!/usr/bin/env python3
+"""Regenerates the raster fixtures raster_test.go compares against.
+
+Run from this directory with brother_ql and Pillow installed:
+
+    pip install brother_ql
+    python3 generate.py
+
+The label pattern must match testPattern in raster_test.go.
+"""
+import gzip
+
+from PIL import Image
+from brother_ql.conversion import convert
+from brother_ql.raster import BrotherQLRaster
+
+
+def black(x, y, w, h):
+    return (x < 4 or y < 4 or x >= w - 4 or y >= h - 4 or (x < 120 and y < 60) or x == y
+            or ((x // 16 + y // 16) % 2 == 0 and h // 2 <= y < h // 2 + 64))
+
+
+def label(w, h):
+    im = Image.new('RGB', (w, h), (255, 255, 255))
+    for y in range(h):
+        for x in range(w):
+            if black(x, y, w, h):
+                im.putpixel((x, y), (0, 0, 0))
+    return im
+
+
+for name, model, w, h, compress in [
+    ('62x100', 'QL-500', 696, 1109, False),
+    ('102x152', 'QL-1060N', 1164, 1660, True),
+]:
+    qlr = BrotherQLRaster(model)
+    convert(qlr, [label(w, h)], name, cut=True, dither=False, compress=compress, red=False, rotate='0', dpi_600=False, hq=True)
+    with gzip.GzipFile('%s-%s.bin.gz' % (name, model), 'wb', mtime=0) as f:
+        f.write(qlr.data)
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"golang.org/x/image/font"
+)
+
+// Version is the server version printed on test pages. Release builds set
+// it with -ldflags "-X main.Version=<version>".
+var Version = "dev"
+
+const DotsPerMM = PrinterDPI / 25.4
+
+// loadedFormat picks the format to print a test page on: the one named in
+// the request, or the one matching the media the printer reports, or the
+// first format the printer is set up for.
+func loadedFormat(req *http.Request, queue *PrintQueue) (LabelFormat, LabelDimensions, error) {
+	if formatName := req.FormValue("format"); formatName != "" {
+		format, dimensions, exists := findLabelFormat(formatName)
+		if !exists {
+			return format, dimensions, newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", formatName)
+		}
+		return format, dimensions, nil
+	}
+
+	formatNames := printerFormats(queue.Printer.Name)
+
+	status := queue.Status()
+	if status.MediaKnown {
+		for _, formatName := range formatNames {
+			format, dimensions, _ := findLabelFormat(formatName)
+			if format.WidthMM == status.MediaWidthMM && format.LengthMM == status.MediaLengthMM {
+				return format, dimensions, nil
+			}
+		}
+	}
+
+	if len(formatNames) == 0 {
+		return LabelFormat{}, LabelDimensions{}, newPrintError(CodeInvalidRequest, nil, "printer '%s' is not set up for any label format", queue.Printer.Name)
+	}
+
+	format, dimensions, _ := findLabelFormat(formatNames[0])
+	return format, dimensions, nil
+}
+
+// renderTestPage draws a calibration label: a border on the edge of the
+// printable area, millimetre rulers along it, a greyscale ramp and details
+// of the printer and server.
+func renderTestPage(printer Printer, format LabelFormat, dimensions LabelDimensions, printedAt time.Time) (*RenderedLabel, error) {
+	img := image.NewRGBA(image.Rect(0, 0, dimensions.X, dimensions.Y))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	printable := image.Rect(format.Margins.Left, format.Margins.Top, dimensions.X-format.Margins.Right, dimensions.Y-format.Margins.Bottom)
+	drawOutline(img, printable, 3, color.RGBA{A: 0xff})
+
+	rulerFace, err := newFace(regularFont, 6)
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not draw the test page")
+	}
+	drawRulers(img, printable, rulerFace)
+
+	center := image.Pt((printable.Min.X+printable.Max.X)/2, (printable.Min.Y+printable.Max.Y)/2)
+	black := &image.Uniform{color.Black}
+	draw.Draw(img, image.Rect(center.X-60, center.Y-1, center.X+60, center.Y+2), black, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(center.X-1, center.Y-60, center.X+2, center.Y+60), black, image.Point{}, draw.Src)
+
+	titleFace, err := newFace(boldFont, 12)
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not draw the test page")
+	}
+	bodyFace, err := newFace(regularFont, 8)
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not draw the test page")
+	}
+
+	serial := printer.Serial
+	if serial == "" {
+		serial = "unknown"
+	}
+
+	left := printable.Min.X + 90
+	y := printable.Min.Y + 130
+	drawText(img, titleFace, left, y, "Test page")
+	y += 80
+
+	for _, line := range []string{
+		fmt.Sprintf("Printer: %s", printer.Name),
+		fmt.Sprintf("Model: %s", printer.Model),
+		fmt.Sprintf("Serial: %s", serial),
+		fmt.Sprintf("Label: %s %s", format.Name, format.Type),
+		fmt.Sprintf("Server: %s %s", ServiceName, Version),
+		fmt.Sprintf("Printed: %s", printedAt.Format(time.RFC3339)),
+	} {
+		drawText(img, bodyFace, left, y, line)
+		y += 50
+	}
+
+	rampTop := max(y, center.Y+90)
+	drawGreyscaleRamp(img, image.Rect(left, rampTop, printable.Max.X-90, rampTop+120))
+
+	return renderLabel(img, format, dimensions, PipelineOptions{
+		Rotate:    "0",
+		Dither:    true,
+		Threshold: DefaultThreshold,
+	})
+}
+
+// drawRulers draws millimetre ticks inside the top and left edges of the
+// area, longer every 5 mm and numbered every 10 mm, in the face.
+func drawRulers(img *image.RGBA, area image.Rectangle, face font.Face) {
+	black := &image.Uniform{color.Black}
+
+	for mm := 1; float64(mm)*DotsPerMM < float64(area.Dx()); mm++ {
+		x := area.Min.X + int(float64(mm)*DotsPerMM)
+		length := rulerTickLength(mm)
+		draw.Draw(img, image.Rect(x, area.Min.Y, x+2, area.Min.Y+length), black, image.Point{}, draw.Src)
+		if mm%10 == 0 {
+			label := fmt.Sprint(mm)
+			drawText(img, face, x-textWidth(face, label)/2, area.Min.Y+length+30, label)
+		}
+	}
+
+	for mm := 1; float64(mm)*DotsPerMM < float64(area.Dy()); mm++ {
+		y := area.Min.Y + int(float64(mm)*DotsPerMM)
+		length := rulerTickLength(mm)
+		draw.Draw(img, image.Rect(area.Min.X, y, area.Min.X+length, y+2), black, image.Point{}, draw.Src)
+		if mm%10 == 0 {
+			drawText(img, face, area.Min.X+length+6, y+10, fmt.Sprint(mm))
+		}
+	}
+}
+
+func rulerTickLength(mm int) int {
+	switch {
+	case mm%10 == 0:
+		return 40
+	case mm%5 == 0:
+		return 28
+	default:
+		return 16
+	}
+}
+
+// drawGreyscaleRamp fills the area with eleven steps from white to black,
+// which show up banded or patchy when the print head is failing.
+func drawGreyscaleRamp(img *image.RGBA, area image.Rectangle) {
+	const steps = 11
+	stepWidth := area.Dx() / steps
+
+	for step := 0; step < steps; step++ {
+		grey := uint8(255 - step*255/(steps-1))
+		r := image.Rect(area.Min.X+step*stepWidth, area.Min.Y, area.Min.X+(step+1)*stepWidth, area.Max.Y)
+		draw.Draw(img, r, &image.Uniform{color.Gray{Y: grey}}, image.Point{}, draw.Src)
+	}
+	drawOutline(img, image.Rect(area.Min.X, area.Min.Y, area.Min.X+steps*stepWidth, area.Max.Y), 2, color.RGBA{A: 0xff})
+}
+
+func testPage(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		name := req.PathValue("name")
+		queue := printQueue(name)
+		if queue == nil {
+			writeProblem(rw, req, newPrintError(CodeUnknownPrinter, nil, "no printer is named '%s'", name))
+			return
+		}
+
+		format, dimensions, err := loadedFormat(req, queue)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		label, err := renderTestPage(queue.Printer, format, dimensions, time.Now())
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		printJob := newPrintJob(hlog.FromRequest(req).With().Logger(), format.Name)
+		if err := label.save(printJob.FilePath); err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		if err := labelPrinters[format.Name].SubmitTo(printJob, name); err != nil {
+			printJob.finish(JobFailed, err)
+			writeProblem(rw, req, err)
+			return
+		}
+
+		awaitJob(rw, req, printJob)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	AlignLeft   = "left"
+	AlignCenter = "center"
+	AlignRight  = "right"
+
+	VAlignTop    = "top"
+	VAlignMiddle = "middle"
+	VAlignBottom = "bottom"
+
+	DefaultMaxFontSize = 96
+	DefaultMinFontSize = 6
+	// MaxFontSize is the largest text is drawn, about the height of the
+	// largest label, 152 mm, in points.
+	MaxFontSize = 432
+	// fontSizeStep is the precision, in points, the font is shrunk to fit.
+	fontSizeStep = 0.5
+)
+
+// TextOptions control how text is laid out on a text label. They are read
+// from the request's form values or query.
+type TextOptions struct {
+	Text        string
+	Align       string
+	VAlign      string
+	Rotate      int
+	Font        string
+	MaxSize     float64
+	MinSize     float64
+	LineSpacing float64
+	// Barcode is drawn under the text if set.
+	Barcode *BarcodeOptions
+}
+
+func parseTextOptions(req *http.Request) (TextOptions, error) {
+	options := TextOptions{
+		Text:        strings.ReplaceAll(req.FormValue("text"), "\r\n", "\n"),
+		Align:       AlignCenter,
+		VAlign:      VAlignMiddle,
+		Font:        DefaultFontName,
+		MaxSize:     DefaultMaxFontSize,
+		MinSize:     DefaultMinFontSize,
+		LineSpacing: 1,
+	}
+
+	if strings.TrimSpace(options.Text) == "" {
+		return options, newPrintError(CodeInvalidRequest, nil, "text is required")
+	}
+
+	if align := req.FormValue("align"); align != "" {
+		switch align {
+		case AlignLeft, AlignCenter, AlignRight:
+			options.Align = align
+		default:
+			return options, newPrintError(CodeInvalidRequest, nil, "align must be left, center or right, not '%s'", align)
+		}
+	}
+
+	if valign := req.FormValue("valign"); valign != "" {
+		switch valign {
+		case VAlignTop, VAlignMiddle, VAlignBottom:
+			options.VAlign = valign
+		default:
+			return options, newPrintError(CodeInvalidRequest, nil, "valign must be top, middle or bottom, not '%s'", valign)
+		}
+	}
+
+	rotate, err := parseRightAngle(req)
+	if err != nil {
+		return options, err
+	}
+	options.Rotate = rotate
+
+	if fontName := req.FormValue("font"); fontName != "" {
+		options.Font = fontName
+	}
+
+	if size := req.FormValue("size"); size != "" {
+		value, err := strconv.ParseFloat(size, 64)
+		if err != nil || !(value > 0 && value <= MaxFontSize) {
+			return options, newPrintError(CodeInvalidRequest, err, "size must be a positive number of points up to %d", MaxFontSize)
+		}
+		options.MaxSize = value
+		options.MinSize = min(options.MinSize, value)
+	}
+
+	if minSize := req.FormValue("min_size"); minSize != "" {
+		value, err := strconv.ParseFloat(minSize, 64)
+		if err != nil || !(value > 0 && value <= options.MaxSize) {
+			return options, newPrintError(CodeInvalidRequest, err, "min_size must be a positive number of points no larger than size")
+		}
+		options.MinSize = value
+	}
+
+	if lineSpacing := req.FormValue("line_spacing"); lineSpacing != "" {
+		value, err := strconv.ParseFloat(lineSpacing, 64)
+		if err != nil || !(value >= 0.5 && value <= 3) {
+			return options, newPrintError(CodeInvalidRequest, err, "line_spacing must be a number from 0.5 to 3")
+		}
+		options.LineSpacing = value
+	}
+
+	options.Barcode, err = parseBarcodeOptions(req, "barcode")
+	if err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+// textFaces draws text in one font, falling back to the default font and
+// then the installed fonts, by name, for any character it has no glyph for.
+// Faces are only created for the fonts that are needed.
+type textFaces struct {
+	fonts []*opentype.Font
+	faces []font.Face
+	// indexes are the fallback fonts in use, by name.
+	indexes map[string]int
+	size    float64
+	buf     sfnt.Buffer
+}
+
+func newTextFaces(primary *opentype.Font, size float64) (*textFaces, error) {
+	face, err := newFace(primary, size)
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "could not draw text at %gpt", size)
+	}
+	return &textFaces{
+		fonts:   []*opentype.Font{primary},
+		faces:   []font.Face{face},
+		indexes: map[string]int{},
+		size:    size,
+	}, nil
+}
+
+func (t *textFaces) face(index int) font.Face {
+	return t.faces[index]
+}
+
+// faceIndex returns the index of the first font with a glyph for the rune,
+// or the primary font if none has one.
+func (t *textFaces) faceIndex(r rune) int {
+	if unicode.IsSpace(r) || !unicode.IsPrint(r) || t.hasGlyph(t.fonts[0], r) {
+		return 0
+	}
+
+	if index, ok := t.fallback(DefaultFontName); ok && t.hasGlyph(t.fonts[index], r) {
+		return index
+	}
+	if name := fallbackFont(r); name != "" {
+		if index, ok := t.fallback(name); ok {
+			return index
+		}
+	}
+	return 0
+}
+
+func (t *textFaces) hasGlyph(f *opentype.Font, r rune) bool {
+	glyph, err := f.GlyphIndex(&t.buf, r)
+	return err == nil && glyph != 0
+}
+
+// fallback returns the index of a fallback font, adding it the first time
+// it is used. Fonts that cannot be used are skipped.
+func (t *textFaces) fallback(name string) (int, bool) {
+	if index, exists := t.indexes[name]; exists {
+		return index, index >= 0
+	}
+
+	t.indexes[name] = -1
+	loaded, err := findFont(name)
+	if err != nil {
+		log.Warn().Err(err).Str("font", name).Msg("Skipping fallback font")
+		return -1, false
+	}
+	face, err := newFace(loaded, t.size)
+	if err != nil {
+		log.Warn().Err(err).Str("font", name).Msg("Skipping fallback font")
+		return -1, false
+	}
+
+	t.fonts = append(t.fonts, loaded)
+	t.faces = append(t.faces, face)
+	t.indexes[name] = len(t.fonts) - 1
+	return len(t.fonts) - 1, true
+}
+
+// runs splits text into pieces drawn with the same face.
+func (t *textFaces) runs(text string, fn func(face font.Face, run string)) {
+	start, current := 0, -1
+	for i, r := range text {
+		index := t.faceIndex(r)
+		if current >= 0 && index != current {
+			fn(t.face(current), text[start:i])
+			start = i
+		}
+		current = index
+	}
+	if current >= 0 {
+		fn(t.face(current), text[start:])
+	}
+}
+
+func (t *textFaces) width(text string) fixed.Int26_6 {
+	var width fixed.Int26_6
+	t.runs(text, func(face font.Face, run string) {
+		width += font.MeasureString(face, run)
+	})
+	return width
+}
+
+func (t *textFaces) draw(dst draw.Image, dot fixed.Point26_6, text string) {
+	t.runs(text, func(face font.Face, run string) {
+		drawer := font.Drawer{
+			Dst:  dst,
+			Src:  image.Black,
+			Face: face,
+			Dot:  dot,
+		}
+		drawer.DrawString(run)
+		dot = drawer.Dot
+	})
+}
+
+// wrapText breaks each paragraph of the text into lines no wider than the
+// width. Words too long for a line on their own are split between
+// characters if breakWords is set, otherwise wrapText reports that the text
+// does not fit.
+func wrapText(faces *textFaces, text string, width int, breakWords bool) ([]string, bool) {
+	maxWidth := fixed.I(width)
+	var lines []string
+
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if faces.width(candidate) <= maxWidth {
+				line = candidate
+				continue
+			}
+
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			if !breakWords && faces.width(word) > maxWidth {
+				return nil, false
+			}
+			for faces.width(word) > maxWidth {
+				split := 1
+				for split < len([]rune(word)) && faces.width(string([]rune(word)[:split+1])) <= maxWidth {
+					split++
+				}
+				lines = append(lines, string([]rune(word)[:split]))
+				word = string([]rune(word)[split:])
+			}
+			line = word
+		}
+		lines = append(lines, line)
+	}
+	return lines, true
+}
+
+// TextLayout is text wrapped and sized to fit a box.
+type TextLayout struct {
+	Faces      *textFaces
+	Lines      []string
+	LineHeight int
+	Ascent     int
+	Descent    int
+}
+
+// height is from the top of the first line to the bottom of the last.
+func (l *TextLayout) height() int {
+	return (len(l.Lines)-1)*l.LineHeight + l.Ascent + l.Descent
+}
+
+// layoutText wraps the text at the given font size, reporting whether it
+// fits in a box of the given size.
+func layoutText(primary *opentype.Font, options TextOptions, size float64, width, height int, breakWords bool) (*TextLayout, bool, error) {
+	faces, err := newTextFaces(primary, size)
+	if err != nil {
+		return nil, false, err
+	}
+	lines, wrapped := wrapText(faces, options.Text, width, breakWords)
+	if !wrapped {
+		return nil, false, nil
+	}
+
+	metrics := faces.face(0).Metrics()
+	layout := &TextLayout{
+		Faces:      faces,
+		Lines:      lines,
+		LineHeight: int(math.Ceil(float64(metrics.Height.Ceil()) * options.LineSpacing)),
+		Ascent:     metrics.Ascent.Ceil(),
+		Descent:    metrics.Descent.Ceil(),
+	}
+	return layout, layout.height() <= height, nil
+}
+
+// fitText finds the largest font size from MaxSize down to MinSize at which
+// the wrapped text fits in a box of the given size. Words are only split
+// across lines if they do not fit whole even at MinSize, or if splitting
+// them allows text twice the size.
+func fitText(primary *opentype.Font, options TextOptions, width, height int) (*TextLayout, error) {
+	var layoutErr error
+	fitsAt := func(breakWords bool) func(size float64) bool {
+		return func(size float64) bool {
+			_, fits, err := layoutText(primary, options, size, width, height, breakWords)
+			if err != nil && layoutErr == nil {
+				layoutErr = err
+			}
+			return fits
+		}
+	}
+
+	wholeSize, wholeFits := largestFittingSize(options.MaxSize, options.MinSize, fitsAt(false))
+	brokenSize, brokenFits := largestFittingSize(options.MaxSize, options.MinSize, fitsAt(true))
+	if layoutErr != nil {
+		return nil, layoutErr
+	}
+	if !brokenFits {
+		return nil, newPrintError(CodeTextDoesNotFit, nil, "the text does not fit on the label even at %gpt", smallestSize(options.MaxSize, options.MinSize))
+	}
+
+	if wholeFits && brokenSize < 2*wholeSize {
+		layout, _, err := layoutText(primary, options, wholeSize, width, height, false)
+		return layout, err
+	}
+	layout, _, err := layoutText(primary, options, brokenSize, width, height, true)
+	return layout, err
+}
+
+// smallestSize is the smallest font size largestFittingSize tries.
+func smallestSize(maxSize, minSize float64) float64 {
+	return maxSize - math.Floor((maxSize-minSize)/fontSizeStep)*fontSizeStep
+}
+
+// largestFittingSize binary searches the font sizes from maxSize down to
+// minSize, in steps of fontSizeStep, for the largest at which fits reports
+// the content fits.
+func largestFittingSize(maxSize, minSize float64, fits func(size float64) bool) (float64, bool) {
+	steps := int(math.Floor((maxSize - minSize) / fontSizeStep))
+	sizeAt := func(step int) float64 {
+		return maxSize - float64(step)*fontSizeStep
+	}
+
+	if !fits(sizeAt(steps)) {
+		return 0, false
+	}
+
+	low, high := 0, steps
+	for low < high {
+		middle := (low + high) / 2
+		if fits(sizeAt(middle)) {
+			high = middle
+		} else {
+			low = middle + 1
+		}
+	}
+	return sizeAt(low), true
+}
+
+// render draws the laid out text in a box of the given size.
+func (l *TextLayout) render(options TextOptions, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	top := 0
+	switch options.VAlign {
+	case VAlignMiddle:
+		top = (height - l.height()) / 2
+	case VAlignBottom:
+		top = height - l.height()
+	}
+
+	for i, line := range l.Lines {
+		lineWidth := l.Faces.width(line).Ceil()
+		left := 0
+		switch options.Align {
+		case AlignCenter:
+			left = (width - lineWidth) / 2
+		case AlignRight:
+			left = width - lineWidth
+		}
+		l.Faces.draw(img, fixed.P(left, top+i*l.LineHeight+l.Ascent), line)
+	}
+	return img
+}
+
+// TextBarcodeGap is the space in dots between the text and a barcode
+// under it.
+const TextBarcodeGap = 24
+
+// renderTextLabel lays the text out in the printable area of the label,
+// with the barcode under it in up to half the height if there is one,
+// rotated as asked, and renders it to dots.
+func renderTextLabel(options TextOptions, format LabelFormat, dimensions LabelDimensions) (*RenderedLabel, error) {
+	primary, err := findFont(options.Font)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderPrintableArea(format, dimensions, options.Rotate, func(width, height int) (*image.RGBA, error) {
+		var code *BarcodeLayout
+		textHeight := height
+		if options.Barcode != nil {
+			code, err = layoutBarcode(options.Barcode, width, height/2)
+			if err != nil {
+				return nil, err
+			}
+			textHeight -= code.Size.Y + TextBarcodeGap
+		}
+
+		layout, err := fitText(primary, options, width, textHeight)
+		if err != nil {
+			return nil, err
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(img, img.Bounds(), layout.render(options, width, textHeight), image.Point{}, draw.Over)
+		if code != nil {
+			code.draw(img, image.Pt((width-code.Size.X)/2, height-code.Size.Y))
+		}
+		return img, nil
+	})
+}
+
+func textLabel(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		formatName := req.FormValue("format")
+		format, dimensions, exists := findLabelFormat(formatName)
+		if !exists {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "label format '%s' does not exist", formatName))
+			return
+		}
+
+		options, err := parseTextOptions(req)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		label, err := renderTextLabel(options, format, dimensions)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+
+		respondWithLabel(rw, req, label)
+	}
+}
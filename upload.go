@@ -0,0 +1,291 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// MaxUploadFiles limits how many files one request to /print prints,
+	// counting each file in a ZIP archive.
+	MaxUploadFiles = 100
+	// MaxUploadLabels limits how many labels one request to /print draws,
+	// counting every page of every file.
+	MaxUploadLabels = 100
+	// MaxUploadSize limits the size of a multipart request to /print, with
+	// every file in it.
+	MaxUploadSize = 100 << 20
+	// MaxArchiveFileSize limits the size of each file unpacked from a ZIP
+	// archive, so a small archive cannot fill the disk. Every file unpacked
+	// from the archives of one request together is limited to MaxUploadSize.
+	MaxArchiveFileSize = 20 << 20
+)
+
+// uploadRoom is how many more files a request may hold, and how many more
+// bytes may be unpacked from its archives.
+type uploadRoom struct {
+	files    int
+	unpacked int64
+}
+
+// isZip reports whether the file starts with a ZIP local file header.
+func isZip(file io.ReaderAt) bool {
+	header := make([]byte, 4)
+	n, _ := file.ReadAt(header, 0)
+	return string(header[:n]) == "PK\x03\x04"
+}
+
+// saveUpload copies an uploaded file into the upload directory under a name
+// of its own, so files with the same name in one request do not overwrite
+// each other.
+func saveUpload(name string, content io.Reader) (*LabelImage, error) {
+	out, err := os.CreateTemp(UploadDirectory, "upload-*")
+	if err != nil {
+		return nil, newPrintError(CodeInternal, err, "unable to create file for copying the form image")
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, content); err != nil {
+		os.Remove(out.Name())
+		return nil, newPrintError(CodeInternal, err, "unable to copy form content to file")
+	}
+
+	return &LabelImage{File: out, Name: name}, nil
+}
+
+// retrieveImagesFromForm saves every file sent in the form's image values,
+// in the order they were sent, unpacking ZIP archives into the files they
+// hold in the order they are stored. archived reports whether any came from
+// an archive.
+func retrieveImagesFromForm(req *http.Request) (uploads []*LabelImage, archived bool, err error) {
+	req.Body = http.MaxBytesReader(nil, req.Body, MaxUploadSize)
+	if err := req.ParseMultipartForm(10 << 20); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, false, newPrintError(CodeInvalidRequest, err, "uploads should be fewer than %dMB in total", MaxUploadSize>>20)
+		}
+		return nil, false, newPrintError(CodeInvalidRequest, err, "could not read the multipart form")
+	}
+
+	headers := req.MultipartForm.File["image"]
+	if len(headers) == 0 {
+		return nil, false, newPrintError(CodeInvalidRequest, nil, "form file not found at key 'image'")
+	}
+
+	logger := hlog.FromRequest(req).With().Logger()
+	room := uploadRoom{files: MaxUploadFiles, unpacked: MaxUploadSize}
+	for _, header := range headers {
+		files, fromArchive, err := retrieveFormFile(header, &room)
+		if err != nil {
+			removeUploads(logger, uploads)
+			return nil, false, err
+		}
+		uploads = append(uploads, files...)
+		archived = archived || fromArchive
+	}
+
+	hlog.FromRequest(req).Debug().
+		Int("Files", len(uploads)).
+		Bool("Archived", archived).
+		Msg("Retrieved images from form")
+	return uploads, archived, nil
+}
+
+// retrieveFormFile saves one file of the form, or the files in it if it is
+// a ZIP archive, taking them from the request's room.
+func retrieveFormFile(header *multipart.FileHeader, room *uploadRoom) ([]*LabelImage, bool, error) {
+	if room.files < 1 {
+		return nil, false, newPrintError(CodeInvalidRequest, nil, "at most %d files can be printed at once", MaxUploadFiles)
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, false, newPrintError(CodeInternal, err, "could not open form file '%s'", header.Filename)
+	}
+	defer file.Close()
+
+	upload, err := saveUpload(header.Filename, file)
+	if err != nil {
+		return nil, false, err
+	}
+	if !isZip(file) {
+		room.files--
+		return []*LabelImage{upload}, false, nil
+	}
+
+	defer os.Remove(upload.File.Name())
+	files, err := upload.unpack(room)
+	return files, true, err
+}
+
+// unpack saves each file in a ZIP archive as an upload of its own, skipping
+// directories and the hidden files archivers add.
+func (l *LabelImage) unpack(room *uploadRoom) ([]*LabelImage, error) {
+	archive, err := zip.OpenReader(l.File.Name())
+	if err != nil {
+		return nil, newPrintError(CodeInvalidRequest, err, "could not read '%s' as a ZIP archive", l.Name)
+	}
+	defer archive.Close()
+
+	var files []*LabelImage
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") || strings.HasPrefix(path.Base(entry.Name), ".") {
+			continue
+		}
+
+		var err error
+		switch {
+		case room.files == 0:
+			err = newPrintError(CodeInvalidRequest, nil, "at most %d files can be printed at once", MaxUploadFiles)
+		case entry.UncompressedSize64 > MaxArchiveFileSize:
+			err = newPrintError(CodeInvalidRequest, nil, "'%s' in '%s' is larger than %dMB", entry.Name, l.Name, MaxArchiveFileSize>>20)
+		case entry.UncompressedSize64 > uint64(room.unpacked):
+			err = newPrintError(CodeInvalidRequest, nil, "files unpacked from archives should be fewer than %dMB in total", MaxUploadSize>>20)
+		default:
+			var file *LabelImage
+			file, err = unpackFile(entry)
+			if err == nil {
+				files = append(files, file)
+				room.files--
+				room.unpacked -= int64(entry.UncompressedSize64)
+			}
+		}
+		if err != nil {
+			removeUploads(zerolog.Nop(), files)
+			return nil, err
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, newPrintError(CodeInvalidRequest, nil, "'%s' holds no files to print", l.Name)
+	}
+	return files, nil
+}
+
+func unpackFile(entry *zip.File) (*LabelImage, error) {
+	content, err := entry.Open()
+	if err != nil {
+		return nil, newPrintError(CodeInvalidRequest, err, "could not unpack '%s'", entry.Name)
+	}
+	defer content.Close()
+
+	file, err := saveUpload(entry.Name, content)
+	if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, newPrintError(CodeInvalidRequest, err, "could not unpack '%s'", entry.Name)
+	}
+	return file, err
+}
+
+func removeUploads(logger zerolog.Logger, uploads []*LabelImage) {
+	for _, upload := range uploads {
+		upload.remove(logger)
+	}
+}
+
+// UploadResult is what became of one label of a multi-file upload. A PDF
+// has a result for each page printed. Files skipped in partial mode have
+// the reason they could not be printed instead of a job.
+type UploadResult struct {
+	File      string     `json:"file"`
+	Job       *JobStatus `json:"job,omitempty"`
+	ErrorCode string     `json:"error_code,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// printUploads prints several uploaded files in order. Every file is drawn
+// and checked before any is queued: if any cannot be printed nothing is,
+// unless the request is partial, in which case the others are printed and
+// the bad files reported in their results.
+func printUploads(rw http.ResponseWriter, req *http.Request, printRequest *PrintRequest) {
+	uploads := printRequest.Uploads
+	labels := make([][]*RenderedLabel, len(uploads))
+	warnings := make([][][]string, len(uploads))
+	var problems []FileProblem
+	total := 0
+	for i, upload := range uploads {
+		var err error
+		labels[i], err = printRequest.labels(req.Context(), upload)
+		if total += len(labels[i]); total > MaxUploadLabels {
+			writeProblem(rw, req, newPrintError(CodeInvalidRequest, nil, "at most %d labels can be printed at once, counting every page", MaxUploadLabels))
+			return
+		}
+		if err == nil {
+			warnings[i], err = checkLabels(labels[i], printRequest.Strictness, printRequest.Printer, printRequest.PrintOptions)
+		}
+		if err == nil {
+			continue
+		}
+
+		var printErr *PrintError
+		if !errors.As(err, &printErr) || printErr.Code == CodeInternal {
+			writeProblem(rw, req, err)
+			return
+		}
+		labels[i] = nil
+		problems = append(problems, FileProblem{File: upload.Name, Code: printErr.Code, Detail: printErr.Detail})
+	}
+
+	if len(problems) > 0 && (!printRequest.Partial || len(problems) == len(uploads)) {
+		printErr := newPrintError(CodeInvalidUpload, nil, "%d of %d files cannot be printed, starting with '%s': %s", len(problems), len(uploads), problems[0].File, problems[0].Detail)
+		printErr.Files = problems
+		writeProblem(rw, req, printErr)
+		return
+	}
+
+	skipped := len(problems)
+	var results []UploadResult
+	var printJobs []*PrintJob
+	for i, upload := range uploads {
+		if labels[i] == nil {
+			problem := problems[0]
+			problems = problems[1:]
+			results = append(results, UploadResult{File: upload.Name, ErrorCode: problem.Code, Error: problem.Detail})
+			continue
+		}
+
+		jobs, err := queueLabels(hlog.FromRequest(req).With().Logger(), labels[i], warnings[i], printRequest.Printer, printRequest.PrintOptions)
+		if err != nil {
+			writeProblem(rw, req, err)
+			return
+		}
+		for _, printJob := range jobs {
+			results = append(results, UploadResult{File: upload.Name})
+			printJobs = append(printJobs, printJob)
+		}
+	}
+	hlog.FromRequest(req).Info().
+		Int("Files", len(uploads)).
+		Int("Jobs", len(printJobs)).
+		Int("Skipped", skipped).
+		Msg("Printing upload")
+
+	waitForJobs(req, printJobs)
+
+	allCompleted := true
+	for i := range results {
+		if results[i].ErrorCode != "" {
+			continue
+		}
+		status := printJobs[0].Status()
+		printJobs = printJobs[1:]
+		results[i].Job = &status
+		if status.State != JobCompleted {
+			allCompleted = false
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !allCompleted {
+		rw.WriteHeader(http.StatusAccepted)
+	}
+	writeJSON(rw, req, results)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	SysfsUSBDevicesDirectory = "/sys/bus/usb/devices"
+	BrotherVendorID          = "04f9"
+)
+
+// USBDevice is a Brother printer found in sysfs.
+type USBDevice struct {
+	SysfsPath string `json:"-"`
+	Vendor    string `json:"vendor"`
+	Product   string `json:"product"`
+	Model     string `json:"model"`
+	Serial    string `json:"serial"`
+}
+
+// Port is the brother_ql printer identifier for this exact device.
+func (d USBDevice) Port() string {
+	return usbPort(d.Vendor, d.Product, d.Serial)
+}
+
+func usbPort(vendor, product, serial string) string {
+	port := fmt.Sprintf("usb://0x%s:0x%s", vendor, product)
+	if serial != "" {
+		port += "/" + serial
+	}
+	return port
+}
+
+// modelPort builds the port for a model, optionally pinned to one serial.
+func modelPort(model, serial string) (string, error) {
+	printerModel, exists := findPrinterModel(model)
+	if !exists {
+		return "", fmt.Errorf("unknown printer model '%s'", model)
+	}
+	return usbPort(BrotherVendorID, printerModel.ProductID, serial), nil
+}
+
+func modelForProduct(product string) string {
+	for name, model := range printerModels {
+		if model.ProductID == product {
+			return name
+		}
+	}
+	return ""
+}
+
+// parseUSBPort splits a brother_ql port such as usb://0x04f9:0x2015 or
+// usb://0x04f9:0x2015/000M6Z401370 into the lower case, unprefixed vendor
+// and product IDs used in sysfs and the optional serial number.
+func parseUSBPort(port string) (string, string, string, error) {
+	ids, found := strings.CutPrefix(port, "usb://")
+	if !found {
+		return "", "", "", fmt.Errorf("port '%s' is not a usb:// port", port)
+	}
+	ids, serial, _ := strings.Cut(ids, "/")
+
+	vendor, product, found := strings.Cut(ids, ":")
+	if !found {
+		return "", "", "", fmt.Errorf("port '%s' must be usb://<vendor>:<product>[/<serial>]", port)
+	}
+
+	vendor = strings.ToLower(strings.TrimPrefix(vendor, "0x"))
+	product = strings.ToLower(strings.TrimPrefix(product, "0x"))
+	return vendor, product, serial, nil
+}
+
+func readSysfsAttribute(devicePath, name string) string {
+	value, err := os.ReadFile(filepath.Join(devicePath, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// discoverUSBPrinters lists every Brother USB device currently attached.
+func discoverUSBPrinters() ([]USBDevice, error) {
+	devicePaths, err := filepath.Glob(filepath.Join(SysfsUSBDevicesDirectory, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []USBDevice
+	for _, devicePath := range devicePaths {
+		if device, found := readUSBDevice(devicePath); found {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices, nil
+}
+
+func readUSBDevice(devicePath string) (USBDevice, bool) {
+	vendor := readSysfsAttribute(devicePath, "idVendor")
+	if vendor != BrotherVendorID {
+		return USBDevice{}, false
+	}
+
+	product := readSysfsAttribute(devicePath, "idProduct")
+	return USBDevice{
+		SysfsPath: devicePath,
+		Vendor:    vendor,
+		Product:   product,
+		Model:     modelForProduct(product),
+		Serial:    readSysfsAttribute(devicePath, "serial"),
+	}, true
+}
+
+// findUSBDevice returns the sysfs directory of the first USB device matching
+// the port's vendor, product and, if the port has one, serial number.
+func findUSBDevice(port string) (string, error) {
+	vendor, product, serial, err := parseUSBPort(port)
+	if err != nil {
+		return "", err
+	}
+
+	devices, err := discoverUSBPrinters()
+	if err != nil {
+		return "", err
+	}
+
+	for _, device := range devices {
+		if device.Vendor != vendor || device.Product != product {
+			continue
+		}
+		if serial != "" && device.Serial != serial {
+			continue
+		}
+		return device.SysfsPath, nil
+	}
+
+	return "", nil
+}
+
+// warnMissingPrinters warns about configured printers that are not plugged
+// in, which is the usual sign of a mistyped serial number.
+func warnMissingPrinters() {
+	for _, queue := range allPrintQueues() {
+		devicePath, err := findUSBDevice(queue.Printer.Port)
+		if err != nil || devicePath == "" {
+			log.Warn().
+				Str("printer", queue.Printer.Name).
+				Str("port", queue.Printer.Port).
+				Msg("Configured printer is not attached")
+		}
+	}
+}